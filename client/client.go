@@ -2,13 +2,20 @@ package client
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/bruce-mig/stock-exchange/orderbook"
 	"github.com/bruce-mig/stock-exchange/server"
+	"github.com/ethereum/go-ethereum/crypto"
 	_ "github.com/joho/godotenv/autoload"
 )
 
@@ -17,25 +24,142 @@ var Endpoint = os.Getenv("SERVER_ENDPOINT")
 type (
 	Client struct {
 		*http.Client
+		// UserID and key sign the requests on the orders and settings of
+		// the user, see NewUserClient. A client with an API key sends it
+		// instead, see NewAPIKeyClient.
+		UserID    string
+		key       *ecdsa.PrivateKey
+		apiKey    string
+		apiSecret string
+	}
+
+	// APIError is the error returned for a request the exchange refused.
+	// Code is set for errors the caller may want to handle, like
+	// server.ErrCodeInsufficientLiquidity.
+	APIError struct {
+		StatusCode int
+		Code       string
+		Message    string
 	}
 
 	PlaceOrderParams struct {
+		Market string
+		// UserID defaults to the user of the client, the only user it can
+		// place orders for.
 		UserID string
 		Bid    bool
 		// Price only needed for placing LIMIT orders
-		Price float64
-		Size  float64
+		Price orderbook.Decimal
+		Size  orderbook.Decimal
+		// StopPrice only needed for placing STOP and STOP_LIMIT orders
+		StopPrice orderbook.Decimal
+		// DisplaySize turns a LIMIT or STOP_LIMIT order into an iceberg
+		// order that only shows DisplaySize in the book.
+		DisplaySize orderbook.Decimal
+		// TimeInForce and ExpiresAt only apply to LIMIT and STOP_LIMIT orders
+		TimeInForce orderbook.TimeInForce
+		ExpiresAt   int64
+		// LiquidityPolicy and ProtectionPrice only apply to MARKET and STOP
+		// orders
+		LiquidityPolicy orderbook.LiquidityPolicy
+		ProtectionPrice orderbook.Decimal
+		// SelfTradePrevention defaults to the mode of the user
+		SelfTradePrevention orderbook.SelfTradePrevention
 	}
 )
 
+func (e *APIError) Error() string {
+	return fmt.Sprintf("exchange error [status: %d]: %s", e.StatusCode, e.Message)
+}
+
 func NewClient() *Client {
 	return &Client{
 		Client: http.DefaultClient,
 	}
 }
 
-func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
-	e := fmt.Sprintf("%s/trades/%s", Endpoint, market)
+// NewUserClient returns a client that signs its requests with the key of the
+// user. Only its user's orders can be placed, amended and cancelled with it.
+func NewUserClient(userID string, key *ecdsa.PrivateKey) *Client {
+	return &Client{
+		Client: http.DefaultClient,
+		UserID: userID,
+		key:    key,
+	}
+}
+
+// NewAPIKeyClient returns a client that authenticates its requests with an API
+// key of the user, it can only do what the scopes of the key allow.
+func NewAPIKeyClient(userID, apiKey, apiSecret string) *Client {
+	return &Client{
+		Client:    http.DefaultClient,
+		UserID:    userID,
+		apiKey:    apiKey,
+		apiSecret: apiSecret,
+	}
+}
+
+// newNonce returns a random nonce for a signed request.
+func newNonce() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// newAuthRequest returns a request authenticated as the user of the client:
+// with its API key, or signed with its key, see server.RequestHash.
+func (c *Client) newAuthRequest(method, url string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.apiKey != "" {
+		req.Header.Set(server.HeaderAPIKey, c.apiKey)
+		req.Header.Set(server.HeaderAPISecret, c.apiSecret)
+		return req, nil
+	}
+	if c.key == nil {
+		return nil, fmt.Errorf("client has no key to sign %s %s", method, url)
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	timestamp := time.Now().UnixNano()
+	sig, err := crypto.Sign(server.RequestHash(method, req.URL.RequestURI(), timestamp, nonce, body), c.key)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set(server.HeaderUserID, c.UserID)
+	req.Header.Set(server.HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(server.HeaderNonce, nonce)
+	req.Header.Set(server.HeaderSignature, hex.EncodeToString(sig))
+	return req, nil
+}
+
+// GetTrades returns a page of the trades of the market selected by the filter.
+// Pass the Seq of the last trade as Since to get the next page.
+func (c *Client) GetTrades(market string, filter orderbook.TradeFilter) ([]server.PublicTrade, error) {
+	query := url.Values{}
+	if filter.Since > 0 {
+		query.Set("since", strconv.FormatUint(filter.Since, 10))
+	}
+	if filter.From > 0 {
+		query.Set("from", strconv.FormatInt(filter.From, 10))
+	}
+	if filter.To > 0 {
+		query.Set("to", strconv.FormatInt(filter.To, 10))
+	}
+	if filter.Limit > 0 {
+		query.Set("limit", strconv.Itoa(filter.Limit))
+	}
+
+	e := fmt.Sprintf("%s/trades/%s?%s", Endpoint, market, query.Encode())
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -45,8 +169,13 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
 
-	trades := []*orderbook.Trade{}
+	trades := []server.PublicTrade{}
 
 	if err := json.NewDecoder(res.Body).Decode(&trades); err != nil {
 		return nil, err
@@ -56,8 +185,19 @@ func (c *Client) GetTrades(market string) ([]*orderbook.Trade, error) {
 
 }
 
-func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
-	e := fmt.Sprintf("%s/order/user/%d", Endpoint, userID)
+// GetCandles returns the candles of the interval of the market that start from
+// from up to, not including, to (unix nano). Zero values do not filter.
+func (c *Client) GetCandles(market string, interval server.Interval, from, to int64) ([]server.Candle, error) {
+	query := url.Values{}
+	query.Set("interval", string(interval))
+	if from > 0 {
+		query.Set("from", strconv.FormatInt(from, 10))
+	}
+	if to > 0 {
+		query.Set("to", strconv.FormatInt(to, 10))
+	}
+
+	e := fmt.Sprintf("%s/candles/%s?%s", Endpoint, market, query.Encode())
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
@@ -67,30 +207,60 @@ func (c *Client) GetOrders(userID int64) (*server.GetOrdersResponse, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	orders := &server.GetOrdersResponse{}
-	if err := json.NewDecoder(res.Body).Decode(orders); err != nil {
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	candles := []server.Candle{}
+	if err := json.NewDecoder(res.Body).Decode(&candles); err != nil {
 		return nil, err
 	}
-	return orders, nil
+
+	return candles, nil
 }
 
-func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
-	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.MarketOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Market: server.MarketINN,
+// GetTicker returns the statistics of the trades of the market in the last 24
+// hours.
+func (c *Client) GetTicker(market string) (*server.Ticker, error) {
+	e := fmt.Sprintf("%s/ticker/%s", Endpoint, market)
+	req, err := http.NewRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	body, err := json.Marshal(params)
+	res, err := c.Do(req)
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	e := Endpoint + "/order"
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	ticker := &server.Ticker{}
+	if err := json.NewDecoder(res.Body).Decode(ticker); err != nil {
+		return nil, err
+	}
+
+	return ticker, nil
+}
+
+// GetDepth returns levels price levels of each side of the market, merged into
+// buckets of group when it is not zero.
+func (c *Client) GetDepth(market string, levels int, group orderbook.Decimal) (*server.DepthResponse, error) {
+	query := url.Values{}
+	if levels > 0 {
+		query.Set("levels", strconv.Itoa(levels))
+	}
+	if !group.IsZero() {
+		query.Set("group", group.String())
+	}
+
+	e := fmt.Sprintf("%s/depth/%s?%s", Endpoint, market, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -99,16 +269,63 @@ func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderRespon
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
 
-	placeOrderResponse := &server.PlaceOrderResponse{}
-	if err := json.NewDecoder(res.Body).Decode(placeOrderResponse); err != nil {
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	depth := &server.DepthResponse{}
+	if err := json.NewDecoder(res.Body).Decode(depth); err != nil {
 		return nil, err
 	}
-	return placeOrderResponse, nil
+
+	return depth, nil
+}
+
+// GetOrders returns the orders of the user of the client.
+func (c *Client) GetOrders() (*server.GetOrdersResponse, error) {
+	e := fmt.Sprintf("%s/order/user/%s", Endpoint, c.UserID)
+	req, err := c.newAuthRequest(http.MethodGet, e, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	orders := &server.GetOrdersResponse{}
+	if err := json.NewDecoder(res.Body).Decode(orders); err != nil {
+		return nil, err
+	}
+	return orders, nil
+}
+
+func (c *Client) PlaceMarketOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	params := &server.PlaceOrderRequest{
+		UserID:          p.UserID,
+		Type:            server.MarketOrder,
+		Bid:             p.Bid,
+		Size:            p.Size,
+		Market:          server.Market(p.Market),
+		LiquidityPolicy: p.LiquidityPolicy,
+		ProtectionPrice: p.ProtectionPrice,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+	}
+
+	return c.placeOrder(params)
 }
 
-func (c *Client) GetBestBid() (*server.Order, error) {
-	e := fmt.Sprintf("%s/book/%s/bestBid", Endpoint, server.MarketINN)
+func (c *Client) GetBestBid(market string) (*server.BestPriceResponse, error) {
+	e := fmt.Sprintf("%s/book/%s/bestBid", Endpoint, market)
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -120,15 +337,15 @@ func (c *Client) GetBestBid() (*server.Order, error) {
 		return nil, err
 	}
 
-	order := &server.Order{}
-	if err := json.NewDecoder(res.Body).Decode(order); err != nil {
+	best := &server.BestPriceResponse{}
+	if err := json.NewDecoder(res.Body).Decode(best); err != nil {
 		return nil, err
 	}
-	return order, err
+	return best, err
 }
 
-func (c *Client) GetBestAsk() (*server.Order, error) {
-	e := fmt.Sprintf("%s/book/%s/bestAsk", Endpoint, server.MarketINN)
+func (c *Client) GetBestAsk(market string) (*server.BestPriceResponse, error) {
+	e := fmt.Sprintf("%s/book/%s/bestAsk", Endpoint, market)
 
 	req, err := http.NewRequest(http.MethodGet, e, nil)
 	if err != nil {
@@ -140,49 +357,151 @@ func (c *Client) GetBestAsk() (*server.Order, error) {
 		return nil, err
 	}
 
-	order := &server.Order{}
-	if err := json.NewDecoder(res.Body).Decode(order); err != nil {
+	best := &server.BestPriceResponse{}
+	if err := json.NewDecoder(res.Body).Decode(best); err != nil {
 		return nil, err
 	}
-	return order, err
+	return best, err
 }
 
 func (c *Client) CancelOrder(orderID int64) error {
 	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
-	req, err := http.NewRequest(http.MethodDelete, e, nil)
+	req, err := c.newAuthRequest(http.MethodDelete, e, nil)
 	if err != nil {
 		return err
 	}
 
-	_, err = c.Do(req)
+	res, err := c.Do(req)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return decodeAPIError(res)
+	}
 	return nil
 }
 
+// AmendOrder changes the price and the size of a resting limit order, keeping
+// its ID. A zero price keeps the current price.
+func (c *Client) AmendOrder(orderID int64, price, size orderbook.Decimal) (*server.PlaceOrderResponse, error) {
+	body, err := json.Marshal(&server.AmendOrderRequest{Price: price, Size: size})
+	if err != nil {
+		return nil, err
+	}
+
+	e := fmt.Sprintf("%s/order/%d", Endpoint, orderID)
+	req, err := c.newAuthRequest(http.MethodPut, e, body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	amendOrderResponse := &server.PlaceOrderResponse{}
+	if err := json.NewDecoder(res.Body).Decode(amendOrderResponse); err != nil {
+		return nil, err
+	}
+	return amendOrderResponse, nil
+}
+
 func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
 
-	if p.Size == 0.0 {
+	if p.Size.IsZero() {
 		return nil, fmt.Errorf("size cannot be 0 when placing a limit order")
 	}
 
 	params := &server.PlaceOrderRequest{
-		UserID: p.UserID,
-		Type:   server.LimitOrder,
-		Bid:    p.Bid,
-		Size:   p.Size,
-		Price:  p.Price,
-		Market: server.MarketINN,
+		UserID:      p.UserID,
+		Type:        server.LimitOrder,
+		Bid:         p.Bid,
+		Size:        p.Size,
+		Price:       p.Price,
+		DisplaySize: p.DisplaySize,
+		Market:      server.Market(p.Market),
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+
+		SelfTradePrevention: p.SelfTradePrevention,
+	}
+
+	return c.placeOrder(params)
+}
+
+// PlaceStopOrder places a STOP order, or a STOP_LIMIT order when a limit
+// price is given.
+func (c *Client) PlaceStopOrder(p *PlaceOrderParams) (*server.PlaceOrderResponse, error) {
+	if p.StopPrice.IsZero() {
+		return nil, fmt.Errorf("stop price cannot be 0 when placing a stop order")
+	}
+
+	params := &server.PlaceOrderRequest{
+		UserID:      p.UserID,
+		Type:        server.StopOrder,
+		Bid:         p.Bid,
+		Size:        p.Size,
+		StopPrice:   p.StopPrice,
+		Market:      server.Market(p.Market),
+		TimeInForce: p.TimeInForce,
+		ExpiresAt:   p.ExpiresAt,
+
+		LiquidityPolicy:     p.LiquidityPolicy,
+		ProtectionPrice:     p.ProtectionPrice,
+		SelfTradePrevention: p.SelfTradePrevention,
 	}
 
+	if !p.Price.IsZero() {
+		params.Type = server.StopLimitOrder
+		params.Price = p.Price
+		params.DisplaySize = p.DisplaySize
+	}
+
+	return c.placeOrder(params)
+}
+
+// SetSelfTradePrevention sets the self-trade prevention mode used for the
+// orders of the user of the client that do not set one.
+func (c *Client) SetSelfTradePrevention(mode orderbook.SelfTradePrevention) error {
+	body, err := json.Marshal(&server.SelfTradePreventionRequest{SelfTradePrevention: mode})
+	if err != nil {
+		return err
+	}
+
+	e := fmt.Sprintf("%s/user/%s/stp", Endpoint, c.UserID)
+	req, err := c.newAuthRequest(http.MethodPut, e, body)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return decodeAPIError(res)
+	}
+	return nil
+}
+
+func (c *Client) placeOrder(params *server.PlaceOrderRequest) (*server.PlaceOrderResponse, error) {
 	body, err := json.Marshal(params)
 	if err != nil {
 		return nil, err
 	}
 
 	e := Endpoint + "/order"
-	req, err := http.NewRequest(http.MethodPost, e, bytes.NewReader(body))
+	req, err := c.newAuthRequest(http.MethodPost, e, body)
 	if err != nil {
 		return nil, err
 	}
@@ -191,6 +510,11 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 	if err != nil {
 		return nil, err
 	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
 
 	placeOrderResponse := &server.PlaceOrderResponse{}
 	if err := json.NewDecoder(res.Body).Decode(placeOrderResponse); err != nil {
@@ -198,3 +522,93 @@ func (c *Client) PlaceLimitOrder(p *PlaceOrderParams) (*server.PlaceOrderRespons
 	}
 	return placeOrderResponse, nil
 }
+
+// CreateAPIKey creates an API key for the user of the client. The secret of the
+// key is only returned here.
+func (c *Client) CreateAPIKey(params server.CreateAPIKeyRequest) (*server.CreateAPIKeyResponse, error) {
+	body, err := json.Marshal(&params)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := c.newAuthRequest(http.MethodPost, Endpoint+"/apikeys", body)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	key := &server.CreateAPIKeyResponse{}
+	if err := json.NewDecoder(res.Body).Decode(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GetAPIKeys returns the API keys of the user of the client, without their
+// secrets.
+func (c *Client) GetAPIKeys() ([]server.APIKey, error) {
+	req, err := c.newAuthRequest(http.MethodGet, Endpoint+"/apikeys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, decodeAPIError(res)
+	}
+
+	keys := []server.APIKey{}
+	if err := json.NewDecoder(res.Body).Decode(&keys); err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey revokes an API key of the user of the client.
+func (c *Client) RevokeAPIKey(id string) error {
+	e := fmt.Sprintf("%s/apikeys/%s", Endpoint, id)
+	req, err := c.newAuthRequest(http.MethodDelete, e, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return decodeAPIError(res)
+	}
+	return nil
+}
+
+// decodeAPIError turns a response the exchange did not accept into an
+// *APIError.
+func decodeAPIError(res *http.Response) error {
+	apiErr := server.APIError{}
+	if err := json.NewDecoder(res.Body).Decode(&apiErr); err != nil {
+		apiErr.Error = res.Status
+	}
+
+	return &APIError{
+		StatusCode: res.StatusCode,
+		Code:       apiErr.Code,
+		Message:    apiErr.Error,
+	}
+}
@@ -0,0 +1,124 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bruce-mig/stock-exchange/server"
+	"github.com/gorilla/websocket"
+)
+
+// ErrSequenceGap is returned by MarketDataStream.Next for an update that does
+// not follow the previous message of its channel. Subscribe to the channel
+// again to get a new snapshot.
+var ErrSequenceGap = errors.New("market data sequence gap")
+
+type (
+	// MarketDataStream is a connection to the market data WebSocket of the
+	// exchange.
+	MarketDataStream struct {
+		conn *websocket.Conn
+		// seq is the sequence number of the last message of every
+		// subscribed channel.
+		seq map[subscription]uint64
+	}
+
+	subscription struct {
+		market  server.Market
+		channel server.Channel
+	}
+)
+
+// SubscribeMarketData connects to the market data WebSocket and subscribes to
+// the channels of the market.
+func (c *Client) SubscribeMarketData(market string, channels ...server.Channel) (*MarketDataStream, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(wsEndpoint("/ws/marketdata"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &MarketDataStream{
+		conn: conn,
+		seq:  make(map[subscription]uint64),
+	}
+	for _, ch := range channels {
+		if err := s.Subscribe(market, ch); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// wsEndpoint returns the WebSocket URL of the path on the exchange.
+func wsEndpoint(path string) string {
+	endpoint := strings.Replace(Endpoint, "http", "ws", 1)
+	return endpoint + path
+}
+
+// Subscribe subscribes to the channel of the market, the snapshot of the
+// channel is the next message of it. Subscribing again to a channel after a
+// sequence gap starts it over with a new snapshot.
+func (s *MarketDataStream) Subscribe(market string, ch server.Channel) error {
+	sub := subscription{market: server.Market(market), channel: ch}
+	if _, ok := s.seq[sub]; ok {
+		if err := s.Unsubscribe(market, ch); err != nil {
+			return err
+		}
+	}
+
+	return s.conn.WriteJSON(server.SubscribeRequest{
+		Op:      server.OpSubscribe,
+		Channel: ch,
+		Market:  server.Market(market),
+	})
+}
+
+// Unsubscribe stops the updates of the channel of the market.
+func (s *MarketDataStream) Unsubscribe(market string, ch server.Channel) error {
+	delete(s.seq, subscription{market: server.Market(market), channel: ch})
+
+	return s.conn.WriteJSON(server.SubscribeRequest{
+		Op:      server.OpUnsubscribe,
+		Channel: ch,
+		Market:  server.Market(market),
+	})
+}
+
+// Next waits for the next message of the subscribed channels. Updates of a
+// channel without its snapshot, which can still arrive right after
+// unsubscribing, are skipped.
+func (s *MarketDataStream) Next() (*server.MarketDataMessage, error) {
+	for {
+		msg := &server.MarketDataMessage{}
+		if err := s.conn.ReadJSON(msg); err != nil {
+			return nil, err
+		}
+
+		sub := subscription{market: msg.Market, channel: msg.Channel}
+		switch msg.Type {
+		case server.MessageError:
+			return nil, fmt.Errorf("market data error: %s", msg.Error)
+		case server.MessageSnapshot:
+			s.seq[sub] = msg.Seq
+		case server.MessageUpdate:
+			last, ok := s.seq[sub]
+			if !ok {
+				continue
+			}
+			if msg.Seq != last+1 {
+				return msg, fmt.Errorf("%w: %s %s update %d after %d", ErrSequenceGap, msg.Market, msg.Channel, msg.Seq, last)
+			}
+			s.seq[sub] = msg.Seq
+		}
+
+		return msg, nil
+	}
+}
+
+// Close closes the connection.
+func (s *MarketDataStream) Close() error {
+	return s.conn.Close()
+}
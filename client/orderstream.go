@@ -0,0 +1,84 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/server"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+)
+
+// OrderStream is an authenticated connection to the order WebSocket of the
+// exchange, it receives the events of the orders of one user.
+type OrderStream struct {
+	conn *websocket.Conn
+}
+
+// SubscribeOrders connects to the order WebSocket and authenticates as the
+// user with its private key.
+func (c *Client) SubscribeOrders(userID string, key *ecdsa.PrivateKey) (*OrderStream, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(wsEndpoint("/ws/orders"), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	timestamp := time.Now().UnixNano()
+	sig, err := crypto.Sign(server.AuthHash(userID, timestamp, nonce), key)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	auth := server.AuthRequest{
+		UserID:    userID,
+		Timestamp: timestamp,
+		Nonce:     nonce,
+		Signature: hex.EncodeToString(sig),
+	}
+	if err := conn.WriteJSON(auth); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	msg := server.OrderStreamMessage{}
+	if err := conn.ReadJSON(&msg); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if msg.Type != server.MessageAuthenticated {
+		conn.Close()
+		return nil, fmt.Errorf("order stream authentication failed: %s", msg.Error)
+	}
+
+	return &OrderStream{conn: conn}, nil
+}
+
+// Next waits for the next event of an order of the user.
+func (s *OrderStream) Next() (*server.OrderEvent, error) {
+	for {
+		msg := server.OrderStreamMessage{}
+		if err := s.conn.ReadJSON(&msg); err != nil {
+			return nil, err
+		}
+
+		switch msg.Type {
+		case server.MessageOrder:
+			return msg.Event, nil
+		case server.MessageError:
+			return nil, fmt.Errorf("order stream error: %s", msg.Error)
+		}
+	}
+}
+
+// Close closes the connection.
+func (s *OrderStream) Close() error {
+	return s.conn.Close()
+}
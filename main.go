@@ -1,13 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 
 	"github.com/bruce-mig/stock-exchange/client"
 	mm "github.com/bruce-mig/stock-exchange/marketmaker"
+	"github.com/bruce-mig/stock-exchange/orderbook"
 	"github.com/bruce-mig/stock-exchange/server"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func main() {
@@ -19,16 +23,26 @@ func main() {
 	//wait for server to boot up before client sends request
 	time.Sleep(1 * time.Second)
 
-	c := client.NewClient()
+	// the market maker trades as user 1, the market orders are placed by
+	// user 2.
+	makerClient, err := newUserClient("CSD000000000001-0001", "USER_1_PK")
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := newUserClient("CSD000000000002-0001", "USER_2_PK")
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	cfg := mm.Config{
 		UserID:         "CSD000000000001-0001",
-		OrderSize:      200, //original 10
-		MinSpread:      20,
+		Market:         string(server.MarketINN),
+		OrderSize:      orderbook.NewDecimal(200), //original 10
+		MinSpread:      orderbook.NewDecimal(20),
 		MakeInterval:   1 * time.Second,
-		SeedOffset:     40,
-		ExchangeClient: c,
-		PriceOffset:    10,
+		SeedOffset:     orderbook.NewDecimal(40),
+		ExchangeClient: makerClient,
+		PriceOffset:    orderbook.NewDecimal(10),
 	}
 
 	maker := mm.NewMarketMaker(cfg)
@@ -41,6 +55,16 @@ func main() {
 	select {} // block main
 }
 
+// newUserClient returns a client signing with the private key of the user in
+// the env var.
+func newUserClient(userID, env string) (*client.Client, error) {
+	key, err := crypto.HexToECDSA(os.Getenv(env))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", env, err)
+	}
+	return client.NewUserClient(userID, key), nil
+}
+
 func marketOrderPlacer(c *client.Client) {
 	ticker := time.NewTicker(500 * time.Millisecond)
 
@@ -53,13 +77,14 @@ func marketOrderPlacer(c *client.Client) {
 
 		order := &client.PlaceOrderParams{
 			UserID: "CSD000000000002-0001",
+			Market: string(server.MarketINN),
 			Bid:    bid,
-			Size:   10,
+			Size:   orderbook.NewDecimal(10),
 		}
 
 		_, err := c.PlaceMarketOrder(order)
 		if err != nil {
-			panic(err)
+			log.Println(err)
 		}
 
 		<-ticker.C
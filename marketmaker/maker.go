@@ -4,26 +4,29 @@ import (
 	"time"
 
 	"github.com/bruce-mig/stock-exchange/client"
+	"github.com/bruce-mig/stock-exchange/orderbook"
 	"github.com/sirupsen/logrus"
 )
 
 type (
 	Config struct {
 		UserID         string
-		OrderSize      float64
-		MinSpread      float64
-		SeedOffset     float64
+		Market         string
+		OrderSize      orderbook.Decimal
+		MinSpread      orderbook.Decimal
+		SeedOffset     orderbook.Decimal
 		ExchangeClient *client.Client
 		MakeInterval   time.Duration
-		PriceOffset    float64
+		PriceOffset    orderbook.Decimal
 	}
 
 	MarketMaker struct {
 		userID         string
-		orderSize      float64
-		minSpread      float64
-		seedOffset     float64
-		priceOffset    float64
+		market         string
+		orderSize      orderbook.Decimal
+		minSpread      orderbook.Decimal
+		seedOffset     orderbook.Decimal
+		priceOffset    orderbook.Decimal
 		exchangeClient *client.Client
 		makeInterval   time.Duration
 	}
@@ -32,6 +35,7 @@ type (
 func NewMarketMaker(cfg Config) *MarketMaker {
 	return &MarketMaker{
 		userID:         cfg.UserID,
+		market:         cfg.Market,
 		orderSize:      cfg.OrderSize,
 		minSpread:      cfg.MinSpread,
 		seedOffset:     cfg.SeedOffset,
@@ -57,19 +61,19 @@ func (mm *MarketMaker) makerLoop() {
 	ticker := time.NewTicker(mm.makeInterval)
 
 	for {
-		bestBid, err := mm.exchangeClient.GetBestBid()
+		bestBid, err := mm.exchangeClient.GetBestBid(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		bestAsk, err := mm.exchangeClient.GetBestAsk()
+		bestAsk, err := mm.exchangeClient.GetBestAsk(mm.market)
 		if err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		if bestAsk.Price == 0.0 && bestBid.Price == 0.0 {
+		if bestAsk.Price.IsZero() && bestBid.Price.IsZero() {
 			if err := mm.seedMarket(); err != nil {
 				logrus.Error(err)
 				break
@@ -77,26 +81,26 @@ func (mm *MarketMaker) makerLoop() {
 			continue
 		}
 
-		if bestBid.Price == 0 {
-			bestBid.Price = bestAsk.Price - mm.priceOffset*2
+		if bestBid.Price.IsZero() {
+			bestBid.Price = bestAsk.Price.Sub(mm.priceOffset.Add(mm.priceOffset))
 		}
 
-		if bestAsk.Price == 0 {
-			bestAsk.Price = bestBid.Price + mm.priceOffset*2
+		if bestAsk.Price.IsZero() {
+			bestAsk.Price = bestBid.Price.Add(mm.priceOffset.Add(mm.priceOffset))
 		}
 
-		spread := bestAsk.Price - bestBid.Price
+		spread := bestAsk.Price.Sub(bestBid.Price)
 
-		if spread <= mm.minSpread {
+		if spread.LessThanOrEqual(mm.minSpread) {
 			continue
 		}
 
-		if err := mm.placeOrder(true, bestBid.Price+mm.priceOffset); err != nil {
+		if err := mm.placeOrder(true, bestBid.Price.Add(mm.priceOffset)); err != nil {
 			logrus.Error(err)
 			break
 		}
 
-		if err := mm.placeOrder(false, bestAsk.Price-mm.priceOffset); err != nil {
+		if err := mm.placeOrder(false, bestAsk.Price.Sub(mm.priceOffset)); err != nil {
 			logrus.Error(err)
 			break
 		}
@@ -105,9 +109,10 @@ func (mm *MarketMaker) makerLoop() {
 	}
 }
 
-func (mm *MarketMaker) placeOrder(bid bool, price float64) error {
+func (mm *MarketMaker) placeOrder(bid bool, price orderbook.Decimal) error {
 	bidOrder := &client.PlaceOrderParams{
 		UserID: mm.userID,
+		Market: mm.market,
 		Size:   mm.orderSize,
 		Bid:    bid,
 		Price:  price,
@@ -127,9 +132,10 @@ func (mm *MarketMaker) seedMarket() error {
 
 	bidOrder := &client.PlaceOrderParams{
 		UserID: mm.userID,
+		Market: mm.market,
 		Size:   mm.orderSize,
 		Bid:    true,
-		Price:  currentPrice - mm.seedOffset,
+		Price:  currentPrice.Sub(mm.seedOffset),
 	}
 
 	_, err := mm.exchangeClient.PlaceLimitOrder(bidOrder)
@@ -139,9 +145,10 @@ func (mm *MarketMaker) seedMarket() error {
 
 	askOrder := &client.PlaceOrderParams{
 		UserID: mm.userID,
+		Market: mm.market,
 		Size:   mm.orderSize,
 		Bid:    false,
-		Price:  currentPrice + mm.seedOffset,
+		Price:  currentPrice.Add(mm.seedOffset),
 	}
 
 	_, err = mm.exchangeClient.PlaceLimitOrder(askOrder)
@@ -151,8 +158,8 @@ func (mm *MarketMaker) seedMarket() error {
 
 // this will simulate a call to another exchange fetching
 // the current INN price so we can offset both for bid and ask.
-func simulateFetchCurrentINNPrice() float64 {
+func simulateFetchCurrentINNPrice() orderbook.Decimal {
 	time.Sleep(80 * time.Millisecond)
 
-	return 1000.0
+	return orderbook.NewDecimal(1000)
 }
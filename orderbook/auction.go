@@ -0,0 +1,242 @@
+package orderbook
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrAuctionInProgress is returned for a market order placed while the book
+// is in a call auction.
+var ErrAuctionInProgress = errors.New("market orders are not accepted during a call auction")
+
+// AuctionResult is the outcome of uncrossing the book at Price.
+type AuctionResult struct {
+	Price  Decimal
+	Volume Decimal
+	// Surplus is the volume left unmatched at Price, positive when it is
+	// on the bid side and negative when it is on the ask side.
+	Surplus Decimal
+}
+
+// StartAuction puts the book into a call auction. Limit orders collect in the
+// book without matching, even when they cross, until Uncross. IOC and FOK
+// orders are rejected, market orders fail with ErrAuctionInProgress and stop
+// orders are not triggered.
+func (ob *Orderbook) StartAuction() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandStartAuction}); err != nil {
+		return err
+	}
+	ob.auction = true
+
+	logrus.Info("call auction started")
+	return nil
+}
+
+// InAuction reports whether the book is in a call auction.
+func (ob *Orderbook) InAuction() bool {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.auction
+}
+
+// IndicativePrice returns the price and volume the book would uncross at
+// right now. The volume is zero when the book does not cross.
+func (ob *Orderbook) IndicativePrice() AuctionResult {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.equilibrium()
+}
+
+// Uncross ends the call auction. Every crossed order is executed at the single
+// equilibrium price, see equilibrium, in price-time priority. What is left of
+// the orders stays in the book for continuous trading.
+func (ob *Orderbook) Uncross() (AuctionResult, []Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandUncross}); err != nil {
+		return AuctionResult{}, nil, err
+	}
+	result, matches := ob.applyUncross()
+	ob.end(matches)
+
+	return result, matches, nil
+}
+
+func (ob *Orderbook) applyUncross() (AuctionResult, []Match) {
+	result := ob.equilibrium()
+	ob.auction = false
+
+	logrus.WithFields(logrus.Fields{
+		"price":   result.Price,
+		"volume":  result.Volume,
+		"surplus": result.Surplus,
+	}).Info("call auction uncrossed")
+
+	if result.Volume.IsZero() {
+		return result, []Match{}
+	}
+
+	matches := ob.executeAuction(result)
+	ob.ReferencePrice = result.Price
+
+	return result, append(matches, ob.triggerStops()...)
+}
+
+// equilibrium returns the price that maximizes the executed volume. Ties go
+// to the price with the smallest surplus, then to the price closest to the
+// reference price, the last trade price, and finally to the lowest price.
+func (ob *Orderbook) equilibrium() AuctionResult {
+	bids := ob.bids.Limits()
+	asks := ob.asks.Limits()
+
+	// cumulative volume willing to trade at each level and every better one.
+	bidVolumes := cumulativeVolumes(bids)
+	askVolumes := cumulativeVolumes(asks)
+
+	prices := make([]Decimal, 0, len(bids)+len(asks))
+	for _, limit := range bids {
+		prices = append(prices, limit.Price)
+	}
+	for _, limit := range asks {
+		prices = append(prices, limit.Price)
+	}
+
+	reference, hasReference := ob.lastPrice()
+
+	var best AuctionResult
+	for _, price := range prices {
+		// bids are sorted by descending price, asks by ascending price.
+		b := sort.Search(len(bids), func(i int) bool { return bids[i].Price.LessThan(price) })
+		a := sort.Search(len(asks), func(i int) bool { return asks[i].Price.GreaterThan(price) })
+
+		buy, sell := Decimal{}, Decimal{}
+		if b > 0 {
+			buy = bidVolumes[b-1]
+		}
+		if a > 0 {
+			sell = askVolumes[a-1]
+		}
+
+		volume := MinDecimal(buy, sell)
+		if !volume.IsPositive() {
+			continue
+		}
+
+		result := AuctionResult{Price: price, Volume: volume, Surplus: buy.Sub(sell)}
+		if best.Volume.IsZero() || result.better(best, reference, hasReference) {
+			best = result
+		}
+	}
+
+	return best
+}
+
+// better reports whether r is a better uncrossing result than other.
+func (r AuctionResult) better(other AuctionResult, reference Decimal, hasReference bool) bool {
+	if c := r.Volume.Cmp(other.Volume); c != 0 {
+		return c > 0
+	}
+	if c := absDecimal(r.Surplus).Cmp(absDecimal(other.Surplus)); c != 0 {
+		return c < 0
+	}
+	if hasReference {
+		distance := absDecimal(r.Price.Sub(reference))
+		otherDistance := absDecimal(other.Price.Sub(reference))
+		if c := distance.Cmp(otherDistance); c != 0 {
+			return c < 0
+		}
+	}
+	return r.Price.LessThan(other.Price)
+}
+
+func absDecimal(d Decimal) Decimal {
+	if d.IsNegative() {
+		return d.Neg()
+	}
+	return d
+}
+
+func cumulativeVolumes(limits []*Limit) []Decimal {
+	volumes := make([]Decimal, len(limits))
+	total := Decimal{}
+	for i, limit := range limits {
+		total = total.Add(limit.TotalVolume).Add(limit.HiddenVolume)
+		volumes[i] = total
+	}
+	return volumes
+}
+
+// lastPrice returns the price of the last trade, false when there was none.
+func (ob *Orderbook) lastPrice() (Decimal, bool) {
+	if len(ob.Trades) == 0 {
+		return Decimal{}, false
+	}
+	return ob.Trades[len(ob.Trades)-1].Price, true
+}
+
+// executeAuction matches the orders with the highest priority on both sides
+// at the auction price until the auction volume is executed.
+func (ob *Orderbook) executeAuction(result AuctionResult) []Match {
+	matches := []Match{}
+	remaining := result.Volume
+
+	for remaining.IsPositive() {
+		bidLimit := ob.bids.Front()
+		askLimit := ob.asks.Front()
+		bid := bidLimit.Front()
+		ask := askLimit.Front()
+
+		size := MinDecimal(remaining, MinDecimal(bid.Size, ask.Size))
+		bid.Size = bid.Size.Sub(size)
+		ask.Size = ask.Size.Sub(size)
+		bidLimit.TotalVolume = bidLimit.TotalVolume.Sub(size)
+		askLimit.TotalVolume = askLimit.TotalVolume.Sub(size)
+		remaining = remaining.Sub(size)
+
+		match := Match{
+			Bid:        bid,
+			Ask:        ask,
+			Sizefilled: size,
+			Price:      result.Price,
+		}
+		// there is no aggressor in an auction, the order that arrived
+		// last is counted as the taker.
+		ob.recordTrade(&match, bid.Timestamp > ask.Timestamp)
+		matches = append(matches, match)
+
+		ob.settleAuctionOrder(true, bidLimit, bid)
+		ob.settleAuctionOrder(false, askLimit, ask)
+	}
+
+	return matches
+}
+
+// settleAuctionOrder refreshes or removes an order whose visible size got
+// executed in the auction.
+func (ob *Orderbook) settleAuctionOrder(bid bool, limit *Limit, o *Order) {
+	if o.Size.IsPositive() {
+		return
+	}
+
+	if o.Hidden.IsPositive() {
+		limit.refreshIceberg(o, ob.now)
+		return
+	}
+
+	o.Status = StatusFilled
+	limit.DeleteOrder(o)
+	delete(ob.Orders, o.ID)
+
+	if limit.Len() == 0 {
+		ob.clearLimit(bid, limit)
+	}
+}
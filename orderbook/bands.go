@@ -0,0 +1,95 @@
+package orderbook
+
+import "fmt"
+
+const (
+	// StaticBand is the price band around the reference price.
+	StaticBand Band = "STATIC"
+	// DynamicBand is the price band around the last trade price.
+	DynamicBand Band = "DYNAMIC"
+)
+
+type (
+	Band string
+
+	// PriceBands keep orders from executing at prices too far away from the
+	// reference price or the last trade price. A band is a fraction of the
+	// price it is around, 0.1 allows prices up to 10% above or below it. A
+	// zero band is not checked.
+	PriceBands struct {
+		Static  Decimal
+		Dynamic Decimal
+	}
+
+	// PriceBandError is returned for an order that was rejected because it
+	// would have executed at Price, outside of the band from Low to High.
+	PriceBandError struct {
+		Band  Band
+		Price Decimal
+		Low   Decimal
+		High  Decimal
+	}
+)
+
+func (e *PriceBandError) Error() string {
+	return fmt.Sprintf("execution price %s is outside the %s price band [%s, %s]", e.Price, e.Band, e.Low, e.High)
+}
+
+// checkBands returns a *PriceBandError when the order would execute at a
+// price outside of the price bands. Limit orders are only matched up to their
+// limit price, market orders have limited set to false.
+func (ob *Orderbook) checkBands(o *Order, price Decimal, limited bool) error {
+	best, worst, ok := ob.executionRange(o, price, limited)
+	if !ok {
+		return nil
+	}
+
+	if ob.Bands.Static.IsPositive() && ob.ReferencePrice.IsPositive() {
+		if err := checkBand(StaticBand, ob.ReferencePrice, ob.Bands.Static, best, worst); err != nil {
+			return err
+		}
+	}
+
+	if last, ok := ob.lastPrice(); ok && ob.Bands.Dynamic.IsPositive() {
+		if err := checkBand(DynamicBand, last, ob.Bands.Dynamic, best, worst); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkBand(band Band, reference, width Decimal, prices ...Decimal) error {
+	deviation := reference.Mul(width)
+	low, high := reference.Sub(deviation), reference.Add(deviation)
+
+	for _, price := range prices {
+		if price.LessThan(low) || price.GreaterThan(high) {
+			return &PriceBandError{Band: band, Price: price, Low: low, High: high}
+		}
+	}
+	return nil
+}
+
+// executionRange returns the first and the last price level the order would
+// be matched against, ok is false when it would not be matched at all.
+func (ob *Orderbook) executionRange(o *Order, price Decimal, limited bool) (best, worst Decimal, ok bool) {
+	remaining := o.Size
+
+	for limit := range ob.side(!o.Bid).All() {
+		if limited && !crosses(o.Bid, price, limit.Price) {
+			break
+		}
+		if !ok {
+			best, ok = limit.Price, true
+		}
+		worst = limit.Price
+
+		remaining = remaining.Sub(limit.TotalVolume.Add(limit.HiddenVolume))
+		if !remaining.IsPositive() {
+			break
+		}
+	}
+
+	return best, worst, ok
+}
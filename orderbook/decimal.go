@@ -0,0 +1,278 @@
+package orderbook
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// DecimalPlaces is the number of decimal places every Decimal is stored with.
+const DecimalPlaces = 8
+
+// decimalUnit is the number of units in 1.
+const decimalUnit = 100_000_000
+
+var bigDecimalUnit = big.NewInt(decimalUnit)
+
+// Decimal is a fixed-point number with DecimalPlaces decimal places. Every
+// price and size in the engine is a Decimal, so fills never leave rounding
+// dust and price levels can be looked up by value.
+//
+// The zero value is 0. Decimals are comparable, equal values compare equal
+// with == and can be used as map keys.
+type Decimal struct {
+	units int64
+}
+
+// Scale holds the number of decimal places prices and sizes of a market are
+// quoted with. It is never more than DecimalPlaces.
+type Scale struct {
+	Price int
+	Size  int
+}
+
+// DefaultScale is the scale of orderbooks created with NewOrderbook.
+var DefaultScale = Scale{Price: 2, Size: 2}
+
+// NewDecimal returns the Decimal for the integer i.
+func NewDecimal(i int64) Decimal {
+	return Decimal{units: i * decimalUnit}
+}
+
+// NewDecimalFromFloat returns the Decimal closest to f.
+func NewDecimalFromFloat(f float64) Decimal {
+	return Decimal{units: int64(math.Round(f * decimalUnit))}
+}
+
+// ParseDecimal parses a decimal number like "-1000.25". It fails when s has
+// more than DecimalPlaces decimal places instead of rounding it.
+func ParseDecimal(s string) (Decimal, error) {
+	str := s
+	neg := false
+	if strings.HasPrefix(str, "-") {
+		neg = true
+		str = str[1:]
+	} else if strings.HasPrefix(str, "+") {
+		str = str[1:]
+	}
+
+	intPart, fracPart, _ := strings.Cut(str, ".")
+	if intPart == "" && fracPart == "" {
+		return Decimal{}, fmt.Errorf("invalid decimal: %q", s)
+	}
+	if len(fracPart) > DecimalPlaces {
+		return Decimal{}, fmt.Errorf("decimal %q has more than %d decimal places", s, DecimalPlaces)
+	}
+	if intPart == "" {
+		intPart = "0"
+	}
+
+	digits := intPart + fracPart + strings.Repeat("0", DecimalPlaces-len(fracPart))
+	for _, r := range digits {
+		if r < '0' || r > '9' {
+			return Decimal{}, fmt.Errorf("invalid decimal: %q", s)
+		}
+	}
+
+	units, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return Decimal{}, fmt.Errorf("decimal %q out of range", s)
+	}
+	if neg {
+		units = -units
+	}
+	return Decimal{units: units}, nil
+}
+
+// MustParseDecimal is like ParseDecimal but panics when s cannot be parsed.
+func MustParseDecimal(s string) Decimal {
+	d, err := ParseDecimal(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+func (d Decimal) Add(d2 Decimal) Decimal { return Decimal{units: d.units + d2.units} }
+func (d Decimal) Sub(d2 Decimal) Decimal { return Decimal{units: d.units - d2.units} }
+func (d Decimal) Neg() Decimal           { return Decimal{units: -d.units} }
+
+// Mul returns d * d2 truncated to DecimalPlaces. It panics on overflow.
+func (d Decimal) Mul(d2 Decimal) Decimal {
+	r := new(big.Int).Mul(big.NewInt(d.units), big.NewInt(d2.units))
+	return fromBig(r.Quo(r, bigDecimalUnit))
+}
+
+// Div returns d / d2 truncated to DecimalPlaces. It panics when d2 is zero or
+// on overflow.
+func (d Decimal) Div(d2 Decimal) Decimal {
+	r := new(big.Int).Mul(big.NewInt(d.units), bigDecimalUnit)
+	return fromBig(r.Quo(r, big.NewInt(d2.units)))
+}
+
+func fromBig(i *big.Int) Decimal {
+	if !i.IsInt64() {
+		panic(fmt.Errorf("decimal overflow: %s", i))
+	}
+	return Decimal{units: i.Int64()}
+}
+
+// Cmp returns -1 if d < d2, 0 if d == d2 and +1 if d > d2.
+func (d Decimal) Cmp(d2 Decimal) int {
+	switch {
+	case d.units < d2.units:
+		return -1
+	case d.units > d2.units:
+		return 1
+	}
+	return 0
+}
+
+func (d Decimal) LessThan(d2 Decimal) bool           { return d.units < d2.units }
+func (d Decimal) LessThanOrEqual(d2 Decimal) bool    { return d.units <= d2.units }
+func (d Decimal) GreaterThan(d2 Decimal) bool        { return d.units > d2.units }
+func (d Decimal) GreaterThanOrEqual(d2 Decimal) bool { return d.units >= d2.units }
+func (d Decimal) IsZero() bool                       { return d.units == 0 }
+func (d Decimal) IsPositive() bool                   { return d.units > 0 }
+func (d Decimal) IsNegative() bool                   { return d.units < 0 }
+
+// MinDecimal returns the smaller of a and b.
+func MinDecimal(a, b Decimal) Decimal {
+	if a.units < b.units {
+		return a
+	}
+	return b
+}
+
+// MaxDecimal returns the larger of a and b.
+func MaxDecimal(a, b Decimal) Decimal {
+	if a.units > b.units {
+		return a
+	}
+	return b
+}
+
+// IsMultipleOf reports whether d is a whole multiple of step. It panics when
+// step is zero.
+func (d Decimal) IsMultipleOf(step Decimal) bool {
+	return d.units%step.units == 0
+}
+
+// Floor returns the largest multiple of step that is not greater than d. It
+// panics when step is not positive.
+func (d Decimal) Floor(step Decimal) Decimal {
+	if step.units <= 0 {
+		panic("decimal: step must be positive")
+	}
+	q := d.units / step.units
+	if d.units%step.units < 0 {
+		q--
+	}
+	return Decimal{units: q * step.units}
+}
+
+// Ceil returns the smallest multiple of step that is not less than d. It
+// panics when step is not positive.
+func (d Decimal) Ceil(step Decimal) Decimal {
+	return d.Neg().Floor(step).Neg()
+}
+
+// Places returns the number of decimal places needed to represent d exactly.
+func (d Decimal) Places() int {
+	units := d.units
+	if units < 0 {
+		units = -units
+	}
+
+	places := DecimalPlaces
+	for places > 0 && units%10 == 0 {
+		units /= 10
+		places--
+	}
+	return places
+}
+
+// IntPart returns the integer part of d, truncated towards zero.
+func (d Decimal) IntPart() int64 {
+	return d.units / decimalUnit
+}
+
+// Float64 returns the nearest float64 to d. Only meant for display and
+// statistics, never for matching.
+func (d Decimal) Float64() float64 {
+	return float64(d.units) / decimalUnit
+}
+
+// String formats d without trailing zeros, for example "1000.5".
+func (d Decimal) String() string {
+	return d.StringFixed(d.Places())
+}
+
+// StringFixed formats d with exactly places decimal places, truncating any
+// decimal places beyond that.
+func (d Decimal) StringFixed(places int) string {
+	places = max(0, min(places, DecimalPlaces))
+
+	units := d.units
+	sign := ""
+	if units < 0 {
+		sign = "-"
+	}
+
+	abs := new(big.Int).Abs(big.NewInt(units)).String()
+	if len(abs) <= DecimalPlaces {
+		abs = strings.Repeat("0", DecimalPlaces-len(abs)+1) + abs
+	}
+
+	intPart := abs[:len(abs)-DecimalPlaces]
+	fracPart := abs[len(abs)-DecimalPlaces:][:places]
+	if places == 0 {
+		return sign + intPart
+	}
+	return sign + intPart + "." + fracPart
+}
+
+// MarshalJSON encodes d as a JSON number, keeping every decimal place exact.
+func (d Decimal) MarshalJSON() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// UnmarshalJSON decodes d from a JSON number or a JSON string holding a
+// decimal number.
+func (d *Decimal) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+
+	s := string(bytes.Trim(b, `"`))
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid decimal: %s", b)
+		}
+		*d = NewDecimalFromFloat(f)
+		return nil
+	}
+
+	dec, err := ParseDecimal(s)
+	if err != nil {
+		return err
+	}
+	*d = dec
+	return nil
+}
+
+// Check returns an error when price or size have more decimal places than
+// the scale allows.
+func (s Scale) Check(price, size Decimal) error {
+	if price.Places() > s.Price {
+		return fmt.Errorf("price %s has more than %d decimal places", price, s.Price)
+	}
+	if size.Places() > s.Size {
+		return fmt.Errorf("size %s has more than %d decimal places", size, s.Size)
+	}
+	return nil
+}
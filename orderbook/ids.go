@@ -0,0 +1,153 @@
+package orderbook
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultIDs numbers the orders and the trades of books that have no
+// IDGenerator of their own.
+var defaultIDs = NewIDGenerator()
+
+// IDGenerator hands out increasing IDs, starting at 1. It is safe for
+// concurrent use.
+//
+// A persisted generator reserves the IDs in blocks: the end of a block is
+// written to its file before the first ID of the block is handed out, so
+// after a restart it carries on after the last block and never hands out an
+// ID twice. The unused rest of that block is skipped.
+type IDGenerator struct {
+	mu   sync.Mutex
+	next int64
+	// reserved is the first ID after the current block, path is empty for
+	// a generator that is not persisted.
+	reserved int64
+	path     string
+	block    int64
+	// held is the number of IDs after next that are reserved for the
+	// commands in progress, see hold.
+	held int64
+}
+
+// NewIDGenerator returns a generator that is not persisted.
+func NewIDGenerator() *IDGenerator {
+	return &IDGenerator{next: 1}
+}
+
+// OpenIDGenerator returns a generator persisted to the file at path that
+// reserves block IDs at a time. A missing file starts the IDs at 1.
+func OpenIDGenerator(path string, block int64) (*IDGenerator, error) {
+	if block <= 0 {
+		return nil, fmt.Errorf("id block must be greater than 0")
+	}
+
+	g := &IDGenerator{next: 1, reserved: 1, path: path, block: block}
+
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		reserved, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64)
+		if err != nil || reserved < 1 {
+			return nil, fmt.Errorf("id file %s: invalid reservation %q", path, b)
+		}
+		g.next, g.reserved = reserved, reserved
+	}
+
+	return g, nil
+}
+
+// Next returns the next ID. It fails without handing out an ID when the next
+// block cannot be reserved, the ID could be handed out again after a restart.
+func (g *IDGenerator) Next() (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ensure(1); err != nil {
+		return 0, err
+	}
+
+	id := g.next
+	g.next++
+	return id, nil
+}
+
+// hold makes sure n more IDs are reserved for a command that cannot fail
+// halfway through, like a match, before it starts. The command takes them
+// with take, which never has to reserve, and gives back what it did not use
+// with release. Until then Next reserves the IDs it hands out on top of the
+// held ones.
+func (g *IDGenerator) hold(n int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ensure(n); err != nil {
+		return err
+	}
+	g.held += n
+	return nil
+}
+
+// take returns the next held ID.
+func (g *IDGenerator) take() int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	id := g.next
+	g.next++
+	g.held--
+	return id
+}
+
+// release gives back n held IDs that were not taken.
+func (g *IDGenerator) release(n int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.held -= n
+}
+
+// ensure reserves the next block when the IDs that are held and the n after
+// them are not reserved yet.
+func (g *IDGenerator) ensure(n int64) error {
+	if g.path == "" || g.next+g.held+n <= g.reserved {
+		return nil
+	}
+	if err := g.reserve(g.next + g.held + n - 1 + g.block); err != nil {
+		return fmt.Errorf("reserving ids in %s: %w", g.path, err)
+	}
+	return nil
+}
+
+// reserve writes the end of the next block to the file, through a temporary
+// file so a crash leaves either the old or the new reservation.
+func (g *IDGenerator) reserve(reserved int64) error {
+	tmp, err := os.CreateTemp(filepath.Dir(g.path), filepath.Base(g.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(strconv.FormatInt(reserved, 10) + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), g.path); err != nil {
+		return err
+	}
+
+	g.reserved = reserved
+	return nil
+}
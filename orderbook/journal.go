@@ -0,0 +1,513 @@
+package orderbook
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	CommandPlaceLimit   CommandType = "PLACE_LIMIT"
+	CommandPlaceMarket  CommandType = "PLACE_MARKET"
+	CommandPlaceStop    CommandType = "PLACE_STOP"
+	CommandCancel       CommandType = "CANCEL"
+	CommandAmend        CommandType = "AMEND"
+	CommandExpire       CommandType = "EXPIRE"
+	CommandStartAuction CommandType = "START_AUCTION"
+	CommandUncross      CommandType = "UNCROSS"
+
+	EventAccepted  EventType = "ACCEPTED"
+	EventTrade     EventType = "TRADE"
+	EventFilled    EventType = "FILLED"
+	EventCancelled EventType = "CANCELLED"
+	EventExpired   EventType = "EXPIRED"
+	EventRejected  EventType = "REJECTED"
+)
+
+// ErrJournalFailed is returned for every command of a book after its journal
+// failed to record the events of a command. The book went on without them, it
+// no longer matches its journal and takes no more commands.
+var ErrJournalFailed = errors.New("journal failed, the book is halted")
+
+// recordHeaderSize is the size of the length and the CRC-32 checksum in front
+// of every record in the journal.
+const recordHeaderSize = 8
+
+type (
+	CommandType string
+	EventType   string
+
+	// Journal is the append-only log of an orderbook. Every command that
+	// changes the book is written to it before it is applied, followed by
+	// the events it resulted in. Replaying the commands rebuilds the book.
+	//
+	// On disk every record is its length and the CRC-32 of its payload, both
+	// big endian uint32, followed by the payload, the record as JSON.
+	Journal struct {
+		f       *os.File
+		nextSeq uint64
+		// size is the end of the last record written, a failed write is
+		// cut off there. err is set when that failed too.
+		size int64
+		err  error
+	}
+
+	// Record is a command or an event of the journal. Seq numbers the
+	// records without gaps, starting at 1. Time is the engine time (unix
+	// nano) of the command, events have the time of their command.
+	Record struct {
+		Seq     uint64
+		Time    int64
+		Command *Command `json:",omitzero"`
+		Event   *Event   `json:",omitzero"`
+	}
+
+	// Command is an inbound request to the orderbook.
+	Command struct {
+		Type CommandType
+		// Order is the new order of the place commands.
+		Order *OrderEntry `json:",omitzero"`
+		// OrderID is the order that is cancelled or amended.
+		OrderID   int64   `json:",omitzero"`
+		Price     Decimal `json:",omitzero"`
+		StopPrice Decimal `json:",omitzero"`
+		Size      Decimal `json:",omitzero"`
+	}
+
+	// OrderEntry holds the fields of an order as it was placed.
+	OrderEntry struct {
+		ID                  int64
+		UserID              string
+		Bid                 bool
+		Size                Decimal
+		Timestamp           int64
+		TimeInForce         TimeInForce         `json:",omitzero"`
+		ExpiresAt           int64               `json:",omitzero"`
+		DisplaySize         Decimal             `json:",omitzero"`
+		LiquidityPolicy     LiquidityPolicy     `json:",omitzero"`
+		ProtectionPrice     Decimal             `json:",omitzero"`
+		SelfTradePrevention SelfTradePrevention `json:",omitzero"`
+	}
+
+	// Event is something that happened to an order as a result of a
+	// command. Trades name their ID and both orders, the other events only
+	// OrderID.
+	Event struct {
+		Type       EventType
+		TradeID    int64   `json:",omitzero"`
+		OrderID    int64   `json:",omitzero"`
+		BidOrderID int64   `json:",omitzero"`
+		AskOrderID int64   `json:",omitzero"`
+		Price      Decimal `json:",omitzero"`
+		Size       Decimal `json:",omitzero"`
+	}
+)
+
+// OpenJournal opens the journal at path for appending, creating it when it
+// does not exist, and returns the records that are already in it. A record
+// cut short at the end of the file, left by a crash in the middle of a write,
+// is dropped. Any other damage to the journal is an error.
+func OpenJournal(path string) (*Journal, []Record, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, size, err := readRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("journal %s: %w", path, err)
+	}
+
+	// cut off a torn record so new records are appended after the last
+	// complete one.
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	j := &Journal{f: f, nextSeq: 1, size: size}
+	if len(records) > 0 {
+		j.nextSeq = records[len(records)-1].Seq + 1
+	}
+
+	return j, records, nil
+}
+
+// readRecords reads the complete records from r and returns them with the
+// number of bytes they take.
+func readRecords(r io.Reader) ([]Record, int64, error) {
+	var (
+		records []Record
+		size    int64
+		header  [recordHeaderSize]byte
+	)
+
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, size, nil
+			}
+			return nil, 0, err
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return records, size, nil
+			}
+			return nil, 0, err
+		}
+
+		if crc32.ChecksumIEEE(payload) != checksum {
+			return nil, 0, fmt.Errorf("checksum mismatch at offset %d", size)
+		}
+
+		var record Record
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil, 0, fmt.Errorf("invalid record at offset %d: %w", size, err)
+		}
+		if len(records) > 0 && record.Seq != records[len(records)-1].Seq+1 {
+			return nil, 0, fmt.Errorf("record %d follows record %d", record.Seq, records[len(records)-1].Seq)
+		}
+
+		records = append(records, record)
+		size += int64(recordHeaderSize + length)
+	}
+}
+
+// Append numbers the records and writes them to the journal in one write,
+// which is synced to disk before Append returns. When the write fails nothing
+// of it is kept and the numbering stays where it was. When that cannot be
+// ensured either, the journal is broken and every later Append fails.
+func (j *Journal) Append(records ...Record) error {
+	if j.err != nil {
+		return j.err
+	}
+
+	var buf []byte
+	seq := j.nextSeq
+	for i := range records {
+		records[i].Seq = seq
+		seq++
+
+		payload, err := json.Marshal(records[i])
+		if err != nil {
+			return err
+		}
+
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(payload)))
+		buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+		buf = append(buf, payload...)
+	}
+
+	if err := j.write(buf); err != nil {
+		if rollbackErr := j.seek(j.size); rollbackErr != nil {
+			j.err = fmt.Errorf("journal broken by a failed write: %w", rollbackErr)
+		}
+		return err
+	}
+
+	j.nextSeq = seq
+	j.size += int64(len(buf))
+	return nil
+}
+
+func (j *Journal) write(buf []byte) error {
+	if _, err := j.f.Write(buf); err != nil {
+		return err
+	}
+	return j.f.Sync()
+}
+
+// seek cuts the journal off at size and moves the end of it there.
+func (j *Journal) seek(size int64) error {
+	if err := j.f.Truncate(size); err != nil {
+		return err
+	}
+	_, err := j.f.Seek(size, io.SeekStart)
+	return err
+}
+
+// truncate drops every record from the journal, the numbering carries on
+// where it was.
+func (j *Journal) truncate() error {
+	if err := j.seek(0); err != nil {
+		return err
+	}
+	j.size = 0
+	return nil
+}
+
+// Close flushes the journal to disk and closes it.
+func (j *Journal) Close() error {
+	if err := j.f.Sync(); err != nil {
+		j.f.Close()
+		return err
+	}
+	return j.f.Close()
+}
+
+// SetJournal makes the book write every command and its events to the
+// journal. Load the snapshot and replay the journal before setting it.
+func (ob *Orderbook) SetJournal(j *Journal) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	// a journal truncated by a snapshot starts empty, its numbering
+	// continues after the snapshot.
+	if j.nextSeq <= ob.seq {
+		j.nextSeq = ob.seq + 1
+	}
+	ob.journal = j
+}
+
+func newOrderEntry(o *Order) *OrderEntry {
+	return &OrderEntry{
+		ID:                  o.ID,
+		UserID:              o.UserID,
+		Bid:                 o.Bid,
+		Size:                o.Size,
+		Timestamp:           o.Timestamp,
+		TimeInForce:         o.TimeInForce,
+		ExpiresAt:           o.ExpiresAt,
+		DisplaySize:         o.DisplaySize,
+		LiquidityPolicy:     o.LiquidityPolicy,
+		ProtectionPrice:     o.ProtectionPrice,
+		SelfTradePrevention: o.SelfTradePrevention,
+	}
+}
+
+func (e *OrderEntry) order() *Order {
+	return &Order{
+		ID:                  e.ID,
+		UserID:              e.UserID,
+		Bid:                 e.Bid,
+		Size:                e.Size,
+		Timestamp:           e.Timestamp,
+		TimeInForce:         e.TimeInForce,
+		ExpiresAt:           e.ExpiresAt,
+		DisplaySize:         e.DisplaySize,
+		LiquidityPolicy:     e.LiquidityPolicy,
+		ProtectionPrice:     e.ProtectionPrice,
+		SelfTradePrevention: e.SelfTradePrevention,
+	}
+}
+
+// begin starts a command: it holds the IDs of its trades, journals the command
+// and sets the engine time, which trades and requeued orders take their
+// timestamp from. A command whose IDs cannot be reserved or that cannot be
+// journaled is rejected with the error before it changed the book.
+func (ob *Orderbook) begin(now int64, cmd Command) error {
+	if ob.failed != nil {
+		return ob.failed
+	}
+
+	if err := ob.holdTradeIDs(cmd); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"command": cmd.Type,
+			"err":     err,
+		}).Error("reserving trade ids")
+		return fmt.Errorf("reserving trade ids: %w", err)
+	}
+
+	if ob.journal != nil {
+		if err := ob.journal.Append(Record{Time: now, Command: &cmd}); err != nil {
+			ob.releaseTradeIDs()
+			logrus.WithFields(logrus.Fields{
+				"command": cmd.Type,
+				"err":     err,
+			}).Error("writing command to journal")
+			return fmt.Errorf("writing command to journal: %w", err)
+		}
+		ob.seq = ob.journal.nextSeq - 1
+	}
+
+	ob.now = now
+	ob.touched = ob.touched[:0]
+	return nil
+}
+
+// end journals the events of the command: a trade for every match and the
+// new status of every order the command changed. It keeps the stops the
+// command triggered for TriggeredStops, writes a snapshot when one is due and
+// signals the update of the book.
+func (ob *Orderbook) end(matches []Match, orders ...*Order) {
+	ob.releaseTradeIDs()
+
+	for _, o := range ob.touched {
+		ob.triggeredStops = append(ob.triggeredStops, TriggeredStop{Order: o.copyPrevented(), Err: ob.stopErrors[o]})
+	}
+	clear(ob.stopErrors)
+
+	select {
+	case ob.updates <- struct{}{}:
+	default:
+	}
+
+	if ob.journal == nil {
+		return
+	}
+
+	records := []Record{}
+	seen := make(map[*Order]bool)
+	addOrder := func(o *Order) {
+		if seen[o] {
+			return
+		}
+		seen[o] = true
+
+		if event := statusEvent(o.Status); event != "" {
+			records = append(records, Record{Time: ob.now, Event: &Event{Type: event, OrderID: o.ID}})
+		}
+	}
+
+	for _, match := range matches {
+		records = append(records, Record{Time: ob.now, Event: &Event{
+			Type:       EventTrade,
+			TradeID:    match.TradeID,
+			BidOrderID: match.Bid.ID,
+			AskOrderID: match.Ask.ID,
+			Price:      match.Price,
+			Size:       match.Sizefilled,
+		}})
+	}
+
+	for _, o := range orders {
+		addOrder(o)
+		for _, p := range o.Prevented {
+			addOrder(p.Resting)
+		}
+	}
+	for _, o := range ob.touched {
+		addOrder(o)
+	}
+	for _, match := range matches {
+		addOrder(match.Bid)
+		addOrder(match.Ask)
+	}
+
+	// the command is applied already, the book cannot go on with events
+	// that are not in its journal.
+	if err := ob.journal.Append(records...); err != nil {
+		ob.failed = fmt.Errorf("%w: %w", ErrJournalFailed, err)
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("writing events to journal, halting the book")
+		return
+	}
+	ob.seq = ob.journal.nextSeq - 1
+
+	ob.maybeSnapshot()
+}
+
+// Err returns ErrJournalFailed, wrapping the cause, once the journal failed to
+// record the events of a command. The book rejects every command from then on.
+func (ob *Orderbook) Err() error {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.failed
+}
+
+// statusEvent returns the event of an order reaching the status. Partially
+// filled orders stay open, their fills are journaled as trades.
+func statusEvent(status OrderStatus) EventType {
+	switch status {
+	case StatusOpen, StatusPending:
+		return EventAccepted
+	case StatusFilled:
+		return EventFilled
+	case StatusCancelled:
+		return EventCancelled
+	case StatusExpired:
+		return EventExpired
+	case StatusRejected:
+		return EventRejected
+	}
+	return ""
+}
+
+// Replay rebuilds the book by applying the commands of the journal records in
+// order. Of the events only the trade IDs are used, the trades of a command get
+// the IDs they were journaled with. The book has to be empty, or restored from a
+// snapshot, and must not have a journal set yet. Records the snapshot already
+// includes are skipped, the others have to follow it without a gap.
+func (ob *Orderbook) Replay(records []Record) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+	defer ob.releaseTradeIDs()
+
+	for i, record := range records {
+		if record.Seq <= ob.seq {
+			continue
+		}
+		if record.Seq != ob.seq+1 {
+			return fmt.Errorf("record %d follows record %d", record.Seq, ob.seq)
+		}
+		ob.seq = record.Seq
+
+		cmd := record.Command
+		if cmd == nil {
+			continue
+		}
+		if err := ob.begin(record.Time, *cmd); err != nil {
+			return fmt.Errorf("record %d: %w", record.Seq, err)
+		}
+		ob.replayIDs = ob.replayIDs[:0]
+		for _, next := range records[i+1:] {
+			if next.Command != nil {
+				break
+			}
+			if next.Event != nil && next.Event.Type == EventTrade && next.Event.TradeID != 0 {
+				ob.replayIDs = append(ob.replayIDs, next.Event.TradeID)
+			}
+		}
+
+		switch cmd.Type {
+		case CommandPlaceLimit:
+			ob.applyPlaceLimit(cmd.Price, cmd.Order.order())
+		case CommandPlaceMarket:
+			ob.applyPlaceMarket(cmd.Order.order())
+		case CommandPlaceStop:
+			ob.applyPlaceStop(cmd.StopPrice, cmd.Price, cmd.Order.order())
+		case CommandCancel, CommandAmend:
+			o, ok := ob.Orders[cmd.OrderID]
+			if !ok {
+				return fmt.Errorf("record %d: order %d not found", record.Seq, cmd.OrderID)
+			}
+			if cmd.Type == CommandCancel {
+				ob.applyCancel(o)
+			} else {
+				ob.applyAmend(o, cmd.Price, cmd.Size)
+			}
+		case CommandExpire:
+			ob.applyExpire(record.Time)
+		case CommandStartAuction:
+			ob.auction = true
+		case CommandUncross:
+			ob.applyUncross()
+		default:
+			return fmt.Errorf("record %d: unknown command %s", record.Seq, cmd.Type)
+		}
+		ob.releaseTradeIDs()
+	}
+	ob.replayIDs = nil
+	// the triggered stops were reported before the restart.
+	clear(ob.stopErrors)
+
+	return nil
+}
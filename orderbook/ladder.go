@@ -0,0 +1,145 @@
+package orderbook
+
+import (
+	"iter"
+	"math/rand/v2"
+)
+
+// maxLadderLevel bounds the height of the skip list, enough for far more
+// price levels than a book will ever hold.
+const maxLadderLevel = 24
+
+type (
+	// ladder is one side of the book: the price levels ordered from the
+	// best price to the worst, kept in a skip list. Inserting and removing
+	// a level is O(log n) and the best level is always the first one.
+	ladder struct {
+		head  *ladderNode
+		level int
+		len   int
+		// better reports whether price a has priority over price b on
+		// this side of the book.
+		better func(a, b Decimal) bool
+		rnd    *rand.Rand
+	}
+
+	ladderNode struct {
+		limit *Limit
+		next  []*ladderNode
+	}
+)
+
+func newAskLadder() *ladder {
+	return newLadder(Decimal.LessThan)
+}
+
+func newBidLadder() *ladder {
+	return newLadder(Decimal.GreaterThan)
+}
+
+func newLadder(better func(a, b Decimal) bool) *ladder {
+	return &ladder{
+		head:   &ladderNode{next: make([]*ladderNode, maxLadderLevel)},
+		level:  1,
+		better: better,
+		// a fixed seed keeps the shape of the skip list, and so the
+		// performance of the book, reproducible.
+		rnd: rand.New(rand.NewPCG(1, 2)),
+	}
+}
+
+func (l *ladder) Len() int {
+	return l.len
+}
+
+// Front returns the level with the best price, nil when the side is empty.
+func (l *ladder) Front() *Limit {
+	if first := l.head.next[0]; first != nil {
+		return first.limit
+	}
+	return nil
+}
+
+// All iterates over the levels from the best price to the worst. The ladder
+// must not be changed while iterating.
+func (l *ladder) All() iter.Seq[*Limit] {
+	return func(yield func(*Limit) bool) {
+		for n := l.head.next[0]; n != nil; n = n.next[0] {
+			if !yield(n.limit) {
+				return
+			}
+		}
+	}
+}
+
+// Limits returns the levels from the best price to the worst.
+func (l *ladder) Limits() []*Limit {
+	limits := make([]*Limit, 0, l.len)
+	for limit := range l.All() {
+		limits = append(limits, limit)
+	}
+	return limits
+}
+
+// Insert adds a level, there must not be a level with the same price yet.
+func (l *ladder) Insert(limit *Limit) {
+	var update [maxLadderLevel]*ladderNode
+
+	n := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && l.better(n.next[i].limit.Price, limit.Price) {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+
+	level := l.randomLevel()
+	if level > l.level {
+		for i := l.level; i < level; i++ {
+			update[i] = l.head
+		}
+		l.level = level
+	}
+
+	node := &ladderNode{limit: limit, next: make([]*ladderNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.len++
+}
+
+// Remove deletes the level, it is a no-op when the level is not in the
+// ladder.
+func (l *ladder) Remove(limit *Limit) {
+	var update [maxLadderLevel]*ladderNode
+
+	n := l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for n.next[i] != nil && l.better(n.next[i].limit.Price, limit.Price) {
+			n = n.next[i]
+		}
+		update[i] = n
+	}
+
+	node := n.next[0]
+	if node == nil || node.limit != limit {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+func (l *ladder) randomLevel() int {
+	level := 1
+	for level < maxLadderLevel && l.rnd.Uint32()&3 == 0 {
+		level++
+	}
+	return level
+}
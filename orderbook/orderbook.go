@@ -2,7 +2,6 @@ package orderbook
 
 import (
 	"fmt"
-	"math/rand"
 	"sort"
 	"sync"
 	"time"
@@ -10,53 +9,233 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	SideBid Side = "BID"
+	SideAsk Side = "ASK"
+
+	GoodTillCancel    TimeInForce = "GTC"
+	ImmediateOrCancel TimeInForce = "IOC"
+	FillOrKill        TimeInForce = "FOK"
+	GoodTillDate      TimeInForce = "GTD"
+	Day               TimeInForce = "DAY"
+
+	StatusOpen      OrderStatus = "OPEN"
+	StatusFilled    OrderStatus = "FILLED"
+	StatusCancelled OrderStatus = "CANCELLED"
+	StatusExpired   OrderStatus = "EXPIRED"
+	// StatusPending is the status of a stop order waiting for its trigger.
+	StatusPending OrderStatus = "PENDING"
+	// StatusRejected is the status of an order the book refused to take.
+	StatusRejected OrderStatus = "REJECTED"
+
+	// RejectInsufficientLiquidity rejects a market order without any fill
+	// when the book cannot fill it completely. It is the default.
+	RejectInsufficientLiquidity LiquidityPolicy = "REJECT"
+	// FillAndKill fills a market order with the available liquidity and
+	// cancels the rest.
+	FillAndKill LiquidityPolicy = "FILL_AND_KILL"
+	// ProtectionLimit fills a market order up to its protection price and
+	// cancels the rest.
+	ProtectionLimit LiquidityPolicy = "PROTECTION_LIMIT"
+)
+
 type (
-	Trade struct {
-		Price     float64
-		Size      float64
+	// TimeInForce controls how long an order stays working in the book.
+	TimeInForce string
+
+	OrderStatus string
+
+	// LiquidityPolicy decides what happens to a market order the book does
+	// not have enough liquidity for.
+	LiquidityPolicy string
+
+	// InsufficientLiquidityError is returned for a market order that was
+	// rejected because the book could not fill it completely.
+	InsufficientLiquidityError struct {
 		Bid       bool
-		Timestamp int64
+		Requested Decimal
+		Available Decimal
 	}
 
+	// Side is the side of the book, BID or ASK.
+	Side string
+
+	// Trade is an execution between a maker order, the one that rested in
+	// the book, and a taker order, the one that took its liquidity. Seq
+	// numbers the trades of the market without gaps, starting at 1.
+	Trade struct {
+		Seq          uint64
+		ID           int64
+		Market       string
+		Price        Decimal
+		Size         Decimal
+		BuyerUserID  string
+		SellerUserID string
+		MakerOrderID int64
+		TakerOrderID int64
+		// AggressorSide is the side of the taker, Bid is set when it is
+		// SideBid.
+		AggressorSide Side
+		Bid           bool
+		Timestamp     int64
+	}
+
+	// Level is a price level of the aggregated depth of the book, Volume is
+	// its visible volume and Orders the number of orders at it.
+	Level struct {
+		Price  Decimal
+		Volume Decimal
+		Orders int
+	}
+
+	// TradeFilter selects the trades after the trade with sequence
+	// number Since that happened from From up to, not including, To (unix
+	// nano), at most Limit of them. Zero values do not filter.
+	TradeFilter struct {
+		Since uint64
+		From  int64
+		To    int64
+		Limit int
+	}
+
+	// Match is the fill of an ask against a bid, TradeID is the ID of the
+	// trade it was recorded as.
 	Match struct {
+		TradeID    int64
 		Ask        *Order
 		Bid        *Order
-		Sizefilled float64
-		Price      float64
+		Sizefilled Decimal
+		Price      Decimal
 	}
 
 	Order struct {
-		ID        int64
-		UserID    string
-		Size      float64
-		Bid       bool
-		Limit     *Limit //pointer to the limit level the order belongs to
-		Timestamp int64
+		ID          int64
+		UserID      string
+		Size        Decimal
+		Price       Decimal // limit price, zero for market orders
+		Bid         bool
+		Limit       *Limit //pointer to the limit level the order belongs to
+		Timestamp   int64
+		TimeInForce TimeInForce
+		// ExpiresAt is the unix nano time GTD and DAY orders expire at.
+		ExpiresAt int64
+		// StopPrice is the last trade price that triggers a stop order.
+		StopPrice Decimal
+		// DisplaySize is the peak of an iceberg order, the part of the
+		// order shown in the book. Size holds what is left of the current
+		// peak and Hidden the reserve the next peaks are taken from.
+		DisplaySize Decimal
+		Hidden      Decimal
+		// LiquidityPolicy and ProtectionPrice only apply to market orders.
+		// ProtectionPrice is the worst price a ProtectionLimit order may
+		// be filled at.
+		LiquidityPolicy LiquidityPolicy
+		ProtectionPrice Decimal
+		// SelfTradePrevention decides what happens when the order would
+		// match an order of the same user, Prevented reports the matches
+		// it stopped while the order was placed.
+		SelfTradePrevention SelfTradePrevention
+		Prevented           []PreventedMatch
+		Status              OrderStatus
+
+		// prev and next link the order into the FIFO queue of its limit.
+		prev *Order
+		next *Order
 	}
 
 	Orders []*Order
 
+	// Limit is a price level. Its orders are kept in an intrusive FIFO
+	// list in time priority, so adding an order, cancelling an order and
+	// getting the order with the highest priority are all O(1).
 	Limit struct {
-		Price       float64
-		Orders      Orders
-		TotalVolume float64
+		Price Decimal
+		head  *Order
+		tail  *Order
+		count int
+		// TotalVolume only holds the visible volume of the orders, the
+		// hidden reserve of iceberg orders is kept in HiddenVolume.
+		TotalVolume  Decimal
+		HiddenVolume Decimal
 	}
 
 	Limits []*Limit
 
-	ByBestAsk struct{ Limits }
-
-	ByBestBid struct{ Limits }
-
 	Orderbook struct {
-		asks []*Limit
-		bids []*Limit
-
-		Trades []*Trade
+		asks *ladder
+		bids *ladder
+
+		// stop orders waiting for the last trade price to reach their
+		// stop price, in arrival order.
+		buyStops  []*Order
+		sellStops []*Order
+
+		// Trades are in the order of their Seq, tradeSeq is the Seq of
+		// the last one.
+		Trades   []*Trade
+		tradeSeq uint64
+
+		// Market is the market the book trades, its trades are recorded
+		// with it.
+		Market string
+
+		// Scale is the number of decimal places prices and sizes of the
+		// market are quoted with.
+		Scale Scale
+
+		// IDs numbers the trades of the book.
+		IDs *IDGenerator
+
+		// Bands are checked before an order is matched, the static band
+		// is around ReferencePrice. Uncross sets ReferencePrice to the
+		// auction price.
+		Bands          PriceBands
+		ReferencePrice Decimal
+
+		// auction is set while the book is in a call auction, see
+		// StartAuction.
+		auction bool
+
+		// journal is nil unless the book is journaled, see SetJournal.
+		// seq is the last journal record the state of the book includes,
+		// snapshotSeq the last one in the latest snapshot.
+		journal     *Journal
+		seq         uint64
+		snapshotSeq uint64
+		// failed is set once the journal failed to record the events of a
+		// command, see Err.
+		failed error
+		// snapshotPath is empty unless the book writes snapshots, see
+		// SetSnapshots.
+		snapshotPath  string
+		snapshotEvery uint64
+		// now is the engine time (unix nano) of the command being
+		// applied. touched collects the orders the command changed
+		// besides the ones it names, like triggered stop orders.
+		now     int64
+		touched []*Order
+		// replayIDs are the trade IDs of the command being replayed.
+		// heldIDs is the number of IDs the command holds for its trades,
+		// see holdTradeIDs.
+		replayIDs []int64
+		heldIDs   int64
+		// triggeredStops are the stops triggered since the last call to
+		// TriggeredStops, stopErrors the rejections of the stops the
+		// command triggered.
+		triggeredStops []TriggeredStop
+		stopErrors     map[*Order]error
+		// uncheckedLow and uncheckedHigh are the lowest and highest price
+		// traded since the stops were last checked, unchecked is set when
+		// there was such a trade.
+		unchecked     bool
+		uncheckedLow  Decimal
+		uncheckedHigh Decimal
+		// updates is signalled after every command, see Updates.
+		updates chan struct{}
 
 		mu        sync.RWMutex
-		AskLimits map[float64]*Limit
-		BidLimits map[float64]*Limit
+		AskLimits map[Decimal]*Limit
+		BidLimits map[Decimal]*Limit
 		Orders    map[int64]*Order
 	}
 )
@@ -64,14 +243,21 @@ type (
 // sorting in increasing order
 // oldest order has the smallest timestamp
 // oldest order at the same price level has the highest priority.
-func (o Orders) Len() int           { return len(o) }
-func (o Orders) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
-func (o Orders) Less(i, j int) bool { return o[i].Timestamp < o[j].Timestamp }
-
-func NewOrder(bid bool, size float64, userID string) *Order {
+func (o Orders) Len() int      { return len(o) }
+func (o Orders) Swap(i, j int) { o[i], o[j] = o[j], o[i] }
+func (o Orders) Less(i, j int) bool {
+	if o[i].Timestamp == o[j].Timestamp {
+		return o[i].ID < o[j].ID
+	}
+	return o[i].Timestamp < o[j].Timestamp
+}
 
+// NewOrder returns an order numbered by the default ID generator, orders of an
+// exchange take their ID from its IDGenerator instead.
+// NewOrder returns an order of the user, it gets its ID from the book it is
+// placed in.
+func NewOrder(bid bool, size Decimal, userID string) *Order {
 	return &Order{
-		ID:        int64(rand.Intn(100000000)),
 		UserID:    userID,
 		Size:      size,
 		Bid:       bid,
@@ -80,96 +266,168 @@ func NewOrder(bid bool, size float64, userID string) *Order {
 }
 
 func (o *Order) String() string {
-	return fmt.Sprintf("[size: %.2f] | [id: %d] ", o.Size, o.ID)
+	return fmt.Sprintf("[size: %s] | [id: %d] ", o.Size, o.ID)
 }
 
 func (o *Order) Type() string {
-	if o.Bid {
-		return "BID"
+	return string(sideOf(o.Bid))
+}
+
+func sideOf(bid bool) Side {
+	if bid {
+		return SideBid
 	}
-	return "ASK"
+	return SideAsk
 }
 
 func (o *Order) IsFilled() bool {
-	return o.Size == 0.0
+	return o.Size.IsZero() && o.Hidden.IsZero()
 }
 
-// sorting in increasing order
-// best ask price (for buyers) is the smallest
-func (a ByBestAsk) Len() int      { return len(a.Limits) }
-func (a ByBestAsk) Swap(i, j int) { a.Limits[i], a.Limits[j] = a.Limits[j], a.Limits[i] }
+// IsIceberg reports whether only a peak of the order is shown in the book.
+func (o *Order) IsIceberg() bool {
+	return o.DisplaySize.IsPositive()
+}
 
-// Less reports whether x[i] should be ordered before x[j], as required by the sort Interface.
-func (a ByBestAsk) Less(i, j int) bool { return a.Limits[i].Price < a.Limits[j].Price }
+// IsExpired reports whether a GTD or DAY order has reached its expiry time.
+func (o *Order) IsExpired(now int64) bool {
+	return o.ExpiresAt != 0 && o.ExpiresAt <= now
+}
 
-// sorting in decreasing order
-// best bid price (for sellers) is the highest
-func (b ByBestBid) Len() int           { return len(b.Limits) }
-func (b ByBestBid) Swap(i, j int)      { b.Limits[i], b.Limits[j] = b.Limits[j], b.Limits[i] }
-func (b ByBestBid) Less(i, j int) bool { return b.Limits[i].Price > b.Limits[j].Price }
+// endOfDay returns the unix nano time of the next midnight (UTC) after ts.
+func endOfDay(ts int64) int64 {
+	t := time.Unix(0, ts).UTC()
+	y, m, d := t.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC).UnixNano()
+}
 
-func NewLimit(price float64) *Limit {
+func NewLimit(price Decimal) *Limit {
 	return &Limit{
-		Price:  price,
-		Orders: []*Order{},
+		Price: price,
 	}
 }
 
+// Len returns the number of orders at the limit.
+func (l *Limit) Len() int {
+	return l.count
+}
+
+// Front returns the order with the highest time priority, nil when the limit
+// is empty.
+func (l *Limit) Front() *Order {
+	return l.head
+}
+
+// Orders returns the orders of the limit in time priority.
+func (l *Limit) Orders() Orders {
+	orders := make(Orders, 0, l.count)
+	for o := l.head; o != nil; o = o.next {
+		orders = append(orders, o)
+	}
+	return orders
+}
+
+// AddOrder queues the order at the back of the limit.
 func (l *Limit) AddOrder(o *Order) {
 	o.Limit = l
-	l.Orders = append(l.Orders, o)
-	l.TotalVolume += o.Size
+	o.prev = l.tail
+	o.next = nil
+	if l.tail != nil {
+		l.tail.next = o
+	} else {
+		l.head = o
+	}
+	l.tail = o
+	l.count++
+
+	l.TotalVolume = l.TotalVolume.Add(o.Size)
+	l.HiddenVolume = l.HiddenVolume.Add(o.Hidden)
 }
 
+// DeleteOrder unlinks the order from the limit, it is a no-op when the order
+// is not at this limit.
 func (l *Limit) DeleteOrder(o *Order) {
-	for i := 0; i < len(l.Orders); i++ {
-		if l.Orders[i] == o {
-			l.Orders[i] = l.Orders[len(l.Orders)-1]
-			l.Orders = l.Orders[:len(l.Orders)-1]
-
-			o.Limit = nil
-			l.TotalVolume -= o.Size
+	if o.Limit != l {
+		return
+	}
 
-			//sort the remaining orders
-			sort.Sort(l.Orders)
-			return
-		}
+	if o.prev != nil {
+		o.prev.next = o.next
+	} else {
+		l.head = o.next
+	}
+	if o.next != nil {
+		o.next.prev = o.prev
+	} else {
+		l.tail = o.prev
 	}
+	o.prev = nil
+	o.next = nil
+	l.count--
+
+	o.Limit = nil
+	l.TotalVolume = l.TotalVolume.Sub(o.Size)
+	l.HiddenVolume = l.HiddenVolume.Sub(o.Hidden)
 }
 
+// Fill matches o against the orders of the limit in time priority until
+// either o is filled or the limit runs out of volume. An iceberg order whose
+// peak got filled is refreshed from its hidden reserve at the back of the
+// queue, so its hidden volume is matched after the orders that were ahead of
+// the refreshed peak.
+//
+// A resting order of the same user is not matched when o has a self-trade
+// prevention mode, see SelfTradePrevention.
 func (l *Limit) Fill(o *Order) []Match {
-	var (
-		matches        []Match
-		ordersToDelete []*Order
-	)
+	var matches []Match
 
-	for _, order := range l.Orders {
-		if o.IsFilled() {
-			break
+	for !o.isDone() && l.head != nil {
+		order := l.head
+		if selfTrade(order, o) {
+			l.preventSelfTrade(order, o)
+			continue
 		}
+
 		match := l.fillOrder(order, o)
 		matches = append(matches, match)
 
-		l.TotalVolume -= match.Sizefilled
+		l.TotalVolume = l.TotalVolume.Sub(match.Sizefilled)
 
-		if order.IsFilled() {
-			ordersToDelete = append(ordersToDelete, order)
+		if order.Size.IsPositive() {
+			continue
 		}
 
-	}
+		if order.Hidden.IsPositive() {
+			l.refreshIceberg(order, o.Timestamp)
+			continue
+		}
 
-	for _, order := range ordersToDelete {
+		order.Status = StatusFilled
 		l.DeleteOrder(order)
 	}
 
 	return matches
 }
 
+// refreshIceberg moves the next peak of an iceberg order from its hidden
+// reserve into the visible size. The order loses its time priority and is
+// queued behind every other order of the limit, with now as its timestamp.
+func (l *Limit) refreshIceberg(o *Order, now int64) {
+	l.DeleteOrder(o)
+
+	peak := MinDecimal(o.DisplaySize, o.Hidden)
+	o.Size = peak
+	o.Hidden = o.Hidden.Sub(peak)
+	o.Timestamp = now
+
+	l.AddOrder(o)
+}
+
 func (l *Limit) fillOrder(a, b *Order) Match {
 	var (
 		bid        *Order
 		ask        *Order
-		sizeFilled float64
+		sizeFilled Decimal
 	)
 
 	if a.Bid {
@@ -180,14 +438,14 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 		ask = a
 	}
 
-	if a.Size >= b.Size {
-		a.Size -= b.Size
+	if a.Size.GreaterThanOrEqual(b.Size) {
+		a.Size = a.Size.Sub(b.Size)
 		sizeFilled = b.Size
-		b.Size = 0.0
+		b.Size = Decimal{}
 	} else {
-		b.Size -= a.Size
+		b.Size = b.Size.Sub(a.Size)
 		sizeFilled = a.Size
-		a.Size = 0.0
+		a.Size = Decimal{}
 	}
 
 	return Match{
@@ -199,73 +457,226 @@ func (l *Limit) fillOrder(a, b *Order) Match {
 }
 
 func NewOrderbook() *Orderbook {
+	return NewOrderbookWithScale(DefaultScale)
+}
+
+// NewOrderbookWithScale returns an empty orderbook for a market quoted with
+// the given scale.
+func NewOrderbookWithScale(scale Scale) *Orderbook {
 	return &Orderbook{
-		asks:      []*Limit{},
-		bids:      []*Limit{},
+		Scale:     scale,
+		IDs:       defaultIDs,
+		updates:   make(chan struct{}, 1),
+		asks:      newAskLadder(),
+		bids:      newBidLadder(),
+		buyStops:  []*Order{},
+		sellStops: []*Order{},
 		Trades:    []*Trade{},
-		AskLimits: make(map[float64]*Limit),
-		BidLimits: make(map[float64]*Limit),
+		AskLimits: make(map[Decimal]*Limit),
+		BidLimits: make(map[Decimal]*Limit),
 		Orders:    make(map[int64]*Order),
+
+		stopErrors: make(map[*Order]error),
 	}
 }
 
-func (ob *Orderbook) PlaceMarketOrder(o *Order) []Match {
+func (e *InsufficientLiquidityError) Error() string {
+	side := "bid"
+	if e.Bid {
+		side = "ask"
+	}
+	return fmt.Sprintf("not enough %s volume [size: %s] for market order [size: %s]", side, e.Available, e.Requested)
+}
+
+// PlaceMarketOrder fills the order against the opposite side, best price
+// first. When the book cannot fill the whole order the LiquidityPolicy of the
+// order decides what happens, see LiquidityPolicy. A rejected order returns
+// an *InsufficientLiquidityError, or a *PriceBandError when it would execute
+// outside of the price bands.
+func (ob *Orderbook) PlaceMarketOrder(o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	if err := ob.number(o); err != nil {
+		return nil, err
+	}
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandPlaceMarket, Order: newOrderEntry(o)}); err != nil {
+		o.Status = StatusRejected
+		return nil, err
+	}
+	matches, err := ob.applyPlaceMarket(o)
+	ob.end(matches, o)
+
+	return matches, err
+}
+
+func (ob *Orderbook) applyPlaceMarket(o *Order) ([]Match, error) {
+	matches, err := ob.placeMarketOrder(o)
+	if err != nil {
+		return matches, err
+	}
+
+	return append(matches, ob.triggerStops()...), nil
+}
+
+func (ob *Orderbook) placeMarketOrder(o *Order) ([]Match, error) {
 	matches := []Match{}
 
-	if o.Bid {
-		if o.Size > ob.AskTotalVolume() {
-			panic(fmt.Errorf("not enough ask volume [size: %.2f] for bid market order [size: %.2f]", ob.AskTotalVolume(), o.Size))
-		}
-		for _, limit := range ob.Asks() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
+	if ob.auction {
+		o.Status = StatusRejected
+		return matches, ErrAuctionInProgress
+	}
 
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(false, limit)
+	switch o.LiquidityPolicy {
+	case "", RejectInsufficientLiquidity:
+		o.LiquidityPolicy = RejectInsufficientLiquidity
+		available := ob.liquidity(o)
+		if o.Size.GreaterThan(available) {
+			o.Status = StatusRejected
+			return matches, &InsufficientLiquidityError{
+				Bid:       o.Bid,
+				Requested: o.Size,
+				Available: available,
 			}
-
 		}
-	} else {
-		if o.Size > ob.BidTotalVolume() {
-			panic(fmt.Errorf("not enough bid volume [size: %.2f] for ask market order [size: %.2f]", ob.BidTotalVolume(), o.Size))
+		if err := ob.checkBands(o, Decimal{}, false); err != nil {
+			o.Status = StatusRejected
+			return matches, err
 		}
-		for _, limit := range ob.Bids() {
-			limitMatches := limit.Fill(o)
-			matches = append(matches, limitMatches...)
-
-			if len(limit.Orders) == 0 {
-				ob.clearLimit(true, limit)
-			}
+		matches = ob.matchMarketOrder(o)
+	case FillAndKill:
+		if err := ob.checkBands(o, Decimal{}, false); err != nil {
+			o.Status = StatusRejected
+			return matches, err
 		}
+		matches = ob.matchMarketOrder(o)
+	case ProtectionLimit:
+		if !o.ProtectionPrice.IsPositive() {
+			o.Status = StatusRejected
+			return matches, fmt.Errorf("market order with %s policy needs a protection price", ProtectionLimit)
+		}
+		if err := ob.checkBands(o, o.ProtectionPrice, true); err != nil {
+			o.Status = StatusRejected
+			return matches, err
+		}
+		matches = ob.matchLimitOrder(o.ProtectionPrice, o)
+	default:
+		o.Status = StatusRejected
+		return matches, fmt.Errorf("invalid liquidity policy: %s", o.LiquidityPolicy)
 	}
 
-	for _, match := range matches {
-		trade := &Trade{
-			Price:     match.Price,
-			Size:      match.Sizefilled,
-			Timestamp: time.Now().UnixNano(),
-			Bid:       o.Bid,
-		}
-		ob.Trades = append(ob.Trades, trade)
+	ob.recordTrades(o, matches)
 
+	if o.IsFilled() && o.Status != StatusCancelled {
+		o.Status = StatusFilled
+	} else {
+		o.Status = StatusCancelled
 	}
 
-	logrus.WithFields(logrus.Fields{
-		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
-	}).Info()
+	return matches, nil
+}
+
+// matchMarketOrder fills the order against the opposite side, best price
+// first, for as long as there is liquidity.
+func (ob *Orderbook) matchMarketOrder(o *Order) []Match {
+	matches := []Match{}
+	opposite := ob.side(!o.Bid)
+
+	for !o.isDone() {
+		limit := opposite.Front()
+		if limit == nil {
+			break
+		}
+		matches = append(matches, ob.fillLimit(!o.Bid, limit, o)...)
+	}
 
 	return matches
 }
 
-func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
-	var limit *Limit
-
+// PlaceLimitOrder first matches the order against the opposite side of the
+// book for as long as the best price level crosses the limit price, using
+// price-time priority. Whatever is left of the order rests at its price,
+// unless its time in force says otherwise:
+//
+//   - IOC orders fill what they can and cancel the rest.
+//   - FOK orders are cancelled without any fill unless they can fill completely.
+//   - GTD and DAY orders rest until they expire, see ExpireOrders.
+//
+// An order that would execute outside of the price bands is rejected with a
+// *PriceBandError.
+func (ob *Orderbook) PlaceLimitOrder(price Decimal, o *Order) ([]Match, error) {
 	ob.mu.Lock()
 	defer ob.mu.Unlock()
 
+	if err := ob.number(o); err != nil {
+		return nil, err
+	}
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandPlaceLimit, Order: newOrderEntry(o), Price: price}); err != nil {
+		o.Status = StatusRejected
+		return nil, err
+	}
+	matches, err := ob.applyPlaceLimit(price, o)
+	ob.end(matches, o)
+
+	return matches, err
+}
+
+func (ob *Orderbook) applyPlaceLimit(price Decimal, o *Order) ([]Match, error) {
+	matches, err := ob.placeLimitOrder(price, o)
+	if err != nil {
+		return matches, err
+	}
+
+	return append(matches, ob.triggerStops()...), nil
+}
+
+func (ob *Orderbook) placeLimitOrder(price Decimal, o *Order) ([]Match, error) {
+	var limit *Limit
+
+	o.Price = price
+	if o.TimeInForce == "" {
+		o.TimeInForce = GoodTillCancel
+	}
+	if o.TimeInForce == Day && o.ExpiresAt == 0 {
+		o.ExpiresAt = endOfDay(o.Timestamp)
+	}
+
+	immediate := o.TimeInForce == ImmediateOrCancel || o.TimeInForce == FillOrKill
+	if ob.auction && immediate {
+		o.Status = StatusRejected
+		return []Match{}, nil
+	}
+
+	if o.TimeInForce == FillOrKill && ob.crossingVolume(price, o).LessThan(o.Size) {
+		o.Status = StatusCancelled
+		return []Match{}, nil
+	}
+
+	// during a call auction orders collect in the book until the uncross.
+	matches := []Match{}
+	if !ob.auction {
+		if err := ob.checkBands(o, price, true); err != nil {
+			o.Status = StatusRejected
+			return matches, err
+		}
+		matches = ob.matchLimitOrder(price, o)
+		ob.recordTrades(o, matches)
+	}
+
+	if o.Status == StatusCancelled {
+		return matches, nil
+	}
+
+	if o.IsFilled() {
+		o.Status = StatusFilled
+		return matches, nil
+	}
+
+	if immediate {
+		o.Status = StatusCancelled
+		return matches, nil
+	}
+
 	if o.Bid {
 		limit = ob.BidLimits[price]
 	} else {
@@ -276,12 +687,11 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		limit = NewLimit(price)
 
 		if o.Bid {
-			ob.bids = append(ob.bids, limit)
 			ob.BidLimits[price] = limit
 		} else {
-			ob.asks = append(ob.asks, limit)
 			ob.AskLimits[price] = limit
 		}
+		ob.side(o.Bid).Insert(limit)
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -291,68 +701,644 @@ func (ob *Orderbook) PlaceLimitOrder(price float64, o *Order) {
 		"userID": o.UserID,
 	}).Info("new limit order")
 
+	if o.IsIceberg() && o.Size.GreaterThan(o.DisplaySize) {
+		o.Hidden = o.Hidden.Add(o.Size.Sub(o.DisplaySize))
+		o.Size = o.DisplaySize
+	}
+
+	o.Status = StatusOpen
 	ob.Orders[o.ID] = o
 	limit.AddOrder(o)
+
+	return matches, nil
+}
+
+// crossingVolume returns the volume on the opposite side that o could be
+// matched against at its limit price, see matchableVolume.
+func (ob *Orderbook) crossingVolume(price Decimal, o *Order) Decimal {
+	return ob.matchableVolume(o, func(limit *Limit) bool {
+		return crosses(o.Bid, price, limit.Price)
+	})
+}
+
+// matchableVolume returns the volume on the opposite side that can take up o
+// at the price levels accepted by crossing, best price first. Self-trade
+// prevention decides about resting orders of the same user: CancelOldest
+// cancels them, so they are left out, and CancelNewest and CancelBoth cancel
+// o, so only the volume ahead of the first of them counts. DecrementAndCancel
+// takes their size off o, so they count.
+func (ob *Orderbook) matchableVolume(o *Order, crossing func(*Limit) bool) Decimal {
+	totalVolume := Decimal{}
+
+	for limit := range ob.side(!o.Bid).All() {
+		if !crossing(limit) {
+			break
+		}
+
+		hidden := Decimal{}
+		for resting := limit.head; resting != nil; resting = resting.next {
+			if selfTrade(resting, o) {
+				switch o.SelfTradePrevention {
+				case CancelOldest:
+					continue
+				case CancelNewest, CancelBoth:
+					// refreshed iceberg peaks would queue behind
+					// the order that stops o.
+					return totalVolume
+				}
+			}
+			totalVolume = totalVolume.Add(resting.Size)
+			hidden = hidden.Add(resting.Hidden)
+		}
+		totalVolume = totalVolume.Add(hidden)
+	}
+
+	return totalVolume
+}
+
+// matchLimitOrder fills a limit order against the opposite side, best price
+// first, stopping at the first price level that no longer crosses.
+func (ob *Orderbook) matchLimitOrder(price Decimal, o *Order) []Match {
+	matches := []Match{}
+	opposite := ob.side(!o.Bid)
+
+	for !o.isDone() {
+		limit := opposite.Front()
+		if limit == nil || !crosses(o.Bid, price, limit.Price) {
+			break
+		}
+		matches = append(matches, ob.fillLimit(!o.Bid, limit, o)...)
+	}
+
+	return matches
+}
+
+// fillLimit fills o against the limit on the bid (or ask) side and removes
+// the resting orders that got filled or that self-trade prevention cancelled
+// from the book.
+func (ob *Orderbook) fillLimit(bid bool, limit *Limit, o *Order) []Match {
+	prevented := len(o.Prevented)
+	matches := limit.Fill(o)
+
+	for _, match := range matches {
+		resting := match.Bid
+		if !bid {
+			resting = match.Ask
+		}
+		if resting.Status == StatusFilled {
+			delete(ob.Orders, resting.ID)
+		}
+	}
+	for _, p := range o.Prevented[prevented:] {
+		if p.Resting.Status == StatusCancelled {
+			delete(ob.Orders, p.Resting.ID)
+		}
+	}
+
+	if limit.Len() == 0 {
+		ob.clearLimit(bid, limit)
+	}
+
+	return matches
+}
+
+// crosses reports whether an order on the bid (or ask) side with the given
+// limit price can be matched against the opposite level price.
+func crosses(bid bool, price, levelPrice Decimal) bool {
+	if bid {
+		return levelPrice.LessThanOrEqual(price)
+	}
+	return levelPrice.GreaterThanOrEqual(price)
+}
+
+// side returns the price ladder of the bid or the ask side.
+func (ob *Orderbook) side(bid bool) *ladder {
+	if bid {
+		return ob.bids
+	}
+	return ob.asks
+}
+
+// recordTrades appends a trade for every match of the incoming order o, which
+// is the taker of all of them.
+func (ob *Orderbook) recordTrades(o *Order, matches []Match) {
+	if len(matches) == 0 {
+		return
+	}
+
+	for i := range matches {
+		ob.recordTrade(&matches[i], o.Bid)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"currentPrice": ob.Trades[len(ob.Trades)-1].Price,
+	}).Info()
+}
+
+// recordTrade numbers the match and appends its trade, takerBid tells which
+// side of the match took liquidity.
+func (ob *Orderbook) recordTrade(match *Match, takerBid bool) {
+	match.TradeID = ob.nextTradeID()
+
+	maker, taker := match.Bid, match.Ask
+	if takerBid {
+		maker, taker = match.Ask, match.Bid
+	}
+
+	if !ob.unchecked {
+		ob.unchecked = true
+		ob.uncheckedLow, ob.uncheckedHigh = match.Price, match.Price
+	}
+	ob.uncheckedLow = MinDecimal(ob.uncheckedLow, match.Price)
+	ob.uncheckedHigh = MaxDecimal(ob.uncheckedHigh, match.Price)
+
+	ob.tradeSeq++
+	ob.Trades = append(ob.Trades, &Trade{
+		Seq:           ob.tradeSeq,
+		ID:            match.TradeID,
+		Market:        ob.Market,
+		Price:         match.Price,
+		Size:          match.Sizefilled,
+		BuyerUserID:   match.Bid.UserID,
+		SellerUserID:  match.Ask.UserID,
+		MakerOrderID:  maker.ID,
+		TakerOrderID:  taker.ID,
+		AggressorSide: sideOf(takerBid),
+		Bid:           takerBid,
+		Timestamp:     ob.now,
+	})
+}
+
+// nextTradeID returns the ID of the next trade. A replayed command gets the
+// IDs its trades were journaled with.
+func (ob *Orderbook) nextTradeID() int64 {
+	if len(ob.replayIDs) > 0 {
+		id := ob.replayIDs[0]
+		ob.replayIDs = ob.replayIDs[1:]
+		return id
+	}
+	if ob.heldIDs == 0 {
+		panic("orderbook: trade without a held id")
+	}
+	ob.heldIDs--
+	return ob.IDs.take()
+}
+
+// holdTradeIDs holds an ID for every trade the command can make before the
+// command changes the book, so its trades never get an ID that is not
+// reserved. A trade fills the visible peak of one of its orders, or what is
+// left of the auction volume, so a command makes at most one trade more than
+// the book and the order of the command have peaks.
+func (ob *Orderbook) holdTradeIDs(cmd Command) error {
+	switch cmd.Type {
+	case CommandPlaceLimit, CommandPlaceMarket, CommandPlaceStop, CommandAmend, CommandUncross:
+	default:
+		return nil
+	}
+
+	n := int64(1)
+	if cmd.Order != nil {
+		n += peaks(cmd.Order.Size, Decimal{}, cmd.Order.DisplaySize)
+	}
+	if o, ok := ob.Orders[cmd.OrderID]; ok && cmd.Type == CommandAmend {
+		n += peaks(cmd.Size, Decimal{}, o.DisplaySize)
+	}
+	for _, o := range ob.Orders {
+		n += peaks(o.Size, o.Hidden, o.DisplaySize)
+	}
+
+	if err := ob.IDs.hold(n); err != nil {
+		return err
+	}
+	ob.heldIDs = n
+	return nil
+}
+
+// releaseTradeIDs gives back the IDs the command held and did not use.
+func (ob *Orderbook) releaseTradeIDs() {
+	ob.IDs.release(ob.heldIDs)
+	ob.heldIDs = 0
+}
+
+// peaks returns the number of peaks an order of size with the hidden reserve
+// is shown in, one unless it is an iceberg order.
+func peaks(size, hidden, display Decimal) int64 {
+	if !display.IsPositive() {
+		return 1
+	}
+	if size.GreaterThan(display) {
+		hidden = hidden.Add(size.Sub(display))
+	}
+	return 1 + (hidden.units+display.units-1)/display.units
+}
+
+// number gives the order the next ID of the book unless it already has one.
+// An order that cannot be numbered is rejected.
+func (ob *Orderbook) number(o *Order) error {
+	if o.ID != 0 {
+		return nil
+	}
+
+	id, err := ob.IDs.Next()
+	if err != nil {
+		o.Status = StatusRejected
+		return err
+	}
+	o.ID = id
+	return nil
 }
 
 func (ob *Orderbook) clearLimit(bid bool, l *Limit) {
 	if bid {
 		delete(ob.BidLimits, l.Price)
-		for i := 0; i < len(ob.bids); i++ {
-			if ob.bids[i] == l {
-				ob.bids[i] = ob.bids[len(ob.bids)-1]
-				ob.bids = ob.bids[:len(ob.bids)-1]
-			}
-		}
 	} else {
 		delete(ob.AskLimits, l.Price)
-		for i := 0; i < len(ob.asks); i++ {
-			if ob.asks[i] == l {
-				ob.asks[i] = ob.asks[len(ob.asks)-1]
-				ob.asks = ob.asks[:len(ob.asks)-1]
-			}
-		}
 	}
+	ob.side(bid).Remove(l)
+}
 
-	fmt.Printf("clearing limit price level [%.2f]\n", l.Price)
+// CancelOrder removes a resting limit order or a pending stop order from the
+// book. It fails when the order is not working anymore, for example because
+// it got filled in the meantime.
+func (ob *Orderbook) CancelOrder(o *Order) error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if o.Status != StatusPending && (o.Status != StatusOpen || o.Limit == nil) {
+		return fmt.Errorf("order %d is not working", o.ID)
+	}
+
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandCancel, OrderID: o.ID}); err != nil {
+		return err
+	}
+	ob.applyCancel(o)
+	ob.end(nil, o)
+
+	return nil
+}
+
+func (ob *Orderbook) applyCancel(o *Order) {
+	ob.cancelOrder(o)
+	o.Status = StatusCancelled
 }
 
-func (ob *Orderbook) CancelOrder(o *Order) {
+func (ob *Orderbook) cancelOrder(o *Order) {
+	if o.Status == StatusPending {
+		ob.deleteStopOrder(o)
+		return
+	}
+
 	limit := o.Limit
 	limit.DeleteOrder(o)
 	delete(ob.Orders, o.ID)
 
-	if len(limit.Orders) == 0 {
+	if limit.Len() == 0 {
 		ob.clearLimit(o.Bid, limit)
 	}
 }
 
-func (ob *Orderbook) BidTotalVolume() float64 {
-	totalVolume := 0.0
+// AmendOrder changes the price and the size of a resting limit order without
+// changing its ID. A zero price keeps the current price and size is the new
+// total size of the order, the hidden reserve of an iceberg order included.
+//
+// Reducing the size at the same price keeps the time priority of the order.
+// A price change or a size increase moves the order to the back of the queue
+// at its new price, where it is matched like a new limit order first. The
+// order is left as it is when it would execute outside of the price bands.
+func (ob *Orderbook) AmendOrder(o *Order, price, size Decimal) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if o.Status != StatusOpen || o.Limit == nil {
+		return nil, fmt.Errorf("order %d is not resting in the book", o.ID)
+	}
+	if !size.IsPositive() {
+		return nil, fmt.Errorf("invalid size: %s", size)
+	}
+	if price.IsZero() {
+		price = o.Price
+	}
+	if !price.IsPositive() {
+		return nil, fmt.Errorf("invalid price: %s", price)
+	}
+
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandAmend, OrderID: o.ID, Price: price, Size: size}); err != nil {
+		return nil, err
+	}
+	matches, err := ob.applyAmend(o, price, size)
+	ob.end(matches, o)
+
+	return matches, err
+}
+
+func (ob *Orderbook) applyAmend(o *Order, price, size Decimal) ([]Match, error) {
+	o.Prevented = nil
+
+	if price == o.Price && size.LessThanOrEqual(o.Size.Add(o.Hidden)) {
+		o.Limit.reduceOrder(o, size)
+		return []Match{}, nil
+	}
+
+	// check the bands before the order loses its place in the book.
+	if !ob.auction {
+		if err := ob.checkBands(&Order{Bid: o.Bid, Size: size}, price, true); err != nil {
+			return nil, err
+		}
+	}
+
+	ob.cancelOrder(o)
+	o.Size = size
+	o.Hidden = Decimal{}
+	o.Timestamp = ob.now
+
+	logrus.WithFields(logrus.Fields{
+		"id":    o.ID,
+		"price": price,
+		"size":  size,
+	}).Info("order amended")
+
+	matches, err := ob.placeLimitOrder(price, o)
+	if err != nil {
+		return matches, err
+	}
+
+	return append(matches, ob.triggerStops()...), nil
+}
+
+// reduceOrder lowers the total size of the order to size in place, so it keeps
+// its time priority. The hidden reserve of an iceberg order goes first.
+func (l *Limit) reduceOrder(o *Order, size Decimal) {
+	reduce := o.Size.Add(o.Hidden).Sub(size)
+
+	hidden := MinDecimal(o.Hidden, reduce)
+	visible := reduce.Sub(hidden)
+
+	o.Hidden = o.Hidden.Sub(hidden)
+	o.Size = o.Size.Sub(visible)
+	l.HiddenVolume = l.HiddenVolume.Sub(hidden)
+	l.TotalVolume = l.TotalVolume.Sub(visible)
+}
 
-	for i := 0; i < len(ob.bids); i++ {
-		totalVolume += ob.bids[i].TotalVolume
+// ExpireOrders removes every GTD and DAY order that expired at or before now
+// (unix nano) from the book and returns them.
+func (ob *Orderbook) ExpireOrders(now int64) ([]*Order, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	// only journal the expiry runs that expire something.
+	if !ob.hasExpired(now) {
+		return []*Order{}, nil
+	}
+
+	if err := ob.begin(now, Command{Type: CommandExpire}); err != nil {
+		return nil, err
+	}
+	expired := ob.applyExpire(now)
+	ob.end(nil, expired...)
+
+	return expired, nil
+}
+
+func (ob *Orderbook) hasExpired(now int64) bool {
+	for _, o := range ob.Orders {
+		if o.IsExpired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ob *Orderbook) applyExpire(now int64) []*Order {
+	expired := []*Order{}
+	for _, o := range ob.Orders {
+		if o.IsExpired(now) {
+			expired = append(expired, o)
+		}
+	}
+	sort.Sort(Orders(expired))
+
+	for _, o := range expired {
+		ob.cancelOrder(o)
+		o.Status = StatusExpired
+
+		logrus.WithFields(logrus.Fields{
+			"id":     o.ID,
+			"type":   o.Type(),
+			"size":   o.Size,
+			"userID": o.UserID,
+		}).Info("order expired")
+	}
+
+	return expired
+}
+
+func (ob *Orderbook) BidTotalVolume() Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	totalVolume := Decimal{}
+
+	for limit := range ob.bids.All() {
+		totalVolume = totalVolume.Add(limit.TotalVolume)
 	}
 	return totalVolume
 }
 
-func (ob *Orderbook) AskTotalVolume() float64 {
-	totalVolume := 0.0
+func (ob *Orderbook) AskTotalVolume() Decimal {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	totalVolume := Decimal{}
 
-	for i := 0; i < len(ob.asks); i++ {
-		totalVolume += ob.asks[i].TotalVolume
+	for limit := range ob.asks.All() {
+		totalVolume = totalVolume.Add(limit.TotalVolume)
 	}
 	return totalVolume
 }
 
-// Sorts by best ask price.
+// liquidity returns the volume a market order can be matched against,
+// including the hidden reserve of iceberg orders, see matchableVolume.
+func (ob *Orderbook) liquidity(o *Order) Decimal {
+	return ob.matchableVolume(o, func(*Limit) bool { return true })
+}
+
+// FilterTrades returns the trades selected by the filter, oldest first.
+func (ob *Orderbook) FilterTrades(filter TradeFilter) []*Trade {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	start := sort.Search(len(ob.Trades), func(i int) bool {
+		return ob.Trades[i].Seq > filter.Since
+	})
+
+	trades := []*Trade{}
+	for _, trade := range ob.Trades[start:] {
+		if filter.Limit > 0 && len(trades) == filter.Limit {
+			break
+		}
+		if trade.Timestamp < filter.From || (filter.To > 0 && trade.Timestamp >= filter.To) {
+			continue
+		}
+		trades = append(trades, trade)
+	}
+
+	return trades
+}
+
+// Asks returns the ask price levels from the best (lowest) price to the worst.
 func (ob *Orderbook) Asks() []*Limit {
-	sort.Sort(ByBestAsk{ob.asks})
-	return ob.asks
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.asks.Limits()
 }
 
-// Sorts by best bid price.
+// Bids returns the bid price levels from the best (highest) price to the worst.
 func (ob *Orderbook) Bids() []*Limit {
-	sort.Sort(ByBestBid{ob.bids})
-	return ob.bids
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bids.Limits()
+}
+
+// BookLevel is a price level of the book with copies of its orders in time
+// priority.
+type BookLevel struct {
+	Price  Decimal
+	Volume Decimal
+	Orders []Order
+}
+
+// Book returns copies of the bid and ask levels of the book and their orders
+// from the best price to the worst, at most levels of each side, all of them
+// when levels is zero. The copies are taken under the lock of the book, they
+// can be read while the book keeps matching.
+func (ob *Orderbook) Book(levels int) (bids, asks []BookLevel) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return book(ob.bids, levels), book(ob.asks, levels)
+}
+
+// Depth returns the aggregated bid and ask levels of the book from the best
+// price to the worst, at most levels of each side, all of them when levels is
+// zero.
+func (ob *Orderbook) Depth(levels int) (bids, asks []Level) {
+	bookBids, bookAsks := ob.Book(levels)
+	return depth(bookBids), depth(bookAsks)
+}
+
+// GroupLevels merges the levels of a side, ordered from the best price to the
+// worst, into buckets of group: bids are rounded down to a multiple of group,
+// asks up, so a bucket never shows a better price than its orders have.
+func GroupLevels(levels []Level, group Decimal, bid bool) []Level {
+	grouped := []Level{}
+	for _, level := range levels {
+		price := level.Price.Ceil(group)
+		if bid {
+			price = level.Price.Floor(group)
+		}
+
+		if n := len(grouped); n > 0 && grouped[n-1].Price == price {
+			grouped[n-1].Volume = grouped[n-1].Volume.Add(level.Volume)
+			grouped[n-1].Orders += level.Orders
+			continue
+		}
+		grouped = append(grouped, Level{Price: price, Volume: level.Volume, Orders: level.Orders})
+	}
+	return grouped
+}
+
+func book(side *ladder, levels int) []BookLevel {
+	book := []BookLevel{}
+	for limit := range side.All() {
+		if levels > 0 && len(book) == levels {
+			break
+		}
+		orders := make([]Order, 0, limit.Len())
+		for o := limit.head; o != nil; o = o.next {
+			orders = append(orders, o.copy())
+		}
+		book = append(book, BookLevel{Price: limit.Price, Volume: limit.TotalVolume, Orders: orders})
+	}
+	return book
+}
+
+func depth(book []BookLevel) []Level {
+	depth := make([]Level, 0, len(book))
+	for _, level := range book {
+		depth = append(depth, Level{Price: level.Price, Volume: level.Volume, Orders: len(level.Orders)})
+	}
+	return depth
+}
+
+// Updates returns a channel that receives a value after a command changed the
+// book. Updates are coalesced: a single value can stand for many commands, a
+// reader has to look at the book to find out what changed. The book has one
+// channel, meant for a single reader.
+func (ob *Orderbook) Updates() <-chan struct{} {
+	return ob.updates
+}
+
+// Order returns the working order with the ID, resting or waiting for its
+// stop price.
+func (ob *Orderbook) Order(id int64) (*Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.Orders[id]
+	return o, ok
+}
+
+// OrderState returns a copy of the working order with the ID, taken under the
+// lock of the book. Unlike Order it is safe to read while the book keeps
+// matching.
+func (ob *Orderbook) OrderState(id int64) (Order, bool) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	o, ok := ob.Orders[id]
+	if !ok {
+		return Order{}, false
+	}
+	return o.copy(), true
+}
+
+// copy returns a copy of the order that shares no state with the book: it is
+// not linked into a limit and carries no prevented matches, they point to
+// other orders of the book.
+func (o *Order) copy() Order {
+	c := *o
+	c.Limit, c.prev, c.next = nil, nil, nil
+	c.Prevented = nil
+	return c
+}
+
+// copyPrevented is like copy but keeps the prevented matches, with copies of
+// the resting orders and without the incoming order, which is o itself.
+func (o *Order) copyPrevented() Order {
+	c := o.copy()
+	for _, p := range o.Prevented {
+		resting := p.Resting.copy()
+		c.Prevented = append(c.Prevented, PreventedMatch{Resting: &resting, Size: p.Size, Mode: p.Mode})
+	}
+	return c
+}
+
+// BestAsk returns the ask price level with the lowest price, nil when there
+// are no asks.
+func (ob *Orderbook) BestAsk() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.asks.Front()
+}
+
+// BestBid returns the bid price level with the highest price, nil when there
+// are no bids.
+func (ob *Orderbook) BestBid() *Limit {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.bids.Front()
 }
@@ -1,9 +1,18 @@
 package orderbook
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 func assert(t *testing.T, a, b any) {
@@ -14,13 +23,14 @@ func assert(t *testing.T, a, b any) {
 
 func TestLastMarketTrades(t *testing.T) {
 	ob := NewOrderbook()
-	price := 10_000.0
+	price := NewDecimal(10_000)
 
-	sellOrder := NewOrder(false, 10, "CSD000000000000-0001")
+	sellOrder := NewOrder(false, NewDecimal(10), "CSD000000000000-0001")
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	marketOrder := NewOrder(true, 10, "CSD000000000000-0001")
-	matches := ob.PlaceMarketOrder(marketOrder)
+	marketOrder := NewOrder(true, NewDecimal(10), "CSD000000000000-0001")
+	matches, err := ob.PlaceMarketOrder(marketOrder)
+	assert(t, err, nil)
 	assert(t, len(matches), 1)
 	match := matches[0]
 
@@ -29,13 +39,16 @@ func TestLastMarketTrades(t *testing.T) {
 	assert(t, trade.Price, price)
 	assert(t, trade.Bid, marketOrder.Bid)
 	assert(t, trade.Size, match.Sizefilled)
+	assert(t, trade.ID, match.TradeID)
+	assert(t, trade.MakerOrderID, sellOrder.ID)
+	assert(t, trade.TakerOrderID, marketOrder.ID)
 }
 
 func TestLimit(t *testing.T) {
-	l := NewLimit(10_000)
-	buyOrderA := NewOrder(true, 5, "CSD000000000000-0001")
-	buyOrderB := NewOrder(true, 8, "CSD000000000000-0001")
-	buyOrderC := NewOrder(true, 10, "CSD000000000000-0001")
+	l := NewLimit(NewDecimal(10_000))
+	buyOrderA := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	buyOrderB := NewOrder(true, NewDecimal(8), "CSD000000000000-0001")
+	buyOrderC := NewOrder(true, NewDecimal(10), "CSD000000000000-0001")
 
 	l.AddOrder(buyOrderA)
 	l.AddOrder(buyOrderB)
@@ -48,35 +61,70 @@ func TestLimit(t *testing.T) {
 
 	fmt.Printf("After delete: ")
 	fmt.Println(l)
+
+	assert(t, l.Orders(), Orders{buyOrderA, buyOrderC})
+	assert(t, l.Len(), 2)
+	assert(t, l.TotalVolume, NewDecimal(15))
+	assert(t, buyOrderB.Limit, (*Limit)(nil))
+}
+
+func TestLadder(t *testing.T) {
+	ob := NewOrderbook()
+
+	prices := []int64{10_050, 9_900, 10_100, 10_000, 9_950}
+	for _, price := range prices {
+		ob.PlaceLimitOrder(NewDecimal(price), NewOrder(false, NewDecimal(1), "CSD000000000000-0001"))
+		ob.PlaceLimitOrder(NewDecimal(price-1_000), NewOrder(true, NewDecimal(1), "CSD000000000000-0001"))
+	}
+
+	askPrices := []Decimal{}
+	for _, limit := range ob.Asks() {
+		askPrices = append(askPrices, limit.Price)
+	}
+	assert(t, askPrices, []Decimal{NewDecimal(9_900), NewDecimal(9_950), NewDecimal(10_000), NewDecimal(10_050), NewDecimal(10_100)})
+
+	bidPrices := []Decimal{}
+	for _, limit := range ob.Bids() {
+		bidPrices = append(bidPrices, limit.Price)
+	}
+	assert(t, bidPrices, []Decimal{NewDecimal(9_100), NewDecimal(9_050), NewDecimal(9_000), NewDecimal(8_950), NewDecimal(8_900)})
+
+	assert(t, ob.BestAsk().Price, NewDecimal(9_900))
+	assert(t, ob.BestBid().Price, NewDecimal(9_100))
+
+	ob.CancelOrder(ob.BestAsk().Front())
+	assert(t, ob.BestAsk().Price, NewDecimal(9_950))
+	assert(t, ob.asks.Len(), 4)
 }
 
 func TestPlaceLimitOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrderA := NewOrder(false, 10, "CSD000000000000-0001")
-	sellOrderB := NewOrder(false, 5, "CSD000000000000-0001")
-	ob.PlaceLimitOrder(10_000, sellOrderA)
-	ob.PlaceLimitOrder(9_000, sellOrderB)
+	sellOrderA := NewOrder(false, NewDecimal(10), "CSD000000000000-0001")
+	sellOrderB := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrderA)
+	ob.PlaceLimitOrder(NewDecimal(9_000), sellOrderB)
 
-	assert(t, len(ob.asks), 2)
+	assert(t, ob.asks.Len(), 2)
 }
 
 func TestPlaceMarketOrder(t *testing.T) {
 	ob := NewOrderbook()
 
-	sellOrder := NewOrder(false, 20, "CSD000000000000-0001")
-	ob.PlaceLimitOrder(10_000, sellOrder)
+	sellOrder := NewOrder(false, NewDecimal(20), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
 
-	buyOrder := NewOrder(true, 10, "CSD000000000000-0001")
-	matches := ob.PlaceMarketOrder(buyOrder)
+	buyOrder := NewOrder(true, NewDecimal(10), "CSD000000000000-0001")
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
 
 	assert(t, len(matches), 1)
-	assert(t, len(ob.asks), 1)
-	assert(t, ob.AskTotalVolume(), 10.0)
+	assert(t, ob.asks.Len(), 1)
+	assert(t, ob.AskTotalVolume(), NewDecimal(10))
 	assert(t, matches[0].Ask, sellOrder)
 	assert(t, matches[0].Bid, buyOrder)
-	assert(t, matches[0].Sizefilled, 10.0)
-	assert(t, matches[0].Price, 10_000.0)
+	assert(t, matches[0].Sizefilled, NewDecimal(10))
+	assert(t, matches[0].Price, NewDecimal(10_000))
 	assert(t, buyOrder.IsFilled(), true)
 
 	fmt.Printf("%+v", matches)
@@ -85,39 +133,40 @@ func TestPlaceMarketOrder(t *testing.T) {
 func TestPlaceMarketOrderMultiFill(t *testing.T) {
 	ob := NewOrderbook()
 
-	buyOrderA := NewOrder(true, 5, "CSD000000000000-0001")
-	buyOrderB := NewOrder(true, 8, "CSD000000000000-0001")
-	buyOrderC := NewOrder(true, 10, "CSD000000000000-0001")
-	buyOrderD := NewOrder(true, 1, "CSD000000000000-0001")
+	buyOrderA := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	buyOrderB := NewOrder(true, NewDecimal(8), "CSD000000000000-0001")
+	buyOrderC := NewOrder(true, NewDecimal(10), "CSD000000000000-0001")
+	buyOrderD := NewOrder(true, NewDecimal(1), "CSD000000000000-0001")
 
-	ob.PlaceLimitOrder(5_000, buyOrderC)
-	ob.PlaceLimitOrder(5_000, buyOrderD)
-	ob.PlaceLimitOrder(10_000, buyOrderA)
-	ob.PlaceLimitOrder(9_000, buyOrderB)
+	ob.PlaceLimitOrder(NewDecimal(5_000), buyOrderC)
+	ob.PlaceLimitOrder(NewDecimal(5_000), buyOrderD)
+	ob.PlaceLimitOrder(NewDecimal(10_000), buyOrderA)
+	ob.PlaceLimitOrder(NewDecimal(9_000), buyOrderB)
 
-	assert(t, ob.BidTotalVolume(), 24.0)
+	assert(t, ob.BidTotalVolume(), NewDecimal(24))
 
-	sellOrder := NewOrder(false, 20, "CSD000000000000-0001")
-	matches := ob.PlaceMarketOrder(sellOrder)
+	sellOrder := NewOrder(false, NewDecimal(20), "CSD000000000000-0001")
+	matches, err := ob.PlaceMarketOrder(sellOrder)
+	assert(t, err, nil)
 
-	assert(t, ob.BidTotalVolume(), 4.0)
+	assert(t, ob.BidTotalVolume(), NewDecimal(4))
 	assert(t, len(matches), 3)
-	assert(t, len(ob.bids), 1)
+	assert(t, ob.bids.Len(), 1)
 
 	fmt.Printf("%+v", matches)
 }
 
 func TestCancelOrderAsk(t *testing.T) {
 	ob := NewOrderbook()
-	sellOrder := NewOrder(false, 4, "CSD000000000000-0001")
-	price := 10_000.0
+	sellOrder := NewOrder(false, NewDecimal(4), "CSD000000000000-0001")
+	price := NewDecimal(10_000)
 
 	ob.PlaceLimitOrder(price, sellOrder)
 
-	assert(t, ob.AskTotalVolume(), 4.0)
+	assert(t, ob.AskTotalVolume(), NewDecimal(4))
 
 	ob.CancelOrder(sellOrder)
-	assert(t, ob.AskTotalVolume(), 0.0)
+	assert(t, ob.AskTotalVolume(), NewDecimal(0))
 
 	_, ok := ob.Orders[sellOrder.ID]
 	assert(t, ok, false)
@@ -128,15 +177,15 @@ func TestCancelOrderAsk(t *testing.T) {
 
 func TestCancelOrderBid(t *testing.T) {
 	ob := NewOrderbook()
-	buyOrder := NewOrder(true, 4, "CSD000000000000-0001")
-	price := 10_000.0
+	buyOrder := NewOrder(true, NewDecimal(4), "CSD000000000000-0001")
+	price := NewDecimal(10_000)
 
 	ob.PlaceLimitOrder(price, buyOrder)
 
-	assert(t, ob.BidTotalVolume(), 4.0)
+	assert(t, ob.BidTotalVolume(), NewDecimal(4))
 
 	ob.CancelOrder(buyOrder)
-	assert(t, ob.BidTotalVolume(), 0.0)
+	assert(t, ob.BidTotalVolume(), NewDecimal(0))
 
 	_, ok := ob.Orders[buyOrder.ID]
 	assert(t, ok, false)
@@ -144,3 +193,1177 @@ func TestCancelOrderBid(t *testing.T) {
 	_, ok = ob.BidLimits[price]
 	assert(t, ok, false)
 }
+
+func TestPlaceLimitOrderCrossing(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrderA := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	sellOrderB := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrderA)
+	ob.PlaceLimitOrder(NewDecimal(10_100), sellOrderB)
+
+	buyOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	matches, err := ob.PlaceLimitOrder(NewDecimal(10_050), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Ask, sellOrderA)
+	assert(t, matches[0].Bid, buyOrder)
+	assert(t, matches[0].Sizefilled, NewDecimal(5))
+	assert(t, matches[0].Price, NewDecimal(10_000))
+
+	assert(t, len(ob.Trades), 1)
+	assert(t, ob.Trades[0].Bid, true)
+
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, ob.BidTotalVolume(), NewDecimal(3))
+	assert(t, buyOrder.Limit.Price, NewDecimal(10_050))
+
+	_, ok := ob.AskLimits[NewDecimal(10_000)]
+	assert(t, ok, false)
+}
+
+func TestPlaceLimitOrderCrossingFullyFilled(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyOrderA := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	buyOrderB := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), buyOrderA)
+	ob.PlaceLimitOrder(NewDecimal(9_900), buyOrderB)
+
+	sellOrder := NewOrder(false, NewDecimal(7), "CSD000000000000-0002")
+	matches, err := ob.PlaceLimitOrder(NewDecimal(9_900), sellOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, matches[0].Price, NewDecimal(10_000))
+	assert(t, matches[1].Price, NewDecimal(9_900))
+	assert(t, sellOrder.IsFilled(), true)
+	assert(t, sellOrder.Limit, (*Limit)(nil))
+	assert(t, ob.AskTotalVolume(), NewDecimal(0))
+	assert(t, ob.BidTotalVolume(), NewDecimal(3))
+
+	_, ok := ob.Orders[sellOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestPlaceLimitOrderIOC(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+
+	buyOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	buyOrder.TimeInForce = ImmediateOrCancel
+	matches, err := ob.PlaceLimitOrder(NewDecimal(10_000), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Size, NewDecimal(3))
+	assert(t, buyOrder.Status, StatusCancelled)
+	assert(t, ob.BidTotalVolume(), NewDecimal(0))
+
+	_, ok := ob.Orders[buyOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestPlaceLimitOrderFOK(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+
+	buyOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	buyOrder.TimeInForce = FillOrKill
+	matches, err := ob.PlaceLimitOrder(NewDecimal(10_000), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 0)
+	assert(t, buyOrder.Size, NewDecimal(8))
+	assert(t, buyOrder.Status, StatusCancelled)
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, ob.BidTotalVolume(), NewDecimal(0))
+
+	buyOrder = NewOrder(true, NewDecimal(5), "CSD000000000000-0002")
+	buyOrder.TimeInForce = FillOrKill
+	matches, err = ob.PlaceLimitOrder(NewDecimal(10_000), buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Status, StatusFilled)
+	assert(t, sellOrder.Status, StatusFilled)
+	assert(t, ob.AskTotalVolume(), NewDecimal(0))
+}
+
+func TestExpireOrders(t *testing.T) {
+	ob := NewOrderbook()
+
+	gtdOrder := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	gtdOrder.TimeInForce = GoodTillDate
+	gtdOrder.ExpiresAt = gtdOrder.Timestamp + 1_000
+	ob.PlaceLimitOrder(NewDecimal(9_000), gtdOrder)
+
+	dayOrder := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	dayOrder.TimeInForce = Day
+	ob.PlaceLimitOrder(NewDecimal(9_000), dayOrder)
+
+	gtcOrder := NewOrder(true, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(9_000), gtcOrder)
+
+	assert(t, dayOrder.ExpiresAt, endOfDay(dayOrder.Timestamp))
+
+	expired, err := ob.ExpireOrders(gtdOrder.ExpiresAt)
+	assert(t, err, nil)
+	assert(t, len(expired), 1)
+	assert(t, expired[0], gtdOrder)
+	assert(t, gtdOrder.Status, StatusExpired)
+	assert(t, ob.BidTotalVolume(), NewDecimal(10))
+
+	expired, _ = ob.ExpireOrders(dayOrder.ExpiresAt)
+	assert(t, len(expired), 1)
+	assert(t, expired[0], dayOrder)
+	assert(t, ob.BidTotalVolume(), NewDecimal(5))
+	assert(t, gtcOrder.Status, StatusOpen)
+}
+
+func TestStopMarketOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(NewDecimal(10_000), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(10_100), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+
+	stopOrder := NewOrder(true, NewDecimal(3), "CSD000000000000-0002")
+	matches, _ := ob.PlaceStopOrder(NewDecimal(10_000), Decimal{}, stopOrder)
+	assert(t, len(matches), 0)
+	assert(t, stopOrder.Status, StatusPending)
+	assert(t, len(ob.StopOrders()), 1)
+
+	buyOrder := NewOrder(true, NewDecimal(4), "CSD000000000000-0003")
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 3)
+	assert(t, matches[1].Bid, stopOrder)
+	assert(t, matches[1].Price, NewDecimal(10_000))
+	assert(t, matches[2].Bid, stopOrder)
+	assert(t, matches[2].Price, NewDecimal(10_100))
+	assert(t, stopOrder.Status, StatusFilled)
+	assert(t, len(ob.StopOrders()), 0)
+	assert(t, len(ob.Trades), 3)
+	assert(t, ob.AskTotalVolume(), NewDecimal(3))
+
+	_, ok := ob.Orders[stopOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestTriggeredStopLiquidity(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(NewDecimal(10_000), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+
+	stopOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	ob.PlaceStopOrder(NewDecimal(10_000), Decimal{}, stopOrder)
+	assert(t, stopOrder.LiquidityPolicy, FillAndKill)
+
+	strict := NewOrder(true, NewDecimal(8), "CSD000000000000-0003")
+	strict.LiquidityPolicy = RejectInsufficientLiquidity
+	ob.PlaceStopOrder(NewDecimal(10_000), Decimal{}, strict)
+
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, NewDecimal(1), "CSD000000000000-0004"))
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, matches[1].Bid, stopOrder)
+	assert(t, matches[1].Sizefilled, NewDecimal(4))
+	assert(t, stopOrder.Status, StatusCancelled)
+	assert(t, strict.Status, StatusRejected)
+
+	triggered := ob.TriggeredStops()
+	assert(t, len(triggered), 2)
+	assert(t, triggered[0].Order.ID, stopOrder.ID)
+	assert(t, triggered[0].Order.Status, StatusCancelled)
+	assert(t, triggered[0].Err, nil)
+	assert(t, triggered[1].Order.ID, strict.ID)
+	assert(t, triggered[1].Err != nil, true)
+	assert(t, len(ob.TriggeredStops()), 0)
+}
+
+func TestStopTriggeredBySweep(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(NewDecimal(101), NewOrder(true, NewDecimal(1), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(99), NewOrder(true, NewDecimal(1), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(105), NewOrder(false, NewDecimal(1), "CSD000000000000-0001"))
+
+	stopOrder := NewOrder(true, NewDecimal(1), "CSD000000000000-0002")
+	ob.PlaceStopOrder(NewDecimal(101), Decimal{}, stopOrder)
+
+	// the sweep trades at the stop price and ends below it.
+	matches, err := ob.PlaceMarketOrder(NewOrder(false, NewDecimal(2), "CSD000000000000-0003"))
+	assert(t, err, nil)
+
+	assert(t, len(matches), 3)
+	assert(t, matches[2].Bid, stopOrder)
+	assert(t, matches[2].Price, NewDecimal(105))
+	assert(t, stopOrder.Status, StatusFilled)
+	assert(t, len(ob.StopOrders()), 0)
+}
+
+func TestStopLimitOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(NewDecimal(10_000), NewOrder(true, NewDecimal(5), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(9_900), NewOrder(true, NewDecimal(5), "CSD000000000000-0001"))
+
+	stopOrder := NewOrder(false, NewDecimal(8), "CSD000000000000-0002")
+	ob.PlaceStopOrder(NewDecimal(10_000), NewDecimal(9_950), stopOrder)
+
+	sellOrder := NewOrder(false, NewDecimal(2), "CSD000000000000-0003")
+	matches, err := ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 2)
+	assert(t, matches[1].Ask, stopOrder)
+	assert(t, matches[1].Sizefilled, NewDecimal(3))
+	assert(t, stopOrder.Status, StatusOpen)
+	assert(t, stopOrder.Limit.Price, NewDecimal(9_950))
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, ob.BidTotalVolume(), NewDecimal(5))
+}
+
+func TestCancelStopOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	stopOrder := NewOrder(false, NewDecimal(8), "CSD000000000000-0002")
+	ob.PlaceStopOrder(NewDecimal(10_000), Decimal{}, stopOrder)
+	ob.CancelOrder(stopOrder)
+
+	assert(t, stopOrder.Status, StatusCancelled)
+	assert(t, len(ob.StopOrders()), 0)
+
+	_, ok := ob.Orders[stopOrder.ID]
+	assert(t, ok, false)
+}
+
+func TestIcebergOrder(t *testing.T) {
+	ob := NewOrderbook()
+
+	icebergOrder := NewOrder(false, NewDecimal(10), "CSD000000000000-0001")
+	icebergOrder.DisplaySize = NewDecimal(3)
+	ob.PlaceLimitOrder(NewDecimal(10_000), icebergOrder)
+
+	sellOrder := NewOrder(false, NewDecimal(2), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+
+	assert(t, icebergOrder.Size, NewDecimal(3))
+	assert(t, icebergOrder.Hidden, NewDecimal(7))
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, ob.AskLimits[NewDecimal(10_000)].HiddenVolume, NewDecimal(7))
+
+	buyOrder := NewOrder(true, NewDecimal(7), "CSD000000000000-0002")
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 3)
+	assert(t, matches[0].Ask, icebergOrder)
+	assert(t, matches[0].Sizefilled, NewDecimal(3))
+	assert(t, matches[1].Ask, sellOrder)
+	assert(t, matches[1].Sizefilled, NewDecimal(2))
+	assert(t, matches[2].Ask, icebergOrder)
+	assert(t, matches[2].Sizefilled, NewDecimal(2))
+
+	assert(t, icebergOrder.Size, NewDecimal(1))
+	assert(t, icebergOrder.Hidden, NewDecimal(4))
+	assert(t, icebergOrder.IsFilled(), false)
+	assert(t, ob.AskTotalVolume(), NewDecimal(1))
+	assert(t, ob.AskLimits[NewDecimal(10_000)].HiddenVolume, NewDecimal(4))
+
+	buyOrder = NewOrder(true, NewDecimal(5), "CSD000000000000-0002")
+	ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, icebergOrder.IsFilled(), true)
+	assert(t, icebergOrder.Status, StatusFilled)
+	assert(t, ob.asks.Len(), 0)
+}
+
+func TestDecimal(t *testing.T) {
+	d := MustParseDecimal("1000.25")
+	assert(t, d.String(), "1000.25")
+	assert(t, d.StringFixed(4), "1000.2500")
+	assert(t, d.Places(), 2)
+	assert(t, d.IntPart(), int64(1000))
+	assert(t, MustParseDecimal("-0.5").String(), "-0.5")
+	assert(t, NewDecimal(3).String(), "3")
+
+	assert(t, MustParseDecimal("0.1").Add(MustParseDecimal("0.2")), MustParseDecimal("0.3"))
+	assert(t, MustParseDecimal("1.5").Mul(NewDecimal(3)), MustParseDecimal("4.5"))
+	assert(t, NewDecimal(10).Div(NewDecimal(4)), MustParseDecimal("2.5"))
+
+	_, err := ParseDecimal("0.123456789")
+	assert(t, err != nil, true)
+	_, err = ParseDecimal("1.2.3")
+	assert(t, err != nil, true)
+
+	b, err := json.Marshal(map[string]Decimal{"Price": d})
+	assert(t, err, nil)
+	assert(t, string(b), `{"Price":1000.25}`)
+
+	var v struct{ Price, Size Decimal }
+	err = json.Unmarshal([]byte(`{"Price":990.1,"Size":"0.3"}`), &v)
+	assert(t, err, nil)
+	assert(t, v.Price, MustParseDecimal("990.1"))
+	assert(t, v.Size, MustParseDecimal("0.3"))
+
+	assert(t, DefaultScale.Check(MustParseDecimal("10.25"), MustParseDecimal("1.5")), nil)
+	assert(t, DefaultScale.Check(MustParseDecimal("10.255"), NewDecimal(1)) != nil, true)
+}
+
+func TestPartialFillsAreExact(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, MustParseDecimal("0.3"), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(MustParseDecimal("100.1"), sellOrder)
+
+	ob.PlaceMarketOrder(NewOrder(true, MustParseDecimal("0.1"), "CSD000000000000-0002"))
+	ob.PlaceMarketOrder(NewOrder(true, MustParseDecimal("0.2"), "CSD000000000000-0002"))
+
+	assert(t, sellOrder.IsFilled(), true)
+	assert(t, ob.AskTotalVolume(), Decimal{})
+	assert(t, ob.asks.Len(), 0)
+}
+
+// deepBook returns an orderbook with levels price levels on each side and
+// ordersPerLevel orders at every level.
+func deepBook(levels, ordersPerLevel int) *Orderbook {
+	logrus.SetLevel(logrus.WarnLevel)
+
+	ob := NewOrderbook()
+	for i := 0; i < levels; i++ {
+		for j := 0; j < ordersPerLevel; j++ {
+			ob.PlaceLimitOrder(NewDecimal(int64(10_001+i)), NewOrder(false, NewDecimal(10), "CSD000000000000-0001"))
+			ob.PlaceLimitOrder(NewDecimal(int64(9_999-i)), NewOrder(true, NewDecimal(10), "CSD000000000000-0001"))
+		}
+	}
+	return ob
+}
+
+func BenchmarkPlaceLimitOrderDeepBook(b *testing.B) {
+	ob := deepBook(1_000, 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		price := NewDecimal(int64(10_001 + i%1_000))
+		ob.PlaceLimitOrder(price, NewOrder(false, NewDecimal(1), "CSD000000000000-0001"))
+	}
+}
+
+func BenchmarkCancelOrderDeepBook(b *testing.B) {
+	ob := deepBook(1_000, 10)
+	orders := make([]*Order, 0, b.N)
+	for i := 0; i < b.N; i++ {
+		price := NewDecimal(int64(10_001 + i%1_000))
+		order := NewOrder(false, NewDecimal(1), "CSD000000000000-0001")
+		ob.PlaceLimitOrder(price, order)
+		orders = append(orders, order)
+	}
+
+	b.ResetTimer()
+	for _, order := range orders {
+		ob.CancelOrder(order)
+	}
+}
+
+func BenchmarkPlaceMarketOrderDeepBook(b *testing.B) {
+	ob := deepBook(1_000, 10)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ob.PlaceMarketOrder(NewOrder(true, NewDecimal(5), "CSD000000000000-0002"))
+		ob.PlaceLimitOrder(NewDecimal(10_001), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+	}
+}
+
+func TestPlaceMarketOrderInsufficientLiquidity(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+
+	buyOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, len(matches), 0)
+	assert(t, err, error(&InsufficientLiquidityError{
+		Bid:       true,
+		Requested: NewDecimal(8),
+		Available: NewDecimal(5),
+	}))
+	assert(t, buyOrder.Status, StatusRejected)
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, len(ob.Trades), 0)
+}
+
+func TestPlaceMarketOrderFillAndKill(t *testing.T) {
+	ob := NewOrderbook()
+
+	sellOrder := NewOrder(false, NewDecimal(5), "CSD000000000000-0001")
+	ob.PlaceLimitOrder(NewDecimal(10_000), sellOrder)
+
+	buyOrder := NewOrder(true, NewDecimal(8), "CSD000000000000-0002")
+	buyOrder.LiquidityPolicy = FillAndKill
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, buyOrder.Size, NewDecimal(3))
+	assert(t, buyOrder.Status, StatusCancelled)
+	assert(t, ob.AskTotalVolume(), NewDecimal(0))
+}
+
+func TestPlaceMarketOrderProtectionLimit(t *testing.T) {
+	ob := NewOrderbook()
+
+	ob.PlaceLimitOrder(NewDecimal(10_000), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(10_100), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+	ob.PlaceLimitOrder(NewDecimal(10_200), NewOrder(false, NewDecimal(5), "CSD000000000000-0001"))
+
+	buyOrder := NewOrder(true, NewDecimal(12), "CSD000000000000-0002")
+	buyOrder.LiquidityPolicy = ProtectionLimit
+	buyOrder.ProtectionPrice = NewDecimal(10_100)
+	matches, err := ob.PlaceMarketOrder(buyOrder)
+
+	assert(t, err, nil)
+	assert(t, len(matches), 2)
+	assert(t, matches[1].Price, NewDecimal(10_100))
+	assert(t, buyOrder.Size, NewDecimal(2))
+	assert(t, buyOrder.Status, StatusCancelled)
+	assert(t, ob.AskTotalVolume(), NewDecimal(5))
+	assert(t, ob.BidTotalVolume(), NewDecimal(0))
+}
+
+func TestSelfTradePrevention(t *testing.T) {
+	tests := []struct {
+		mode            SelfTradePrevention
+		incomingStatus  OrderStatus
+		incomingSize    Decimal
+		restingStatus   OrderStatus
+		restingSize     Decimal
+		preventedSize   Decimal
+		otherUserFilled bool
+	}{
+		{CancelNewest, StatusCancelled, NewDecimal(10), StatusOpen, NewDecimal(6), Decimal{}, false},
+		{CancelOldest, StatusOpen, NewDecimal(6), StatusCancelled, NewDecimal(6), Decimal{}, true},
+		{CancelBoth, StatusCancelled, NewDecimal(10), StatusCancelled, NewDecimal(6), Decimal{}, false},
+		{DecrementAndCancel, StatusFilled, NewDecimal(0), StatusCancelled, NewDecimal(0), NewDecimal(6), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			ob := NewOrderbook()
+
+			resting := NewOrder(false, NewDecimal(6), "CSD000000000001-0001")
+			ob.PlaceLimitOrder(NewDecimal(100), resting)
+			other := NewOrder(false, NewDecimal(4), "CSD000000000002-0001")
+			ob.PlaceLimitOrder(NewDecimal(100), other)
+
+			incoming := NewOrder(true, NewDecimal(10), "CSD000000000001-0001")
+			incoming.SelfTradePrevention = tt.mode
+			matches, err := ob.PlaceLimitOrder(NewDecimal(100), incoming)
+			assert(t, err, nil)
+
+			assert(t, incoming.Status, tt.incomingStatus)
+			assert(t, incoming.Size, tt.incomingSize)
+			assert(t, len(incoming.Prevented), 1)
+			assert(t, incoming.Prevented[0].Resting, resting)
+			assert(t, incoming.Prevented[0].Size, tt.preventedSize)
+			assert(t, resting.Status, tt.restingStatus)
+			assert(t, resting.Size, tt.restingSize)
+
+			if tt.otherUserFilled {
+				assert(t, len(matches), 1)
+				assert(t, matches[0].Ask, other)
+				assert(t, other.Status, StatusFilled)
+			} else {
+				assert(t, len(matches), 0)
+				assert(t, other.Status, StatusOpen)
+			}
+
+			if tt.restingStatus == StatusCancelled {
+				_, ok := ob.Orders[resting.ID]
+				assert(t, ok, false)
+			}
+			_, ok := ob.Orders[incoming.ID]
+			assert(t, ok, tt.incomingStatus == StatusOpen)
+		})
+	}
+}
+
+func TestSelfTradePreventionFillOrKill(t *testing.T) {
+	ob := NewOrderbook()
+
+	resting := NewOrder(false, NewDecimal(6), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), resting)
+	other := NewOrder(false, NewDecimal(4), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), other)
+
+	incoming := NewOrder(true, NewDecimal(10), "CSD000000000001-0001")
+	incoming.TimeInForce = FillOrKill
+	incoming.SelfTradePrevention = CancelOldest
+	matches, err := ob.PlaceLimitOrder(NewDecimal(100), incoming)
+	assert(t, err, nil)
+
+	assert(t, len(matches), 0)
+	assert(t, incoming.Status, StatusCancelled)
+	assert(t, resting.Status, StatusOpen)
+	assert(t, other.Size, NewDecimal(4))
+	assert(t, ob.AskTotalVolume(), NewDecimal(10))
+}
+
+func TestSelfTradePreventionInsufficientLiquidity(t *testing.T) {
+	ob := NewOrderbook()
+
+	resting := NewOrder(false, NewDecimal(6), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), resting)
+	ob.PlaceLimitOrder(NewDecimal(101), NewOrder(false, NewDecimal(4), "CSD000000000002-0001"))
+
+	incoming := NewOrder(true, NewDecimal(5), "CSD000000000001-0001")
+	incoming.SelfTradePrevention = CancelOldest
+	matches, err := ob.PlaceMarketOrder(incoming)
+
+	assert(t, err, error(&InsufficientLiquidityError{
+		Bid:       true,
+		Requested: NewDecimal(5),
+		Available: NewDecimal(4),
+	}))
+	assert(t, len(matches), 0)
+	assert(t, incoming.Status, StatusRejected)
+	assert(t, resting.Status, StatusOpen)
+	assert(t, ob.AskTotalVolume(), NewDecimal(10))
+}
+
+func TestSelfTradePreventionDecrementAndCancel(t *testing.T) {
+	ob := NewOrderbook()
+
+	resting := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), resting)
+
+	incoming := NewOrder(true, NewDecimal(4), "CSD000000000001-0001")
+	incoming.SelfTradePrevention = DecrementAndCancel
+	matches, err := ob.PlaceMarketOrder(incoming)
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, len(ob.Trades), 0)
+
+	assert(t, incoming.Status, StatusCancelled)
+	assert(t, incoming.Prevented[0].Size, NewDecimal(4))
+	assert(t, resting.Status, StatusOpen)
+	assert(t, resting.Size, NewDecimal(6))
+	assert(t, ob.AskTotalVolume(), NewDecimal(6))
+}
+
+func TestSelfTradeAllowedByDefault(t *testing.T) {
+	ob := NewOrderbook()
+
+	resting := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), resting)
+
+	incoming := NewOrder(true, NewDecimal(10), "CSD000000000001-0001")
+	matches, err := ob.PlaceLimitOrder(NewDecimal(100), incoming)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, len(incoming.Prevented), 0)
+	assert(t, incoming.Status, StatusFilled)
+}
+
+func TestAmendOrderSizeDownKeepsPriority(t *testing.T) {
+	ob := NewOrderbook()
+	price := NewDecimal(100)
+
+	first := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	second := NewOrder(false, NewDecimal(10), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(price, first)
+	ob.PlaceLimitOrder(price, second)
+
+	matches, err := ob.AmendOrder(first, Decimal{}, NewDecimal(4))
+	assert(t, err, nil)
+	assert(t, len(matches), 0)
+	assert(t, first.Size, NewDecimal(4))
+	assert(t, ob.AskLimits[price].Orders(), Orders{first, second})
+	assert(t, ob.AskTotalVolume(), NewDecimal(14))
+}
+
+func TestAmendOrderSizeUpLosesPriority(t *testing.T) {
+	ob := NewOrderbook()
+	price := NewDecimal(100)
+
+	first := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	second := NewOrder(false, NewDecimal(10), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(price, first)
+	ob.PlaceLimitOrder(price, second)
+
+	_, err := ob.AmendOrder(first, price, NewDecimal(12))
+	assert(t, err, nil)
+	assert(t, first.Size, NewDecimal(12))
+	assert(t, ob.AskLimits[price].Orders(), Orders{second, first})
+	assert(t, ob.AskTotalVolume(), NewDecimal(22))
+}
+
+func TestAmendOrderPriceChange(t *testing.T) {
+	ob := NewOrderbook()
+
+	buyOrder := NewOrder(true, NewDecimal(5), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(95), buyOrder)
+	sellOrder := NewOrder(false, NewDecimal(10), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), sellOrder)
+	id := sellOrder.ID
+
+	matches, err := ob.AmendOrder(sellOrder, NewDecimal(95), NewDecimal(10))
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+	assert(t, matches[0].Price, NewDecimal(95))
+	assert(t, sellOrder.ID, id)
+	assert(t, sellOrder.Status, StatusOpen)
+	assert(t, sellOrder.Size, NewDecimal(5))
+	assert(t, len(ob.asks.Limits()), 1)
+	assert(t, ob.asks.Front().Price, NewDecimal(95))
+	_, ok := ob.AskLimits[NewDecimal(100)]
+	assert(t, ok, false)
+
+	_, err = ob.AmendOrder(buyOrder, NewDecimal(96), NewDecimal(5))
+	if err == nil {
+		t.Errorf("expected an error amending a filled order")
+	}
+}
+
+func auctionBook(ob *Orderbook) {
+	ob.PlaceLimitOrder(NewDecimal(102), NewOrder(true, NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(101), NewOrder(true, NewDecimal(5), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(99), NewOrder(true, NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(98), NewOrder(false, NewDecimal(8), "CSD000000000002-0001"))
+	ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(6), "CSD000000000002-0001"))
+	ob.PlaceLimitOrder(NewDecimal(103), NewOrder(false, NewDecimal(10), "CSD000000000002-0001"))
+}
+
+func TestCallAuction(t *testing.T) {
+	ob := NewOrderbook()
+	ob.StartAuction()
+	auctionBook(ob)
+
+	assert(t, len(ob.Trades), 0)
+	assert(t, ob.BidTotalVolume(), NewDecimal(25))
+	assert(t, ob.AskTotalVolume(), NewDecimal(24))
+
+	_, err := ob.PlaceMarketOrder(NewOrder(true, NewDecimal(1), "CSD000000000003-0001"))
+	assert(t, err, ErrAuctionInProgress)
+
+	iocOrder := NewOrder(true, NewDecimal(1), "CSD000000000003-0001")
+	iocOrder.TimeInForce = ImmediateOrCancel
+	ob.PlaceLimitOrder(NewDecimal(103), iocOrder)
+	assert(t, iocOrder.Status, StatusRejected)
+
+	// 100 and 101 both execute 14 with a surplus of 1, without a reference
+	// price the lower one wins.
+	indicative := ob.IndicativePrice()
+	assert(t, indicative, AuctionResult{Price: NewDecimal(100), Volume: NewDecimal(14), Surplus: NewDecimal(1)})
+
+	result, matches, err := ob.Uncross()
+	assert(t, err, nil)
+	assert(t, result, indicative)
+	assert(t, ob.InAuction(), false)
+	assert(t, len(matches), 3)
+	assert(t, len(ob.Trades), 3)
+	for _, trade := range ob.Trades {
+		assert(t, trade.Price, NewDecimal(100))
+	}
+	assert(t, ob.BidTotalVolume(), NewDecimal(11))
+	assert(t, ob.AskTotalVolume(), NewDecimal(10))
+	assert(t, ob.bids.Front().Price, NewDecimal(101))
+	assert(t, ob.asks.Front().Price, NewDecimal(103))
+}
+
+func TestCallAuctionReferencePrice(t *testing.T) {
+	ob := NewOrderbook()
+	ob.PlaceLimitOrder(NewDecimal(105), NewOrder(false, NewDecimal(1), "CSD000000000002-0001"))
+	ob.PlaceLimitOrder(NewDecimal(105), NewOrder(true, NewDecimal(1), "CSD000000000001-0001"))
+
+	ob.StartAuction()
+	auctionBook(ob)
+
+	// the last trade at 105 breaks the tie between 100 and 101.
+	assert(t, ob.IndicativePrice().Price, NewDecimal(101))
+}
+
+func TestPriceBands(t *testing.T) {
+	ob := NewOrderbook()
+	ob.Bands = PriceBands{Static: MustParseDecimal("0.1"), Dynamic: MustParseDecimal("0.05")}
+	ob.ReferencePrice = NewDecimal(100)
+
+	ob.PlaceLimitOrder(NewDecimal(101), NewOrder(false, NewDecimal(5), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(104), NewOrder(false, NewDecimal(5), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(120), NewOrder(false, NewDecimal(5), "CSD000000000001-0001"))
+
+	// sweeping up to 120 breaks the static band of 90 to 110.
+	marketOrder := NewOrder(true, NewDecimal(15), "CSD000000000002-0001")
+	matches, err := ob.PlaceMarketOrder(marketOrder)
+	assert(t, len(matches), 0)
+	assert(t, err, &PriceBandError{Band: StaticBand, Price: NewDecimal(120), Low: NewDecimal(90), High: NewDecimal(110)})
+	assert(t, marketOrder.Status, StatusRejected)
+	assert(t, ob.AskTotalVolume(), NewDecimal(15))
+
+	// the limit price keeps the order inside the static band.
+	limitOrder := NewOrder(true, NewDecimal(5), "CSD000000000002-0001")
+	matches, err = ob.PlaceLimitOrder(NewDecimal(101), limitOrder)
+	assert(t, err, nil)
+	assert(t, len(matches), 1)
+
+	// 104 is inside the dynamic band around the last trade at 101.
+	limitOrder = NewOrder(true, NewDecimal(5), "CSD000000000002-0001")
+	_, err = ob.PlaceLimitOrder(NewDecimal(104), limitOrder)
+	assert(t, err, nil)
+
+	ob.Bands = PriceBands{Dynamic: MustParseDecimal("0.1")}
+	limitOrder = NewOrder(true, NewDecimal(5), "CSD000000000002-0001")
+	_, err = ob.PlaceLimitOrder(NewDecimal(120), limitOrder)
+	assert(t, err, &PriceBandError{Band: DynamicBand, Price: NewDecimal(120), Low: MustParseDecimal("93.6"), High: MustParseDecimal("114.4")})
+	assert(t, limitOrder.Status, StatusRejected)
+}
+
+// bookState encodes the state of the book a replay has to restore.
+func bookState(t *testing.T, ob *Orderbook) []byte {
+	t.Helper()
+
+	levels := func(limits []*Limit) [][]Order {
+		orders := [][]Order{}
+		for _, limit := range limits {
+			level := []Order{}
+			for _, o := range limit.Orders() {
+				order := *o
+				order.Prevented = nil
+				level = append(level, order)
+			}
+			orders = append(orders, level)
+		}
+		return orders
+	}
+
+	stops := []Order{}
+	for _, o := range ob.StopOrders() {
+		stops = append(stops, *o)
+	}
+
+	b, err := json.Marshal(struct {
+		Asks           [][]Order
+		Bids           [][]Order
+		Stops          []Order
+		Trades         []*Trade
+		Orders         int
+		ReferencePrice Decimal
+		Auction        bool
+	}{levels(ob.Asks()), levels(ob.Bids()), stops, ob.Trades, len(ob.Orders), ob.ReferencePrice, ob.InAuction()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestJournalReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INN.journal")
+
+	journal, records, err := OpenJournal(path)
+	assert(t, err, nil)
+	assert(t, len(records), 0)
+
+	ob := NewOrderbook()
+	ob.SetJournal(journal)
+
+	filled := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), filled)
+	iceberg := NewOrder(false, NewDecimal(30), "CSD000000000001-0001")
+	iceberg.DisplaySize = NewDecimal(5)
+	ob.PlaceLimitOrder(NewDecimal(101), iceberg)
+	cancelled := NewOrder(true, NewDecimal(4), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(NewDecimal(95), cancelled)
+	amended := NewOrder(true, NewDecimal(6), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(NewDecimal(96), amended)
+	expiring := NewOrder(true, NewDecimal(3), "CSD000000000003-0001")
+	expiring.TimeInForce = GoodTillDate
+	expiring.ExpiresAt = time.Now().Add(time.Hour).UnixNano()
+	ob.PlaceLimitOrder(NewDecimal(90), expiring)
+
+	ob.PlaceStopOrder(NewDecimal(101), Decimal{}, NewOrder(true, NewDecimal(2), "CSD000000000003-0001"))
+	ob.PlaceMarketOrder(NewOrder(true, NewDecimal(12), "CSD000000000002-0001"))
+	assert(t, ob.CancelOrder(cancelled), nil)
+	// a filled order cannot be cancelled and leaves no record behind.
+	assert(t, ob.CancelOrder(filled) != nil, true)
+	ob.AmendOrder(amended, NewDecimal(97), NewDecimal(8))
+	ob.ExpireOrders(expiring.ExpiresAt)
+
+	ob.StartAuction()
+	ob.PlaceLimitOrder(NewDecimal(102), NewOrder(true, NewDecimal(7), "CSD000000000003-0001"))
+	ob.Uncross()
+
+	assert(t, journal.Close(), nil)
+
+	journal, records, err = OpenJournal(path)
+	assert(t, err, nil)
+	defer journal.Close()
+	for i, record := range records {
+		assert(t, record.Seq, uint64(i+1))
+	}
+
+	replayed := NewOrderbook()
+	assert(t, replayed.Replay(records), nil)
+
+	want := bookState(t, ob)
+	got := bookState(t, replayed)
+	if !bytes.Equal(got, want) {
+		t.Errorf("replayed book differs\n got: %s\nwant: %s", got, want)
+	}
+}
+
+func TestJournalTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INN.journal")
+
+	journal, _, err := OpenJournal(path)
+	assert(t, err, nil)
+	ob := NewOrderbook()
+	ob.SetJournal(journal)
+	ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(10), "CSD000000000001-0001"))
+	assert(t, journal.Close(), nil)
+
+	b, err := os.ReadFile(path)
+	assert(t, err, nil)
+
+	// a crash in the middle of writing the next record.
+	torn := append(bytes.Clone(b), 0, 0, 0, 40, 1, 2)
+	assert(t, os.WriteFile(path, torn, 0o644), nil)
+
+	journal, records, err := OpenJournal(path)
+	assert(t, err, nil)
+	assert(t, len(records), 2)
+	assert(t, journal.Close(), nil)
+
+	info, err := os.Stat(path)
+	assert(t, err, nil)
+	assert(t, info.Size(), int64(len(b)))
+
+	// a flipped bit in a complete record.
+	b[len(b)-2] ^= 1
+	assert(t, os.WriteFile(path, b, 0o644), nil)
+	if _, _, err := OpenJournal(path); err == nil {
+		t.Errorf("expected a checksum error")
+	}
+}
+
+func TestJournalFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	// a command that cannot be journaled is rejected before it is applied.
+	journal, _, err := OpenJournal(filepath.Join(dir, "INN.journal"))
+	assert(t, err, nil)
+	ob := NewOrderbook()
+	ob.SetJournal(journal)
+	ask := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), ask)
+	assert(t, journal.Close(), nil)
+
+	order := NewOrder(true, NewDecimal(4), "CSD000000000002-0001")
+	if _, err := ob.PlaceMarketOrder(order); err == nil {
+		t.Errorf("expected the command to be rejected")
+	}
+	assert(t, order.Status, StatusRejected)
+	assert(t, ask.Size, NewDecimal(10))
+	assert(t, len(ob.Trades), 0)
+	assert(t, ob.Err(), nil)
+
+	// events that cannot be journaled halt the book.
+	path := filepath.Join(dir, "AAPL.journal")
+	journal, _, err = OpenJournal(path)
+	assert(t, err, nil)
+	ob = NewOrderbook()
+	ob.SetJournal(journal)
+	ask = NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), ask)
+
+	assert(t, ob.begin(time.Now().UnixNano(), Command{Type: CommandCancel, OrderID: ask.ID}), nil)
+	ob.applyCancel(ask)
+	assert(t, journal.Close(), nil)
+	ob.end(nil, ask)
+
+	if !errors.Is(ob.Err(), ErrJournalFailed) {
+		t.Errorf("expected the book to be halted, got %v", ob.Err())
+	}
+	if _, err := ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(1), "CSD000000000001-0001")); !errors.Is(err, ErrJournalFailed) {
+		t.Errorf("expected %v, got %v", ErrJournalFailed, err)
+	}
+
+	_, records, err := OpenJournal(path)
+	assert(t, err, nil)
+	assert(t, len(records), 3)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir := t.TempDir()
+	journalPath := filepath.Join(dir, "INN.journal")
+	snapshotPath := filepath.Join(dir, "INN.snapshot")
+
+	journal, _, err := OpenJournal(journalPath)
+	assert(t, err, nil)
+
+	ob := NewOrderbook()
+	ob.SetJournal(journal)
+	ob.SetSnapshots(snapshotPath, 0)
+
+	ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(10), "CSD000000000001-0001"))
+	iceberg := NewOrder(false, NewDecimal(30), "CSD000000000001-0001")
+	iceberg.DisplaySize = NewDecimal(5)
+	ob.PlaceLimitOrder(NewDecimal(101), iceberg)
+	amended := NewOrder(true, NewDecimal(6), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(NewDecimal(96), amended)
+	ob.PlaceLimitOrder(NewDecimal(96), NewOrder(true, NewDecimal(4), "CSD000000000003-0001"))
+	ob.PlaceStopOrder(NewDecimal(101), Decimal{}, NewOrder(true, NewDecimal(2), "CSD000000000003-0001"))
+	ob.PlaceMarketOrder(NewOrder(true, NewDecimal(12), "CSD000000000002-0001"))
+
+	assert(t, ob.Snapshot(), nil)
+	info, err := os.Stat(journalPath)
+	assert(t, err, nil)
+	assert(t, info.Size(), int64(0))
+
+	ob.AmendOrder(amended, NewDecimal(97), NewDecimal(8))
+	ob.PlaceMarketOrder(NewOrder(false, NewDecimal(9), "CSD000000000001-0001"))
+	assert(t, journal.Close(), nil)
+
+	// filled orders leave the book.
+	assert(t, len(ob.Orders), 2)
+
+	restored := NewOrderbook()
+	assert(t, restored.LoadSnapshot(snapshotPath), nil)
+
+	journal, records, err := OpenJournal(journalPath)
+	assert(t, err, nil)
+	defer journal.Close()
+	assert(t, records[0].Seq, restored.seq+1)
+	assert(t, restored.Replay(records), nil)
+
+	want := bookState(t, ob)
+	got := bookState(t, restored)
+	if !bytes.Equal(got, want) {
+		t.Errorf("restored book differs\n got: %s\nwant: %s", got, want)
+	}
+
+	// records the book already includes are skipped.
+	assert(t, restored.Replay(records), nil)
+	assert(t, restored.seq, records[len(records)-1].Seq)
+
+	b, err := os.ReadFile(snapshotPath)
+	assert(t, err, nil)
+	b[len(b)/2] ^= 1
+	if err := NewOrderbook().UnmarshalBinary(b); !errors.Is(err, ErrInvalidSnapshot) {
+		t.Errorf("expected an invalid snapshot error, got %v", err)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids")
+
+	ids, err := OpenIDGenerator(path, 10)
+	assert(t, err, nil)
+
+	seen := make(map[int64]bool)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 25 {
+				id, err := ids.Next()
+				assert(t, err, nil)
+				mu.Lock()
+				seen[id] = true
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert(t, len(seen), 100)
+	for id := int64(1); id <= 100; id++ {
+		assert(t, seen[id], true)
+	}
+
+	// a restart carries on after the reserved block.
+	ids.Next()
+	restarted, err := OpenIDGenerator(path, 10)
+	assert(t, err, nil)
+	id, err := restarted.Next()
+	assert(t, err, nil)
+	assert(t, id, int64(111))
+
+	// an ID that cannot be reserved is not handed out, the directory in
+	// place of the file makes the reservation of the next block fail.
+	assert(t, os.Remove(path), nil)
+	assert(t, os.Mkdir(path, 0o755), nil)
+	for range 9 { // the rest of the reserved block
+
+		restarted.Next()
+	}
+	id, err = restarted.Next()
+	assert(t, err != nil, true)
+	assert(t, id, int64(0))
+}
+
+func TestTradeIDsReserved(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids")
+	ids, err := OpenIDGenerator(path, 2)
+	assert(t, err, nil)
+
+	ob := NewOrderbook()
+	ob.IDs = ids
+	for range 3 {
+		ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(1), "CSD000000000001-0001"))
+	}
+	matches, err := ob.PlaceMarketOrder(NewOrder(true, NewDecimal(3), "CSD000000000002-0001"))
+	assert(t, err, nil)
+	assert(t, len(matches), 3)
+
+	// every trade ID was reserved before it was handed out.
+	restarted, err := OpenIDGenerator(path, 2)
+	assert(t, err, nil)
+	next, err := restarted.Next()
+	assert(t, err, nil)
+	for _, match := range matches {
+		assert(t, match.TradeID < next, true)
+	}
+
+	// a command whose trade IDs cannot be reserved is rejected before it
+	// changed the book, the directory in place of the file makes the
+	// reservation fail.
+	ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(1), "CSD000000000001-0001"))
+	assert(t, os.Remove(path), nil)
+	assert(t, os.Mkdir(path, 0o755), nil)
+	order := NewOrder(true, NewDecimal(1), "CSD000000000002-0001")
+	order.ID = next + 1_000
+	if _, err := ob.PlaceMarketOrder(order); err == nil {
+		t.Errorf("expected the order to be rejected")
+	}
+	assert(t, order.Status, StatusRejected)
+	assert(t, len(ob.Trades), 3)
+	assert(t, ob.AskTotalVolume(), NewDecimal(1))
+}
+
+func TestReplayTradeIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "INN.journal")
+
+	journal, _, err := OpenJournal(path)
+	assert(t, err, nil)
+
+	ob := NewOrderbook()
+	ob.SetJournal(journal)
+	ob.PlaceLimitOrder(NewDecimal(100), NewOrder(false, NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(NewDecimal(101), NewOrder(false, NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceMarketOrder(NewOrder(true, NewDecimal(15), "CSD000000000002-0001"))
+	assert(t, journal.Close(), nil)
+
+	journal, records, err := OpenJournal(path)
+	assert(t, err, nil)
+	defer journal.Close()
+
+	replayed := NewOrderbook()
+	replayed.IDs = NewIDGenerator()
+	assert(t, replayed.Replay(records), nil)
+
+	assert(t, len(replayed.Trades), 2)
+	for i, trade := range replayed.Trades {
+		assert(t, *trade, *ob.Trades[i])
+	}
+}
+
+func TestTradeAttribution(t *testing.T) {
+	ob := NewOrderbook()
+	ob.Market = "INN"
+
+	maker := NewOrder(false, NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(NewDecimal(100), maker)
+	taker := NewOrder(true, NewDecimal(4), "CSD000000000002-0001")
+	ob.PlaceMarketOrder(taker)
+	seller := NewOrder(false, NewDecimal(4), "CSD000000000003-0001")
+	ob.PlaceLimitOrder(NewDecimal(99), NewOrder(true, NewDecimal(4), "CSD000000000002-0001"))
+	ob.PlaceMarketOrder(seller)
+
+	assert(t, len(ob.Trades), 2)
+	buy, sell := ob.Trades[0], ob.Trades[1]
+	assert(t, buy.Seq, uint64(1))
+	assert(t, buy.Market, "INN")
+	assert(t, buy.BuyerUserID, taker.UserID)
+	assert(t, buy.SellerUserID, maker.UserID)
+	assert(t, buy.MakerOrderID, maker.ID)
+	assert(t, buy.TakerOrderID, taker.ID)
+	assert(t, buy.AggressorSide, SideBid)
+	assert(t, sell.Seq, uint64(2))
+	assert(t, sell.SellerUserID, seller.UserID)
+	assert(t, sell.TakerOrderID, seller.ID)
+	assert(t, sell.AggressorSide, SideAsk)
+
+	assert(t, ob.FilterTrades(TradeFilter{Since: 1}), []*Trade{sell})
+	assert(t, ob.FilterTrades(TradeFilter{Limit: 1}), []*Trade{buy})
+	assert(t, ob.FilterTrades(TradeFilter{From: sell.Timestamp}), []*Trade{sell})
+	assert(t, ob.FilterTrades(TradeFilter{To: sell.Timestamp}), []*Trade{buy})
+}
+
+func TestDepthGroupLevels(t *testing.T) {
+	ob := NewOrderbook()
+	for _, price := range []string{"10.01", "10.01", "10.04", "10.10", "10.15"} {
+		ob.PlaceLimitOrder(MustParseDecimal(price), NewOrder(false, NewDecimal(5), "CSD000000000001-0001"))
+	}
+	for _, price := range []string{"9.99", "9.95", "9.90", "9.90"} {
+		ob.PlaceLimitOrder(MustParseDecimal(price), NewOrder(true, NewDecimal(10), "CSD000000000002-0001"))
+	}
+
+	bids, asks := ob.Depth(0)
+	assert(t, asks[0], Level{Price: MustParseDecimal("10.01"), Volume: NewDecimal(10), Orders: 2})
+	assert(t, len(bids), 3)
+
+	group := MustParseDecimal("0.10")
+	assert(t, GroupLevels(asks, group, false), []Level{
+		{Price: MustParseDecimal("10.10"), Volume: NewDecimal(20), Orders: 4},
+		{Price: MustParseDecimal("10.20"), Volume: NewDecimal(5), Orders: 1},
+	})
+	assert(t, GroupLevels(bids, group, true), []Level{
+		{Price: MustParseDecimal("9.90"), Volume: NewDecimal(40), Orders: 4},
+	})
+
+	assert(t, MustParseDecimal("-1.05").Floor(group), MustParseDecimal("-1.10"))
+	assert(t, MustParseDecimal("-1.05").Ceil(group), MustParseDecimal("-1"))
+	assert(t, MustParseDecimal("1.10").Ceil(group), MustParseDecimal("1.10"))
+}
+
+func TestBookCopiesOrders(t *testing.T) {
+	ob := NewOrderbook()
+	price := NewDecimal(100)
+	first := NewOrder(false, NewDecimal(5), "CSD000000000001-0001")
+	second := NewOrder(false, NewDecimal(3), "CSD000000000002-0001")
+	ob.PlaceLimitOrder(price, first)
+	ob.PlaceLimitOrder(price, second)
+
+	bids, asks := ob.Book(0)
+	assert(t, len(bids), 0)
+	assert(t, len(asks), 1)
+	assert(t, asks[0].Volume, NewDecimal(8))
+	assert(t, len(asks[0].Orders), 2)
+	assert(t, asks[0].Orders[0].ID, first.ID)
+	assert(t, asks[0].Orders[1].ID, second.ID)
+	assert(t, asks[0].Orders[0].Limit == nil, true)
+
+	// the copies do not change with the book.
+	ob.PlaceMarketOrder(NewOrder(true, NewDecimal(2), "CSD000000000003-0001"))
+	assert(t, first.Size, NewDecimal(3))
+	assert(t, asks[0].Orders[0].Size, NewDecimal(5))
+
+	state, ok := ob.OrderState(first.ID)
+	assert(t, ok, true)
+	assert(t, state.Size, NewDecimal(3))
+
+	ob.PlaceMarketOrder(NewOrder(true, NewDecimal(3), "CSD000000000003-0001"))
+	_, ok = ob.OrderState(first.ID)
+	assert(t, ok, false)
+}
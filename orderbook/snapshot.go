@@ -0,0 +1,386 @@
+package orderbook
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// snapshotVersion is the version of the snapshot format written by
+// MarshalBinary. Bump it on every change to the format.
+const snapshotVersion = 1
+
+// snapshotTrades is the number of most recent trades a snapshot keeps.
+const snapshotTrades = 1000
+
+// snapshotMagic starts every snapshot.
+var snapshotMagic = []byte("OBSN")
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// MarshalBinary serializes the state of the book: both sides with the orders
+// of every limit in priority order, the stop orders, the most recent trades,
+// the reference price, the auction flag and the sequence number of the last
+// journal record the state includes. The configuration of the book, its scale
+// and price bands, is not part of it.
+//
+// The format is the magic "OBSN", the version and the state as varints and
+// length prefixed strings, followed by the big endian CRC-32 of everything
+// before it.
+func (ob *Orderbook) MarshalBinary() ([]byte, error) {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	return ob.marshalSnapshot(), nil
+}
+
+func (ob *Orderbook) marshalSnapshot() []byte {
+	w := &snapshotWriter{buf: bytes.Clone(snapshotMagic)}
+	w.uvarint(snapshotVersion)
+
+	w.uvarint(ob.seq)
+	w.decimal(ob.ReferencePrice)
+	w.bool(ob.auction)
+
+	for _, side := range []*ladder{ob.asks, ob.bids} {
+		w.uvarint(uint64(side.Len()))
+		for limit := range side.All() {
+			w.decimal(limit.Price)
+			w.uvarint(uint64(limit.Len()))
+			for o := limit.head; o != nil; o = o.next {
+				w.order(o)
+			}
+		}
+	}
+
+	for _, stops := range [][]*Order{ob.buyStops, ob.sellStops} {
+		w.uvarint(uint64(len(stops)))
+		for _, o := range stops {
+			w.order(o)
+		}
+	}
+
+	trades := ob.Trades[max(0, len(ob.Trades)-snapshotTrades):]
+	w.uvarint(uint64(len(trades)))
+	for _, trade := range trades {
+		w.varint(trade.ID)
+		w.varint(trade.MakerOrderID)
+		w.varint(trade.TakerOrderID)
+		w.uvarint(trade.Seq)
+		w.string(trade.BuyerUserID)
+		w.string(trade.SellerUserID)
+		w.decimal(trade.Price)
+		w.decimal(trade.Size)
+		w.bool(trade.Bid)
+		w.varint(trade.Timestamp)
+	}
+
+	return binary.BigEndian.AppendUint32(w.buf, crc32.ChecksumIEEE(w.buf))
+}
+
+// UnmarshalBinary replaces the state of the book with the snapshot in data.
+// Orders, limits and trades are rebuilt, the book keeps its configuration and
+// its journal.
+func (ob *Orderbook) UnmarshalBinary(data []byte) error {
+	if len(data) < len(snapshotMagic)+4 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return ErrInvalidSnapshot
+	}
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != checksum {
+		return fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+
+	r := &snapshotReader{buf: body[len(snapshotMagic):]}
+	version := r.uvarint()
+	if r.err == nil && version != snapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, version)
+	}
+
+	restored := NewOrderbookWithScale(ob.Scale)
+	restored.seq = r.uvarint()
+	restored.ReferencePrice = r.decimal()
+	restored.auction = r.bool()
+
+	for _, bid := range []bool{false, true} {
+		levels := r.uvarint()
+		for i := uint64(0); i < levels && r.err == nil; i++ {
+			limit := NewLimit(r.decimal())
+			count := r.uvarint()
+			for j := uint64(0); j < count && r.err == nil; j++ {
+				o := r.order()
+				limit.AddOrder(o)
+				restored.Orders[o.ID] = o
+			}
+
+			if bid {
+				restored.BidLimits[limit.Price] = limit
+			} else {
+				restored.AskLimits[limit.Price] = limit
+			}
+			restored.side(bid).Insert(limit)
+		}
+	}
+
+	for _, stops := range []*[]*Order{&restored.buyStops, &restored.sellStops} {
+		count := r.uvarint()
+		for i := uint64(0); i < count && r.err == nil; i++ {
+			o := r.order()
+			*stops = append(*stops, o)
+			restored.Orders[o.ID] = o
+		}
+	}
+
+	count := r.uvarint()
+	for i := uint64(0); i < count && r.err == nil; i++ {
+		trade := &Trade{
+			Market:       ob.Market,
+			ID:           r.varint(),
+			MakerOrderID: r.varint(),
+			TakerOrderID: r.varint(),
+			Seq:          r.uvarint(),
+			BuyerUserID:  r.string(),
+			SellerUserID: r.string(),
+			Price:        r.decimal(),
+			Size:         r.decimal(),
+			Bid:          r.bool(),
+		}
+		trade.AggressorSide = sideOf(trade.Bid)
+		trade.Timestamp = r.varint()
+		restored.Trades = append(restored.Trades, trade)
+		restored.tradeSeq = trade.Seq
+	}
+
+	if r.err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSnapshot, r.err)
+	}
+	if len(r.buf) > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidSnapshot, len(r.buf))
+	}
+
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.asks, ob.bids = restored.asks, restored.bids
+	ob.AskLimits, ob.BidLimits = restored.AskLimits, restored.BidLimits
+	ob.buyStops, ob.sellStops = restored.buyStops, restored.sellStops
+	ob.Orders = restored.Orders
+	ob.Trades, ob.tradeSeq = restored.Trades, restored.tradeSeq
+	ob.ReferencePrice = restored.ReferencePrice
+	ob.auction = restored.auction
+	ob.seq, ob.snapshotSeq = restored.seq, restored.seq
+
+	return nil
+}
+
+// LoadSnapshot restores the book from the snapshot file at path. Replay the
+// journal after it, the records the snapshot already includes are skipped.
+func (ob *Orderbook) LoadSnapshot(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := ob.UnmarshalBinary(data); err != nil {
+		return fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	return nil
+}
+
+// SetSnapshots makes the book write a snapshot to path after every n journal
+// records, n zero only writes the snapshots asked for with Snapshot. Once a
+// snapshot is written the journal is truncated, it only holds the records
+// after the snapshot.
+func (ob *Orderbook) SetSnapshots(path string, n uint64) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	ob.snapshotPath = path
+	ob.snapshotEvery = n
+}
+
+// Snapshot writes a snapshot when the book changed since the last one.
+func (ob *Orderbook) Snapshot() error {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if ob.snapshotPath == "" || ob.seq == ob.snapshotSeq {
+		return nil
+	}
+	return ob.writeSnapshot()
+}
+
+// maybeSnapshot writes a snapshot when n records were journaled since the
+// last one.
+func (ob *Orderbook) maybeSnapshot() {
+	if ob.snapshotPath == "" || ob.snapshotEvery == 0 || ob.seq-ob.snapshotSeq < ob.snapshotEvery {
+		return
+	}
+	if err := ob.writeSnapshot(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"path": ob.snapshotPath,
+			"err":  err,
+		}).Error("writing orderbook snapshot")
+	}
+}
+
+// writeSnapshot writes the snapshot to a temporary file and renames it over
+// the previous one, so a crash leaves either the old or the new snapshot.
+// The journal is truncated after the rename, a crash in between leaves
+// records in it that Replay skips.
+func (ob *Orderbook) writeSnapshot() error {
+	tmp, err := os.CreateTemp(filepath.Dir(ob.snapshotPath), filepath.Base(ob.snapshotPath)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(ob.marshalSnapshot()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), ob.snapshotPath); err != nil {
+		return err
+	}
+
+	ob.snapshotSeq = ob.seq
+
+	if ob.journal != nil {
+		return ob.journal.truncate()
+	}
+	return nil
+}
+
+type snapshotWriter struct {
+	buf []byte
+}
+
+func (w *snapshotWriter) uvarint(v uint64)  { w.buf = binary.AppendUvarint(w.buf, v) }
+func (w *snapshotWriter) varint(v int64)    { w.buf = binary.AppendVarint(w.buf, v) }
+func (w *snapshotWriter) decimal(d Decimal) { w.varint(d.units) }
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *snapshotWriter) bool(b bool) {
+	if b {
+		w.buf = append(w.buf, 1)
+	} else {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *snapshotWriter) order(o *Order) {
+	w.varint(o.ID)
+	w.string(o.UserID)
+	w.bool(o.Bid)
+	w.decimal(o.Size)
+	w.decimal(o.Price)
+	w.varint(o.Timestamp)
+	w.string(string(o.TimeInForce))
+	w.varint(o.ExpiresAt)
+	w.decimal(o.StopPrice)
+	w.decimal(o.DisplaySize)
+	w.decimal(o.Hidden)
+	w.string(string(o.LiquidityPolicy))
+	w.decimal(o.ProtectionPrice)
+	w.string(string(o.SelfTradePrevention))
+	w.string(string(o.Status))
+}
+
+// snapshotReader reads the values written by snapshotWriter. The first error
+// sticks, every read after it returns the zero value.
+type snapshotReader struct {
+	buf []byte
+	err error
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("truncated varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *snapshotReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errors.New("truncated varint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+func (r *snapshotReader) decimal() Decimal {
+	return Decimal{units: r.varint()}
+}
+
+func (r *snapshotReader) string() string {
+	n := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if n > uint64(len(r.buf)) {
+		r.err = errors.New("truncated string")
+		return ""
+	}
+	s := string(r.buf[:n])
+	r.buf = r.buf[n:]
+	return s
+}
+
+func (r *snapshotReader) bool() bool {
+	if r.err != nil {
+		return false
+	}
+	if len(r.buf) == 0 {
+		r.err = errors.New("truncated bool")
+		return false
+	}
+	b := r.buf[0]
+	r.buf = r.buf[1:]
+	return b != 0
+}
+
+func (r *snapshotReader) order() *Order {
+	return &Order{
+		ID:                  r.varint(),
+		UserID:              r.string(),
+		Bid:                 r.bool(),
+		Size:                r.decimal(),
+		Price:               r.decimal(),
+		Timestamp:           r.varint(),
+		TimeInForce:         TimeInForce(r.string()),
+		ExpiresAt:           r.varint(),
+		StopPrice:           r.decimal(),
+		DisplaySize:         r.decimal(),
+		Hidden:              r.decimal(),
+		LiquidityPolicy:     LiquidityPolicy(r.string()),
+		ProtectionPrice:     r.decimal(),
+		SelfTradePrevention: SelfTradePrevention(r.string()),
+		Status:              OrderStatus(r.string()),
+	}
+}
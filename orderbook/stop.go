@@ -0,0 +1,204 @@
+package orderbook
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PlaceStopOrder holds the order in the stop book until the last trade price
+// reaches stopPrice: at or above it for buy stops, at or below it for sell
+// stops. A triggered stop is released as a market order, or as a limit order
+// at price for stop-limit orders. A price of zero places a stop-market order.
+//
+// A stop-market order without a liquidity policy is released with FillAndKill:
+// it fills what the book has when it triggers and cancels the rest. Triggered
+// stops are kept for TriggeredStops.
+//
+// The stop is triggered right away when the last trade already went through
+// its stop price, in which case the resulting matches are returned.
+func (ob *Orderbook) PlaceStopOrder(stopPrice, price Decimal, o *Order) ([]Match, error) {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	if err := ob.number(o); err != nil {
+		return nil, err
+	}
+	if err := ob.begin(time.Now().UnixNano(), Command{Type: CommandPlaceStop, Order: newOrderEntry(o), StopPrice: stopPrice, Price: price}); err != nil {
+		o.Status = StatusRejected
+		return nil, err
+	}
+	matches := ob.applyPlaceStop(stopPrice, price, o)
+	ob.end(matches, o)
+
+	return matches, nil
+}
+
+func (ob *Orderbook) applyPlaceStop(stopPrice, price Decimal, o *Order) []Match {
+	o.StopPrice = stopPrice
+	o.Price = price
+	o.Status = StatusPending
+	if price.IsZero() && o.LiquidityPolicy == "" {
+		o.LiquidityPolicy = FillAndKill
+	}
+
+	if o.Bid {
+		ob.buyStops = append(ob.buyStops, o)
+	} else {
+		ob.sellStops = append(ob.sellStops, o)
+	}
+	ob.Orders[o.ID] = o
+
+	logrus.WithFields(logrus.Fields{
+		"stopPrice": o.StopPrice,
+		"price":     o.Price,
+		"type":      o.Type(),
+		"size":      o.Size,
+		"userID":    o.UserID,
+	}).Info("new stop order")
+
+	return ob.triggerStops()
+}
+
+// StopOrders returns the stop orders that are still waiting for their trigger.
+func (ob *Orderbook) StopOrders() []*Order {
+	ob.mu.RLock()
+	defer ob.mu.RUnlock()
+
+	stops := make([]*Order, 0, len(ob.buyStops)+len(ob.sellStops))
+	stops = append(stops, ob.buyStops...)
+	return append(stops, ob.sellStops...)
+}
+
+// TriggeredStop is a copy of a stop order as the command that triggered it
+// left it: resting in the book, filled, cancelled or rejected with Err. The
+// prevented matches of the copy hold copies of the resting orders.
+type TriggeredStop struct {
+	Order Order
+	Err   error
+}
+
+// TriggeredStops returns the stop orders that were triggered since the last
+// call. The owners of the stops were not around when they triggered, so the
+// caller has to report what happened to them.
+func (ob *Orderbook) TriggeredStops() []TriggeredStop {
+	ob.mu.Lock()
+	defer ob.mu.Unlock()
+
+	triggered := ob.triggeredStops
+	ob.triggeredStops = nil
+	return triggered
+}
+
+// triggerStops releases every stop order whose stop price was hit by the last
+// trade into normal matching. Trades made by released stops can trigger
+// further stops, so this keeps going until no stop is triggered anymore.
+func (ob *Orderbook) triggerStops() []Match {
+	matches := []Match{}
+
+	// stops wait for the first trade of the uncross during a call auction.
+	if ob.auction {
+		return matches
+	}
+
+	for {
+		triggered := ob.popTriggeredStops()
+		if len(triggered) == 0 {
+			return matches
+		}
+
+		for _, o := range triggered {
+			logrus.WithFields(logrus.Fields{
+				"id":        o.ID,
+				"stopPrice": o.StopPrice,
+				"type":      o.Type(),
+			}).Info("stop order triggered")
+
+			var (
+				stopMatches []Match
+				err         error
+			)
+			if o.Price.IsZero() {
+				stopMatches, err = ob.placeMarketOrder(o)
+			} else {
+				stopMatches, err = ob.placeLimitOrder(o.Price, o)
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":  o.ID,
+					"err": err,
+				}).Warn("triggered stop order rejected")
+				ob.stopErrors[o] = err
+			}
+			matches = append(matches, stopMatches...)
+		}
+	}
+}
+
+// popTriggeredStops removes the stops triggered since they were last checked
+// from the stop book and returns them, buy stops first and each side in
+// arrival order. A stop is triggered by the last trade price and by every
+// trade since the last check, so a sweep through its stop price triggers it
+// even when the sweep ends on the other side. Released stops take their time
+// priority from the last trade.
+func (ob *Orderbook) popTriggeredStops() []*Order {
+	if len(ob.Trades) == 0 {
+		return nil
+	}
+	lastTrade := ob.Trades[len(ob.Trades)-1]
+	low, high := lastTrade.Price, lastTrade.Price
+	if ob.unchecked {
+		low = MinDecimal(low, ob.uncheckedLow)
+		high = MaxDecimal(high, ob.uncheckedHigh)
+		ob.unchecked = false
+	}
+
+	var (
+		triggered []*Order
+		buyStops  = ob.buyStops[:0]
+		sellStops = ob.sellStops[:0]
+	)
+
+	for _, o := range ob.buyStops {
+		if high.GreaterThanOrEqual(o.StopPrice) {
+			triggered = append(triggered, o)
+			delete(ob.Orders, o.ID)
+		} else {
+			buyStops = append(buyStops, o)
+		}
+	}
+
+	for _, o := range ob.sellStops {
+		if low.LessThanOrEqual(o.StopPrice) {
+			triggered = append(triggered, o)
+			delete(ob.Orders, o.ID)
+		} else {
+			sellStops = append(sellStops, o)
+		}
+	}
+
+	ob.buyStops = buyStops
+	ob.sellStops = sellStops
+
+	for _, o := range triggered {
+		o.Timestamp = lastTrade.Timestamp
+	}
+	ob.touched = append(ob.touched, triggered...)
+
+	return triggered
+}
+
+func (ob *Orderbook) deleteStopOrder(o *Order) {
+	stops := &ob.sellStops
+	if o.Bid {
+		stops = &ob.buyStops
+	}
+
+	for i := 0; i < len(*stops); i++ {
+		if (*stops)[i] == o {
+			*stops = append((*stops)[:i], (*stops)[i+1:]...)
+			break
+		}
+	}
+	delete(ob.Orders, o.ID)
+}
@@ -0,0 +1,127 @@
+package orderbook
+
+import "github.com/sirupsen/logrus"
+
+const (
+	// AllowSelfTrade lets an order match against orders of the same user.
+	// It is the default.
+	AllowSelfTrade SelfTradePrevention = "NONE"
+	// CancelNewest cancels what is left of the incoming order and keeps the
+	// resting order.
+	CancelNewest SelfTradePrevention = "CANCEL_NEWEST"
+	// CancelOldest cancels the resting order and keeps matching the
+	// incoming order.
+	CancelOldest SelfTradePrevention = "CANCEL_OLDEST"
+	// CancelBoth cancels the resting order and what is left of the
+	// incoming order.
+	CancelBoth SelfTradePrevention = "CANCEL_BOTH"
+	// DecrementAndCancel takes the size the orders would have matched off
+	// both orders without a trade and cancels the smaller one, or both when
+	// they are the same size.
+	DecrementAndCancel SelfTradePrevention = "DECREMENT_AND_CANCEL"
+)
+
+type (
+	// SelfTradePrevention decides what happens when an incoming order would
+	// match a resting order of the same user. The mode of the incoming order
+	// applies.
+	SelfTradePrevention string
+
+	// PreventedMatch is a match between two orders of the same user that
+	// self-trade prevention stopped. Size is the size taken off the orders
+	// without a trade, zero unless the mode is DecrementAndCancel.
+	PreventedMatch struct {
+		Resting  *Order
+		Incoming *Order
+		Size     Decimal
+		Mode     SelfTradePrevention
+	}
+)
+
+// IsValid reports whether m is a known self-trade prevention mode, the empty
+// mode included.
+func (m SelfTradePrevention) IsValid() bool {
+	switch m {
+	case "", AllowSelfTrade, CancelNewest, CancelOldest, CancelBoth, DecrementAndCancel:
+		return true
+	}
+	return false
+}
+
+// isDone reports whether the order cannot be matched any further, because it
+// got filled or self-trade prevention cancelled it.
+func (o *Order) isDone() bool {
+	return o.IsFilled() || o.Status == StatusCancelled
+}
+
+// selfTrade reports whether matching o against the resting order would be a
+// self-trade that o's self-trade prevention mode has to stop.
+func selfTrade(resting, o *Order) bool {
+	if o.SelfTradePrevention == "" || o.SelfTradePrevention == AllowSelfTrade {
+		return false
+	}
+	return resting.UserID == o.UserID
+}
+
+// preventSelfTrade applies the self-trade prevention mode of the incoming
+// order o to the resting order at the front of the limit and records the
+// prevented match on o.
+func (l *Limit) preventSelfTrade(resting, o *Order) {
+	prevented := PreventedMatch{
+		Resting:  resting,
+		Incoming: o,
+		Mode:     o.SelfTradePrevention,
+	}
+
+	switch o.SelfTradePrevention {
+	case CancelNewest:
+		o.Status = StatusCancelled
+	case CancelOldest:
+		l.cancelResting(resting)
+	case CancelBoth:
+		l.cancelResting(resting)
+		o.Status = StatusCancelled
+	case DecrementAndCancel:
+		size := MinDecimal(o.Size, resting.Size.Add(resting.Hidden))
+		prevented.Size = size
+		l.decrementResting(resting, size)
+		o.Size = o.Size.Sub(size)
+
+		if resting.IsFilled() {
+			l.cancelResting(resting)
+		}
+		if o.Size.IsZero() {
+			o.Status = StatusCancelled
+		}
+	}
+
+	o.Prevented = append(o.Prevented, prevented)
+
+	logrus.WithFields(logrus.Fields{
+		"userID":   o.UserID,
+		"mode":     o.SelfTradePrevention,
+		"incoming": o.ID,
+		"resting":  resting.ID,
+	}).Info("self-trade prevented")
+}
+
+func (l *Limit) cancelResting(o *Order) {
+	l.DeleteOrder(o)
+	o.Status = StatusCancelled
+}
+
+// decrementResting takes size off the resting order, first off the visible
+// size and then off the hidden reserve.
+func (l *Limit) decrementResting(o *Order, size Decimal) {
+	visible := MinDecimal(o.Size, size)
+	hidden := size.Sub(visible)
+
+	o.Size = o.Size.Sub(visible)
+	o.Hidden = o.Hidden.Sub(hidden)
+	l.TotalVolume = l.TotalVolume.Sub(visible)
+	l.HiddenVolume = l.HiddenVolume.Sub(hidden)
+
+	if o.Size.IsZero() && o.Hidden.IsPositive() {
+		l.refreshIceberg(o, o.Timestamp)
+	}
+}
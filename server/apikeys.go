@@ -0,0 +1,462 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ScopeRead allows reading the orders of the user.
+	ScopeRead Scope = "READ"
+	// ScopeTrade allows placing, amending and cancelling orders and changing
+	// the settings of the user.
+	ScopeTrade Scope = "TRADE"
+	// ScopeCancel only allows cancelling orders.
+	ScopeCancel Scope = "CANCEL"
+)
+
+// The headers of a request authenticated with an API key.
+const (
+	HeaderAPIKey    = "X-API-Key"
+	HeaderAPISecret = "X-API-Secret"
+)
+
+type (
+	Scope string
+
+	// APIKey lets a program act for a user within the scopes of the key.
+	// AllowedIPs are IP addresses or CIDR ranges the key may be used from,
+	// any address when empty. ExpiresAt and RevokedAt are unix nano, zero
+	// when the key does not expire or is not revoked.
+	APIKey struct {
+		ID         string
+		UserID     string
+		Label      string
+		Scopes     []Scope
+		AllowedIPs []string
+		CreatedAt  int64
+		ExpiresAt  int64
+		RevokedAt  int64
+	}
+
+	// CreateAPIKeyRequest creates a key for the user that signed the
+	// request, UserID is only used by admins.
+	CreateAPIKeyRequest struct {
+		UserID     string
+		Label      string
+		Scopes     []Scope
+		AllowedIPs []string
+		ExpiresAt  int64
+	}
+
+	// CreateAPIKeyResponse holds the new key with its secret, which is only
+	// shown once: the exchange keeps a hash of it.
+	CreateAPIKeyResponse struct {
+		APIKey
+		Secret string
+	}
+
+	// apiKeyRecord is a key as it is stored.
+	apiKeyRecord struct {
+		APIKey
+		SecretHash string
+	}
+
+	// apiKeyStore holds the API keys of all users, persisted to the JSON
+	// file at path unless it is empty.
+	apiKeyStore struct {
+		mu   sync.RWMutex
+		keys map[string]*apiKeyRecord
+		path string
+	}
+)
+
+func (s Scope) isValid() bool {
+	return s == ScopeRead || s == ScopeTrade || s == ScopeCancel
+}
+
+// allows reports whether the key grants the scope, TRADE grants CANCEL.
+func (k *APIKey) allows(scope Scope) bool {
+	return slices.Contains(k.Scopes, scope) || (scope == ScopeCancel && slices.Contains(k.Scopes, ScopeTrade))
+}
+
+// before reports whether k is listed before k2: the older key first, keys
+// created at the same time by ID.
+func (k *APIKey) before(k2 *APIKey) bool {
+	if k.CreatedAt != k2.CreatedAt {
+		return k.CreatedAt < k2.CreatedAt
+	}
+	return k.ID < k2.ID
+}
+
+// allowsIP reports whether the key may be used from the address.
+func (k *APIKey) allowsIP(addr string) bool {
+	if len(k.AllowedIPs) == 0 {
+		return true
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range k.AllowedIPs {
+		if _, network, err := net.ParseCIDR(allowed); err == nil {
+			if network.Contains(ip) {
+				return true
+			}
+		} else if net.ParseIP(allowed).Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newAPIKeyStore() *apiKeyStore {
+	return &apiKeyStore{keys: make(map[string]*apiKeyRecord)}
+}
+
+// openAPIKeyStore returns the store persisted to the file at path, a missing
+// file is an empty store.
+func openAPIKeyStore(path string) (*apiKeyStore, error) {
+	s := newAPIKeyStore()
+	s.path = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*apiKeyRecord{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return nil, fmt.Errorf("api key file %s: %w", path, err)
+	}
+	for _, record := range records {
+		s.keys[record.ID] = record
+	}
+
+	return s, nil
+}
+
+// save writes the keys to the file of the store, the caller holds s.mu.
+func (s *apiKeyStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	records := make([]*apiKeyRecord, 0, len(s.keys))
+	for _, record := range s.keys {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].before(&records[j].APIKey) })
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b)
+}
+
+// create stores a new key and returns it with its secret.
+func (s *apiKeyStore) create(key APIKey) (*CreateAPIKeyResponse, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	key.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[id] = &apiKeyRecord{APIKey: key, SecretHash: hashSecret(secret)}
+	if err := s.save(); err != nil {
+		delete(s.keys, id)
+		return nil, err
+	}
+
+	return &CreateAPIKeyResponse{APIKey: key, Secret: secret}, nil
+}
+
+// list returns the keys of the user, or of every user when userID is empty,
+// oldest first and keys created at the same time by ID.
+func (s *apiKeyStore) list(userID string) []APIKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := []APIKey{}
+	for _, record := range s.keys {
+		if userID == "" || record.UserID == userID {
+			keys = append(keys, record.APIKey)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].before(&keys[j]) })
+	return keys
+}
+
+// get returns the key with the ID.
+func (s *apiKeyStore) get(id string) (APIKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	record, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, false
+	}
+	return record.APIKey, true
+}
+
+// revoke revokes the key, revoked keys are kept so they still show up in the
+// list of keys.
+func (s *apiKeyStore) revoke(id string, now time.Time) (APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, ok := s.keys[id]
+	if !ok {
+		return APIKey{}, fmt.Errorf("api key not found: %s", id)
+	}
+	if record.RevokedAt == 0 {
+		record.RevokedAt = now.UnixNano()
+		if err := s.save(); err != nil {
+			record.RevokedAt = 0
+			return APIKey{}, err
+		}
+	}
+	return record.APIKey, nil
+}
+
+// verify returns the key with the ID and secret if it can be used from the
+// address at now.
+func (s *apiKeyStore) verify(id, secret, addr string, now time.Time) (APIKey, error) {
+	// the record is copied under the lock, revoke changes it in place.
+	s.mu.RLock()
+	var record apiKeyRecord
+	stored, ok := s.keys[id]
+	if ok {
+		record = *stored
+	}
+	s.mu.RUnlock()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(record.SecretHash)) != 1 {
+		return APIKey{}, fmt.Errorf("invalid api key")
+	}
+	if record.RevokedAt != 0 {
+		return APIKey{}, fmt.Errorf("api key %s is revoked", id)
+	}
+	if record.ExpiresAt != 0 && now.UnixNano() >= record.ExpiresAt {
+		return APIKey{}, fmt.Errorf("api key %s expired", id)
+	}
+	if !record.allowsIP(addr) {
+		return APIKey{}, fmt.Errorf("api key %s is not allowed from %s", id, addr)
+	}
+	return record.APIKey, nil
+}
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validate checks the request and returns the key it creates.
+func (req CreateAPIKeyRequest) validate(now time.Time) (APIKey, error) {
+	if len(req.Scopes) == 0 {
+		return APIKey{}, fmt.Errorf("an api key needs at least one scope")
+	}
+	for _, scope := range req.Scopes {
+		if !scope.isValid() {
+			return APIKey{}, fmt.Errorf("invalid scope: %s, expected %s, %s or %s", scope, ScopeRead, ScopeTrade, ScopeCancel)
+		}
+	}
+	for _, allowed := range req.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowed); err != nil && net.ParseIP(allowed) == nil {
+			return APIKey{}, fmt.Errorf("invalid ip address or range: %s", allowed)
+		}
+	}
+	if req.ExpiresAt != 0 && req.ExpiresAt <= now.UnixNano() {
+		return APIKey{}, fmt.Errorf("expiry time must be in the future")
+	}
+
+	return APIKey{
+		UserID:     req.UserID,
+		Label:      req.Label,
+		Scopes:     slices.Compact(slices.Sorted(slices.Values(req.Scopes))),
+		AllowedIPs: req.AllowedIPs,
+		CreatedAt:  now.UnixNano(),
+		ExpiresAt:  req.ExpiresAt,
+	}, nil
+}
+
+// authenticate lets requests through that are signed by a user, see
+// RequestHash, or that carry an API key with the scope. The user is stored in
+// the context for the handlers to check ownership. An empty scope only accepts
+// signed requests. Suspended users are limited to the READ and CANCEL scopes.
+func (ex *Exchange) authenticate(scope Scope) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		next = ex.checkUserStatus(scope, next)
+		signed := ex.signed(next)
+
+		return func(c echo.Context) error {
+			id := c.Request().Header.Get(HeaderAPIKey)
+			if id == "" {
+				return signed(c)
+			}
+			if scope == "" {
+				return c.JSON(http.StatusUnauthorized, APIError{Code: ErrCodeUnauthorized, Error: "api keys cannot be used for this request"})
+			}
+
+			key, err := ex.apiKeys.verify(id, c.Request().Header.Get(HeaderAPISecret), c.RealIP(), time.Now())
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"apiKey": id,
+					"ip":     c.RealIP(),
+					"path":   c.Request().URL.Path,
+					"err":    err,
+				}).Warn("request authentication failed")
+
+				return c.JSON(http.StatusUnauthorized, APIError{Code: ErrCodeUnauthorized, Error: err.Error()})
+			}
+			if !key.allows(scope) {
+				return forbidden(c, "api key %s does not have the %s scope", id, scope)
+			}
+
+			c.Set(authUserKey, key.UserID)
+			return next(c)
+		}
+	}
+}
+
+// checkUserStatus lets the requests of the authenticated user through that its
+// status allows.
+func (ex *Exchange) checkUserStatus(scope Scope, next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		status, _ := ex.userStatus(authUser(c))
+		switch {
+		case status == UserClosed:
+			return forbidden(c, "account of user %s is closed", authUser(c))
+		case status == UserSuspended && scope != ScopeRead && scope != ScopeCancel:
+			return forbidden(c, "account of user %s is suspended", authUser(c))
+		}
+		return next(c)
+	}
+}
+
+// createAPIKey creates the key of the request for its user.
+func (ex *Exchange) createAPIKey(c echo.Context, req CreateAPIKeyRequest) error {
+	status, ok := ex.userStatus(req.UserID)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("user not found: %s", req.UserID)})
+	}
+	if status == UserClosed {
+		return c.JSON(http.StatusConflict, APIError{Error: fmt.Sprintf("account of user %s is closed", req.UserID)})
+	}
+
+	key, err := req.validate(time.Now())
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	res, err := ex.apiKeys.create(key)
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"apiKey": res.ID,
+		"userID": res.UserID,
+		"scopes": res.Scopes,
+	}).Info("api key created")
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// revokeAPIKey revokes the key of the request, of any user when userID is
+// empty.
+func (ex *Exchange) revokeAPIKey(c echo.Context, userID string) error {
+	id := c.Param("id")
+	if key, ok := ex.apiKeys.get(id); !ok || (userID != "" && key.UserID != userID) {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("api key not found: %s", id)})
+	}
+
+	key, err := ex.apiKeys.revoke(id, time.Now())
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"apiKey": key.ID,
+		"userID": key.UserID,
+	}).Info("api key revoked")
+
+	return c.JSON(http.StatusOK, key)
+}
+
+// handleCreateAPIKey creates a key for the user that signed the request.
+func (ex *Exchange) handleCreateAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if req.UserID != "" && req.UserID != authUser(c) {
+		return forbidden(c, "cannot create api keys for user %s", req.UserID)
+	}
+	req.UserID = authUser(c)
+
+	return ex.createAPIKey(c, req)
+}
+
+func (ex *Exchange) handleGetAPIKeys(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.apiKeys.list(authUser(c)))
+}
+
+func (ex *Exchange) handleRevokeAPIKey(c echo.Context) error {
+	return ex.revokeAPIKey(c, authUser(c))
+}
+
+// handleAdminCreateAPIKey creates a key for the user of the request.
+func (ex *Exchange) handleAdminCreateAPIKey(c echo.Context) error {
+	var req CreateAPIKeyRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return ex.createAPIKey(c, req)
+}
+
+// handleAdminGetAPIKeys returns the keys of the user in the query parameter
+// userID, of every user without it.
+func (ex *Exchange) handleAdminGetAPIKeys(c echo.Context) error {
+	return c.JSON(http.StatusOK, ex.apiKeys.list(c.QueryParam("userID")))
+}
+
+func (ex *Exchange) handleAdminRevokeAPIKey(c echo.Context) error {
+	return ex.revokeAPIKey(c, "")
+}
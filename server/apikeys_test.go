@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "apikeys.json")
+	store, err := openAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex := &Exchange{apiKeys: store, nonces: newNonceCache()}
+	now := time.Now()
+
+	// the keys are created a second apart, so they list in that order.
+	created := now
+	create := func(req CreateAPIKeyRequest) *CreateAPIKeyResponse {
+		key, err := req.validate(created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		created = created.Add(time.Second)
+		res, err := store.create(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	user := "CSD000000000001-0001"
+	readOnly := create(CreateAPIKeyRequest{UserID: user, Scopes: []Scope{ScopeRead}})
+	trader := create(CreateAPIKeyRequest{UserID: user, Scopes: []Scope{ScopeTrade}, AllowedIPs: []string{"10.0.0.0/8"}})
+	expiring := create(CreateAPIKeyRequest{UserID: user, Scopes: []Scope{ScopeCancel}, ExpiresAt: now.Add(time.Hour).UnixNano()})
+
+	e := echo.New()
+	e.IPExtractor = echo.ExtractIPDirect()
+	ok := func(c echo.Context) error { return c.String(http.StatusOK, authUser(c)) }
+	e.GET("/orders", ok, ex.authenticate(ScopeRead))
+	e.POST("/order", ok, ex.authenticate(ScopeTrade))
+	e.DELETE("/order", ok, ex.authenticate(ScopeCancel))
+	e.POST("/apikeys", ok, ex.authenticate(""))
+
+	request := func(method, path string, key *CreateAPIKeyResponse, secret, ip string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.RemoteAddr = ip + ":4242"
+		req.Header.Set(HeaderAPIKey, key.ID)
+		req.Header.Set(HeaderAPISecret, secret)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code == http.StatusOK && rec.Body.String() != user {
+			t.Errorf("%s %s: authenticated as %q", method, path, rec.Body.String())
+		}
+		return rec.Code
+	}
+
+	steps := []struct {
+		name     string
+		method   string
+		path     string
+		key      *CreateAPIKeyResponse
+		secret   string
+		ip       string
+		expected int
+	}{
+		{"read", http.MethodGet, "/orders", readOnly, readOnly.Secret, "192.0.2.1", http.StatusOK},
+		{"trade with read key", http.MethodPost, "/order", readOnly, readOnly.Secret, "192.0.2.1", http.StatusForbidden},
+		{"wrong secret", http.MethodGet, "/orders", readOnly, trader.Secret, "192.0.2.1", http.StatusUnauthorized},
+		{"trade", http.MethodPost, "/order", trader, trader.Secret, "10.1.2.3", http.StatusOK},
+		{"trade key cancels", http.MethodDelete, "/order", trader, trader.Secret, "10.1.2.3", http.StatusOK},
+		{"trade from outside the allowlist", http.MethodPost, "/order", trader, trader.Secret, "192.0.2.1", http.StatusUnauthorized},
+		{"cancel", http.MethodDelete, "/order", expiring, expiring.Secret, "192.0.2.1", http.StatusOK},
+		{"read with cancel key", http.MethodGet, "/orders", expiring, expiring.Secret, "192.0.2.1", http.StatusForbidden},
+		{"key management", http.MethodPost, "/apikeys", trader, trader.Secret, "10.1.2.3", http.StatusUnauthorized},
+	}
+	for _, s := range steps {
+		if code := request(s.method, s.path, s.key, s.secret, s.ip); code != s.expected {
+			t.Errorf("%s: got status %d, expected %d", s.name, code, s.expected)
+		}
+	}
+
+	if _, err := store.verify(expiring.ID, expiring.Secret, "192.0.2.1", now.Add(2*time.Hour)); err == nil {
+		t.Errorf("expired key accepted")
+	}
+
+	if _, err := store.revoke(readOnly.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if code := request(http.MethodGet, "/orders", readOnly, readOnly.Secret, "192.0.2.1"); code != http.StatusUnauthorized {
+		t.Errorf("revoked key: got status %d", code)
+	}
+
+	// the keys survive a restart, the secrets are only stored hashed.
+	reopened, err := openAPIKeyStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := reopened.list(user); len(keys) != 3 || keys[0].ID != readOnly.ID || keys[0].RevokedAt == 0 {
+		t.Errorf("unexpected keys after reopening %+v", keys)
+	}
+	if _, err := reopened.verify(trader.ID, trader.Secret, "10.1.2.3", now); err != nil {
+		t.Errorf("key not accepted after reopening: %v", err)
+	}
+	if record := reopened.keys[trader.ID]; record.SecretHash == trader.Secret {
+		t.Errorf("secret stored in plain text")
+	}
+
+	for _, req := range []CreateAPIKeyRequest{
+		{UserID: user},
+		{UserID: user, Scopes: []Scope{"ADMIN"}},
+		{UserID: user, Scopes: []Scope{ScopeRead}, AllowedIPs: []string{"10.0.0.0/33"}},
+		{UserID: user, Scopes: []Scope{ScopeRead}, ExpiresAt: now.Add(-time.Hour).UnixNano()},
+	} {
+		if _, err := req.validate(now); err == nil {
+			t.Errorf("invalid request accepted %+v", req)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// The headers of a signed request. X-Signature is the hex encoded signature
+// of RequestHash by the key of the user, X-Timestamp is unix nano.
+const (
+	HeaderUserID    = "X-User-ID"
+	HeaderTimestamp = "X-Timestamp"
+	HeaderNonce     = "X-Nonce"
+	HeaderSignature = "X-Signature"
+)
+
+const (
+	// ErrCodeUnauthorized is the APIError code of a request without a
+	// valid signature.
+	ErrCodeUnauthorized = "UNAUTHORIZED"
+	// ErrCodeForbidden is the APIError code of a request on the orders or
+	// settings of another user.
+	ErrCodeForbidden = "FORBIDDEN"
+
+	// maxNonceLength is the longest nonce accepted.
+	maxNonceLength = 64
+	// authUserKey is the key of the authenticated user in the echo context.
+	authUserKey = "userID"
+)
+
+// nonceCache remembers the nonces of the signed requests of every user while
+// their timestamp is within the authWindow, a request reusing one is a replay.
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]int64
+	lastPrune time.Time
+}
+
+// RequestHash returns the hash a user signs for a request: the method, the
+// path with the query, the timestamp, the nonce and the hash of the body.
+func RequestHash(method, uri string, timestamp int64, nonce string, body []byte) []byte {
+	payload := fmt.Sprintf("stock-exchange request:%s:%s:%d:%s:%x", method, uri, timestamp, nonce, crypto.Keccak256(body))
+	return crypto.Keccak256([]byte(payload))
+}
+
+func newNonceCache() *nonceCache {
+	return &nonceCache{seen: make(map[string]int64)}
+}
+
+// use records the nonce of the user and reports whether it was unused. The
+// nonces that can no longer be replayed are dropped at most once a second.
+func (n *nonceCache) use(userID, nonce string, timestamp int64, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.lastPrune) >= time.Second {
+		cutoff := now.Add(-authWindow).UnixNano()
+		for key, ts := range n.seen {
+			if ts < cutoff {
+				delete(n.seen, key)
+			}
+		}
+		n.lastPrune = now
+	}
+
+	key := userID + "\x00" + nonce
+	if _, ok := n.seen[key]; ok {
+		return false
+	}
+	n.seen[key] = timestamp
+	return true
+}
+
+// verifySignature checks that the hex encoded signature of the hash is by the
+// key of the user.
+func (ex *Exchange) verifySignature(userID string, hash []byte, signature string) error {
+	// the status can change while we verify, it is copied with the key of
+	// the user under the lock.
+	ex.mu.RLock()
+	user, ok := ex.Users[userID]
+	var status UserStatus
+	var expected common.Address
+	if ok {
+		status = user.Status
+		expected = crypto.PubkeyToAddress(user.PrivateKey.PublicKey)
+	}
+	ex.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("user not found: %s", userID)
+	}
+	if status == UserClosed {
+		return fmt.Errorf("account of user %s is closed", userID)
+	}
+
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding")
+	}
+	pub, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+	signer := crypto.PubkeyToAddress(*pub)
+	if !bytes.Equal(signer.Bytes(), expected.Bytes()) {
+		return fmt.Errorf("signature does not match user %s", userID)
+	}
+
+	return nil
+}
+
+// verifyRequest checks the signature headers of the request against its body
+// and returns the user that signed it.
+func (ex *Exchange) verifyRequest(r *http.Request, body []byte, now time.Time) (string, error) {
+	userID := r.Header.Get(HeaderUserID)
+	nonce := r.Header.Get(HeaderNonce)
+	if userID == "" || nonce == "" || r.Header.Get(HeaderSignature) == "" {
+		return "", fmt.Errorf("missing %s, %s or %s header", HeaderUserID, HeaderNonce, HeaderSignature)
+	}
+	if len(nonce) > maxNonceLength {
+		return "", fmt.Errorf("nonce is longer than %d characters", maxNonceLength)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid timestamp: %s", r.Header.Get(HeaderTimestamp))
+	}
+	if d := now.Sub(time.Unix(0, timestamp)); d > authWindow || d < -authWindow {
+		return "", fmt.Errorf("timestamp is more than %s off", authWindow)
+	}
+
+	hash := RequestHash(r.Method, r.URL.RequestURI(), timestamp, nonce, body)
+	if err := ex.verifySignature(userID, hash, r.Header.Get(HeaderSignature)); err != nil {
+		return "", err
+	}
+
+	// only a valid signature uses up the nonce, otherwise anyone could
+	// burn the nonces of a user.
+	if !ex.nonces.use(userID, nonce, timestamp, now) {
+		return "", fmt.Errorf("nonce already used: %s", nonce)
+	}
+
+	return userID, nil
+}
+
+// signed lets requests through that are signed by a user, see RequestHash.
+// The user is stored in the context for the handlers to check ownership.
+func (ex *Exchange) signed(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		userID, err := ex.verifyRequest(c.Request(), body, time.Now())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"userID": c.Request().Header.Get(HeaderUserID),
+				"path":   c.Request().URL.Path,
+				"err":    err,
+			}).Warn("request authentication failed")
+
+			return c.JSON(http.StatusUnauthorized, APIError{Code: ErrCodeUnauthorized, Error: err.Error()})
+		}
+
+		c.Set(authUserKey, userID)
+		return next(c)
+	}
+}
+
+// authUser returns the user that signed the request.
+func authUser(c echo.Context) string {
+	userID, _ := c.Get(authUserKey).(string)
+	return userID
+}
+
+// forbidden is the response to a request on something of another user.
+func forbidden(c echo.Context, format string, args ...any) error {
+	return c.JSON(http.StatusForbidden, APIError{Code: ErrCodeForbidden, Error: fmt.Sprintf(format, args...)})
+}
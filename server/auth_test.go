@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+)
+
+func TestSignedRequests(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ex := &Exchange{
+		Users: map[string]*User{
+			"CSD000000000001-0001": {ID: "CSD000000000001-0001", PrivateKey: key},
+			"CSD000000000002-0001": {ID: "CSD000000000002-0001", PrivateKey: other},
+		},
+		nonces: newNonceCache(),
+	}
+
+	e := echo.New()
+	e.PUT("/user/:userID/stp", func(c echo.Context) error {
+		if c.Param("userID") != authUser(c) {
+			return forbidden(c, "cannot change the settings of user %s", c.Param("userID"))
+		}
+		return c.NoContent(http.StatusOK)
+	}, ex.signed)
+
+	request := func(userID string, key *ecdsa.PrivateKey, path, nonce string, timestamp time.Time, body, sent string) int {
+		hash := RequestHash(http.MethodPut, path, timestamp.UnixNano(), nonce, []byte(body))
+		sig, err := crypto.Sign(hash, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPut, path, bytes.NewReader([]byte(sent)))
+		req.Header.Set(HeaderUserID, userID)
+		req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp.UnixNano(), 10))
+		req.Header.Set(HeaderNonce, nonce)
+		req.Header.Set(HeaderSignature, hex.EncodeToString(sig))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	user := "CSD000000000001-0001"
+	path := "/user/" + user + "/stp"
+	body := `{"SelfTradePrevention":"CANCEL_NEWEST"}`
+	now := time.Now()
+
+	steps := []struct {
+		name     string
+		userID   string
+		key      *ecdsa.PrivateKey
+		path     string
+		nonce    string
+		ts       time.Time
+		sent     string
+		expected int
+	}{
+		{"valid", user, key, path, "1", now, body, http.StatusOK},
+		{"replay", user, key, path, "1", now, body, http.StatusUnauthorized},
+		{"stale", user, key, path, "2", now.Add(-time.Minute), body, http.StatusUnauthorized},
+		{"key of another user", user, other, path, "3", now, body, http.StatusUnauthorized},
+		{"body changed", user, key, path, "4", now, `{"SelfTradePrevention":"NONE"}`, http.StatusUnauthorized},
+		{"unknown user", "CSD000000000009-0001", key, path, "5", now, body, http.StatusUnauthorized},
+		{"settings of another user", "CSD000000000002-0001", other, path, "6", now, body, http.StatusForbidden},
+		// the nonces of different users do not collide.
+		{"nonce of another user", "CSD000000000002-0001", other, "/user/CSD000000000002-0001/stp", "1", now, body, http.StatusOK},
+	}
+	for _, s := range steps {
+		if code := request(s.userID, s.key, s.path, s.nonce, s.ts, body, s.sent); code != s.expected {
+			t.Errorf("%s: got status %d, expected %d", s.name, code, s.expected)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPut, path, bytes.NewReader([]byte(body)))
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned request: got status %d", rec.Code)
+	}
+}
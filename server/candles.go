@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	Interval1s Interval = "1s"
+	Interval1m Interval = "1m"
+	Interval5m Interval = "5m"
+	Interval1h Interval = "1h"
+	Interval1d Interval = "1d"
+)
+
+const (
+	// candleRetention is the number of candles kept of every interval, the
+	// oldest are dropped.
+	candleRetention = 10000
+	// snapshotCandlesCount is the number of recent candles in the snapshot of
+	// a candles channel.
+	snapshotCandlesCount = 50
+)
+
+// Intervals are the candle intervals of every market.
+var Intervals = []Interval{Interval1s, Interval1m, Interval5m, Interval1h, Interval1d}
+
+var intervalDurations = map[Interval]time.Duration{
+	Interval1s: time.Second,
+	Interval1m: time.Minute,
+	Interval5m: 5 * time.Minute,
+	Interval1h: time.Hour,
+	Interval1d: 24 * time.Hour,
+}
+
+type (
+	Interval string
+
+	// Candle holds the OHLCV of the trades of an interval starting at Start
+	// (unix nano, aligned to the interval in UTC). Intervals without trades
+	// have no candle.
+	Candle struct {
+		Interval Interval
+		Start    int64
+		Open     orderbook.Decimal
+		High     orderbook.Decimal
+		Low      orderbook.Decimal
+		Close    orderbook.Decimal
+		Volume   orderbook.Decimal
+		Trades   int
+	}
+
+	// candles aggregates the trades of a market into candles of every
+	// interval, from the oldest to the newest.
+	candles struct {
+		mu   sync.RWMutex
+		bars map[Interval][]Candle
+	}
+)
+
+// CandleChannel is the market data channel of the candles of the interval, like
+// CANDLES_1m. Its updates hold the candle in progress and the candles closed
+// since the last update.
+func CandleChannel(interval Interval) Channel {
+	return Channel("CANDLES_" + string(interval))
+}
+
+func (i Interval) isValid() bool {
+	_, ok := intervalDurations[i]
+	return ok
+}
+
+// start returns the start of the interval the timestamp falls into.
+func (i Interval) start(timestamp int64) int64 {
+	d := intervalDurations[i].Nanoseconds()
+	start := timestamp - timestamp%d
+	if timestamp%d < 0 {
+		start -= d
+	}
+	return start
+}
+
+func newCandles() *candles {
+	return &candles{bars: make(map[Interval][]Candle)}
+}
+
+// add adds the trades to the candles and returns the candles of every interval
+// that changed. A trade timestamped before the last candle, which the clock
+// can cause, is added to the last candle.
+func (cs *candles) add(trades []*orderbook.Trade) map[Interval][]Candle {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	changed := make(map[Interval][]Candle)
+	for _, interval := range Intervals {
+		bars := cs.bars[interval]
+		first := len(bars)
+		for _, trade := range trades {
+			n := len(bars)
+			start := interval.start(trade.Timestamp)
+			if n > 0 && start <= bars[n-1].Start {
+				bar := &bars[n-1]
+				if trade.Price.Cmp(bar.High) > 0 {
+					bar.High = trade.Price
+				}
+				if trade.Price.Cmp(bar.Low) < 0 {
+					bar.Low = trade.Price
+				}
+				bar.Close = trade.Price
+				bar.Volume = bar.Volume.Add(trade.Size)
+				bar.Trades++
+				first = min(first, n-1)
+				continue
+			}
+			bars = append(bars, Candle{
+				Interval: interval,
+				Start:    start,
+				Open:     trade.Price,
+				High:     trade.Price,
+				Low:      trade.Price,
+				Close:    trade.Price,
+				Volume:   trade.Size,
+				Trades:   1,
+			})
+		}
+		if first < len(bars) {
+			changed[interval] = append([]Candle{}, bars[first:]...)
+		}
+		if len(bars) > candleRetention {
+			bars = append([]Candle{}, bars[len(bars)-candleRetention:]...)
+		}
+		cs.bars[interval] = bars
+	}
+
+	return changed
+}
+
+// get returns the candles of the interval that start from from up to, not
+// including, to (unix nano). Zero values do not filter.
+func (cs *candles) get(interval Interval, from, to int64) []Candle {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	bars := cs.bars[interval]
+	start := sort.Search(len(bars), func(i int) bool { return bars[i].Start >= from })
+	end := len(bars)
+	if to > 0 {
+		end = sort.Search(len(bars), func(i int) bool { return bars[i].Start >= to })
+	}
+	if start >= end {
+		return []Candle{}
+	}
+	return append([]Candle{}, bars[start:end]...)
+}
+
+// recent returns the last n candles of the interval.
+func (cs *candles) recent(interval Interval, n int) []Candle {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	bars := cs.bars[interval]
+	return append([]Candle{}, bars[max(0, len(bars)-n):]...)
+}
+
+// handleGetCandles returns the candles of a market. The query parameter
+// interval selects the interval, 1m by default, from and to (unix nano) the
+// time range of the start of the candles.
+func (ex *Exchange) handleGetCandles(c echo.Context) error {
+	market := Market(c.Param("market"))
+	feed, ok := ex.feeds[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	interval := Interval1m
+	if v := c.QueryParam("interval"); v != "" {
+		interval = Interval(v)
+		if !interval.isValid() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid interval: %s, expected one of %v", v, Intervals)})
+		}
+	}
+
+	var from, to int64
+	if v := c.QueryParam("from"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid from: %s", v)})
+		}
+		from = n
+	}
+	if v := c.QueryParam("to"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid to: %s", v)})
+		}
+		to = n
+	}
+
+	return c.JSON(http.StatusOK, feed.candles.get(interval, from, to))
+}
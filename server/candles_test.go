@@ -0,0 +1,82 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+)
+
+func TestCandles(t *testing.T) {
+	start := time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC).UnixNano()
+	trade := func(offset time.Duration, price, size int64) *orderbook.Trade {
+		return &orderbook.Trade{
+			Timestamp: start + offset.Nanoseconds(),
+			Price:     orderbook.NewDecimal(price),
+			Size:      orderbook.NewDecimal(size),
+		}
+	}
+
+	cs := newCandles()
+	changed := cs.add([]*orderbook.Trade{
+		trade(10*time.Second, 100, 5),
+		trade(20*time.Second, 104, 1),
+		trade(30*time.Second, 98, 2),
+		trade(70*time.Second, 101, 3),
+	})
+	if len(changed[Interval1m]) != 2 || len(changed[Interval1h]) != 1 || len(changed[Interval1s]) != 4 {
+		t.Fatalf("unexpected changed candles %+v", changed)
+	}
+
+	first := Candle{
+		Interval: Interval1m,
+		Start:    start,
+		Open:     orderbook.NewDecimal(100),
+		High:     orderbook.NewDecimal(104),
+		Low:      orderbook.NewDecimal(98),
+		Close:    orderbook.NewDecimal(98),
+		Volume:   orderbook.NewDecimal(8),
+		Trades:   3,
+	}
+	if got := cs.get(Interval1m, 0, 0); len(got) != 2 || got[0] != first || got[1].Start != start+time.Minute.Nanoseconds() {
+		t.Errorf("unexpected 1m candles %+v", got)
+	}
+
+	// only the candle in progress changes.
+	changed = cs.add([]*orderbook.Trade{trade(90*time.Second, 110, 1)})
+	if bars := changed[Interval1m]; len(bars) != 1 || bars[0].High != orderbook.NewDecimal(110) || bars[0].Open != orderbook.NewDecimal(101) {
+		t.Errorf("unexpected changed 1m candles %+v", bars)
+	}
+	if bars := changed[Interval1d]; len(bars) != 1 || bars[0].Trades != 5 || bars[0].Volume != orderbook.NewDecimal(12) {
+		t.Errorf("unexpected changed 1d candles %+v", bars)
+	}
+
+	from := start + time.Minute.Nanoseconds()
+	if got := cs.get(Interval1m, from, 0); len(got) != 1 || got[0].Start != from {
+		t.Errorf("unexpected candles from %d: %+v", from, got)
+	}
+	if got := cs.get(Interval1m, 0, from); len(got) != 1 || got[0] != first {
+		t.Errorf("unexpected candles to %d: %+v", from, got)
+	}
+}
+
+func TestMarketFeedCandles(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	feed := newMarketFeed(MarketINN, ob)
+	ch := CandleChannel(Interval1m)
+
+	c := newWSConn(nil)
+	feed.subscribe(c, ch)
+	if snapshot := nextMessage(t, c); snapshot.Type != MessageSnapshot || snapshot.Channel != ch || len(snapshot.Candles) != 0 {
+		t.Fatalf("unexpected candles snapshot %+v", snapshot)
+	}
+
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceMarketOrder(orderbook.NewOrder(true, orderbook.NewDecimal(4), "CSD000000000002-0001"))
+	feed.publish()
+
+	update := nextMessage(t, c)
+	if update.Type != MessageUpdate || update.Seq != 1 || len(update.Candles) != 1 || update.Candles[0].Volume != orderbook.NewDecimal(4) {
+		t.Errorf("unexpected candles update %+v", update)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// defaultDepthLevels and maxDepthLevels bound the number of levels of
+	// each side returned by GET /depth/:market.
+	defaultDepthLevels = 20
+	maxDepthLevels     = 1000
+
+	// adminTokenHeader carries the token of the admin endpoints.
+	adminTokenHeader = "X-Admin-Token"
+)
+
+// DepthResponse is the aggregated depth of a market, both sides from the best
+// price to the worst.
+type DepthResponse struct {
+	Market Market
+	Group  orderbook.Decimal `json:",omitzero"`
+	Bids   []orderbook.Level
+	Asks   []orderbook.Level
+}
+
+// handleGetDepth returns the price levels of the book with their visible
+// volume and order count. The query parameter levels limits the levels of
+// each side, group merges the levels into buckets of that size, which has to
+// be a multiple of the tick size.
+func (ex *Exchange) handleGetDepth(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	levels := defaultDepthLevels
+	if v := c.QueryParam("levels"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxDepthLevels {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("levels must be between 1 and %d", maxDepthLevels)})
+		}
+		levels = n
+	}
+
+	group := orderbook.Decimal{}
+	if v := c.QueryParam("group"); v != "" {
+		g, err := orderbook.ParseDecimal(v)
+		if err != nil || !g.IsPositive() {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid group: %s", v)})
+		}
+		if tick := ex.instruments[market].TickSize; !g.IsMultipleOf(tick) {
+			return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("group %s is not a multiple of the tick size %s", g, tick)})
+		}
+		group = g
+	}
+
+	res := DepthResponse{Market: market, Group: group}
+	if group.IsZero() {
+		res.Bids, res.Asks = ob.Depth(levels)
+	} else {
+		// buckets can only be cut to size once every level is in them.
+		bids, asks := ob.Depth(0)
+		res.Bids = orderbook.GroupLevels(bids, group, true)
+		res.Asks = orderbook.GroupLevels(asks, group, false)
+		res.Bids = res.Bids[:min(levels, len(res.Bids))]
+		res.Asks = res.Asks[:min(levels, len(res.Asks))]
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+// adminOnly lets requests through that carry the admin token in the
+// X-Admin-Token header. Without an ADMIN_TOKEN the admin endpoints are
+// disabled.
+func adminOnly(token string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if token == "" {
+				return c.JSON(http.StatusForbidden, APIError{Error: "admin endpoints are disabled"})
+			}
+			given := c.Request().Header.Get(adminTokenHeader)
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				return c.JSON(http.StatusUnauthorized, APIError{Error: "invalid admin token"})
+			}
+			return next(c)
+		}
+	}
+}
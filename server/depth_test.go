@@ -0,0 +1,118 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+func TestGetDepth(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	for _, price := range []string{"10.01", "10.04", "10.15", "10.25"} {
+		ob.PlaceLimitOrder(orderbook.MustParseDecimal(price), orderbook.NewOrder(false, orderbook.NewDecimal(5), "CSD000000000001-0001"))
+	}
+	ex := &Exchange{
+		orderbooks:  map[Market]*orderbook.Orderbook{MarketINN: ob},
+		instruments: map[Market]*Instrument{MarketINN: {Market: MarketINN, TickSize: orderbook.MustParseDecimal("0.01")}},
+	}
+
+	e := echo.New()
+	e.GET("/depth/:market", ex.handleGetDepth)
+	get := func(query string) (int, DepthResponse) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/depth/INN?"+query, nil))
+		res := DepthResponse{}
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, res
+	}
+
+	code, res := get("levels=2")
+	if code != http.StatusOK || len(res.Asks) != 2 || res.Asks[1].Price != orderbook.MustParseDecimal("10.04") {
+		t.Errorf("unexpected depth %d %+v", code, res)
+	}
+
+	code, res = get("levels=2&group=0.10")
+	expected := []orderbook.Level{
+		{Price: orderbook.MustParseDecimal("10.10"), Volume: orderbook.NewDecimal(10), Orders: 2},
+		{Price: orderbook.MustParseDecimal("10.20"), Volume: orderbook.NewDecimal(5), Orders: 1},
+	}
+	if code != http.StatusOK || len(res.Asks) != 2 || res.Asks[0] != expected[0] || res.Asks[1] != expected[1] {
+		t.Errorf("unexpected grouped depth %d %+v", code, res)
+	}
+
+	for _, query := range []string{"levels=0", "levels=1001", "group=0", "group=0.015", "group=abc"} {
+		if code, _ := get(query); code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d", query, code)
+		}
+	}
+}
+
+func TestAdminOnly(t *testing.T) {
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	status := func(token, header string) int {
+		req := httptest.NewRequest(http.MethodGet, "/admin/book/INN", nil)
+		if header != "" {
+			req.Header.Set(adminTokenHeader, header)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(token)(ok)(echo.New().NewContext(req, rec))
+		return rec.Code
+	}
+
+	if code := status("secret", "secret"); code != http.StatusOK {
+		t.Errorf("valid token: got status %d", code)
+	}
+	if code := status("secret", "wrong"); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got status %d", code)
+	}
+	if code := status("", ""); code != http.StatusForbidden {
+		t.Errorf("no admin token: got status %d", code)
+	}
+}
+
+func TestPublicMarketData(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(5), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(3), "CSD000000000001-0001"))
+	ob.PlaceMarketOrder(orderbook.NewOrder(true, orderbook.NewDecimal(2), "CSD000000000002-0001"))
+	ex := &Exchange{orderbooks: map[Market]*orderbook.Orderbook{MarketINN: ob}}
+
+	e := echo.New()
+	e.GET("/book/:market/bestAsk", ex.handleGetBestAsk)
+	e.GET("/trades/:market", ex.handleGetTrades)
+	get := func(path string, v any) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: got status %d", path, rec.Code)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	best := map[string]any{}
+	get("/book/INN/bestAsk", &best)
+	if len(best) != 2 || best["Price"] != float64(100) || best["Size"] != float64(6) {
+		t.Errorf("unexpected best ask %v", best)
+	}
+
+	trades := []map[string]any{}
+	get("/trades/INN", &trades)
+	if len(trades) != 1 {
+		t.Fatalf("got %d trades, expected 1", len(trades))
+	}
+	for _, field := range []string{"BuyerUserID", "SellerUserID", "MakerOrderID", "TakerOrderID"} {
+		if _, ok := trades[0][field]; ok {
+			t.Errorf("public trade has %s", field)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RejectOnBreach rejects an order that would execute outside of a
+	// price band. It is the default.
+	RejectOnBreach BandBreach = "REJECT"
+	// HaltOnBreach rejects the order and halts the market for the
+	// HaltSeconds of the instrument.
+	HaltOnBreach BandBreach = "HALT"
+)
+
+type (
+	// BandBreach is what happens to an order that would execute outside of
+	// the price bands of the market.
+	BandBreach string
+
+	// Halt is a period trading on a market was stopped, End is zero while a
+	// manual halt is still going.
+	Halt struct {
+		Market Market
+		Reason string
+		Start  int64 // unix nano
+		End    int64 // unix nano
+	}
+)
+
+// haltMarket halts trading on the market for the duration, a zero duration
+// halts it until it is resumed.
+func (ex *Exchange) haltMarket(market Market, reason string, duration time.Duration) {
+	now := time.Now()
+	halt := &Halt{
+		Market: market,
+		Reason: reason,
+		Start:  now.UnixNano(),
+	}
+
+	until := time.Time{}
+	if duration > 0 {
+		until = now.Add(duration)
+		halt.End = until.UnixNano()
+	}
+	ex.sessions[market].Halt(until)
+
+	ex.mu.Lock()
+	ex.halts[market] = append(ex.halts[market], halt)
+	ex.mu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"market":   market,
+		"reason":   reason,
+		"duration": duration,
+	}).Warn("market halted")
+}
+
+// resumeMarket lifts the halt of the market and ends the halts that were
+// still going.
+func (ex *Exchange) resumeMarket(market Market) {
+	ex.sessions[market].Resume()
+
+	now := time.Now().UnixNano()
+	ex.mu.Lock()
+	for _, halt := range ex.halts[market] {
+		if halt.End == 0 || halt.End > now {
+			halt.End = now
+		}
+	}
+	ex.mu.Unlock()
+
+	ex.updateSession(market, ex.sessions[market])
+
+	logrus.WithFields(logrus.Fields{
+		"market": market,
+	}).Info("market resumed")
+}
+
+// handleGetHalts returns the halts of a market, oldest first.
+func (ex *Exchange) handleGetHalts(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.sessions[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	ex.mu.RLock()
+	halts := make([]Halt, 0, len(ex.halts[market]))
+	for _, halt := range ex.halts[market] {
+		halts = append(halts, *halt)
+	}
+	ex.mu.RUnlock()
+
+	return c.JSON(http.StatusOK, halts)
+}
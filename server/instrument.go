@@ -0,0 +1,197 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+)
+
+// Instrument is the trading specification of a market. Every order placed on
+// the market is validated against it.
+type Instrument struct {
+	Market     Market
+	BaseAsset  string
+	QuoteAsset string
+	// TickSize is the smallest price increment, every price must be a
+	// multiple of it.
+	TickSize orderbook.Decimal
+	// LotSize is the smallest size increment, every size must be a
+	// multiple of it.
+	LotSize orderbook.Decimal
+	MinSize orderbook.Decimal
+	// MaxSize is the largest size of a single order, zero means no limit.
+	MaxSize orderbook.Decimal
+	// MinPrice and MaxPrice are the price band every limit and stop
+	// price has to be in. A zero MaxPrice means no upper bound.
+	MinPrice orderbook.Decimal
+	MaxPrice orderbook.Decimal
+	// StaticBand and DynamicBand are the price bands around the reference
+	// price and around the last trade price, as a fraction of the price.
+	// A zero band is not checked. ReferencePrice is the reference price
+	// until the first auction, zero means none.
+	ReferencePrice orderbook.Decimal
+	StaticBand     orderbook.Decimal
+	DynamicBand    orderbook.Decimal
+	// BandBreach decides what happens to an order that would execute
+	// outside of a band, HaltSeconds is the length of a volatility halt.
+	BandBreach  BandBreach
+	HaltSeconds int
+}
+
+// LoadInstruments reads the instruments from a JSON file holding an array of
+// instruments.
+func LoadInstruments(path string) ([]*Instrument, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	instruments := []*Instrument{}
+	if err := json.NewDecoder(f).Decode(&instruments); err != nil {
+		return nil, fmt.Errorf("decoding instruments file %s: %w", path, err)
+	}
+
+	seen := make(map[Market]bool)
+	for _, in := range instruments {
+		if err := in.validateSpec(); err != nil {
+			return nil, err
+		}
+		if seen[in.Market] {
+			return nil, fmt.Errorf("instrument %s is defined more than once", in.Market)
+		}
+		seen[in.Market] = true
+	}
+
+	return instruments, nil
+}
+
+// Scale returns the number of decimal places prices and sizes of the
+// instrument are quoted with.
+func (in *Instrument) Scale() orderbook.Scale {
+	return orderbook.Scale{
+		Price: in.TickSize.Places(),
+		Size:  in.LotSize.Places(),
+	}
+}
+
+func (in *Instrument) validateSpec() error {
+	if in.Market == "" {
+		return fmt.Errorf("instrument without market")
+	}
+	if !in.TickSize.IsPositive() {
+		return fmt.Errorf("instrument %s: tick size must be greater than 0", in.Market)
+	}
+	if !in.LotSize.IsPositive() {
+		return fmt.Errorf("instrument %s: lot size must be greater than 0", in.Market)
+	}
+	if in.MinSize.LessThan(in.LotSize) {
+		return fmt.Errorf("instrument %s: min size must be at least the lot size", in.Market)
+	}
+	if !in.MaxSize.IsZero() && in.MaxSize.LessThan(in.MinSize) {
+		return fmt.Errorf("instrument %s: max size must be at least the min size", in.Market)
+	}
+	if !in.MaxPrice.IsZero() && in.MaxPrice.LessThan(in.MinPrice) {
+		return fmt.Errorf("instrument %s: max price must be at least the min price", in.Market)
+	}
+	if in.StaticBand.IsNegative() || in.DynamicBand.IsNegative() || in.ReferencePrice.IsNegative() {
+		return fmt.Errorf("instrument %s: price bands and reference price cannot be negative", in.Market)
+	}
+	switch in.BandBreach {
+	case "", RejectOnBreach:
+	case HaltOnBreach:
+		if in.HaltSeconds <= 0 {
+			return fmt.Errorf("instrument %s: halt seconds must be greater than 0", in.Market)
+		}
+	default:
+		return fmt.Errorf("instrument %s: invalid band breach action: %s", in.Market, in.BandBreach)
+	}
+	return nil
+}
+
+// PriceBands returns the price bands of the orderbook of the instrument.
+func (in *Instrument) PriceBands() orderbook.PriceBands {
+	return orderbook.PriceBands{
+		Static:  in.StaticBand,
+		Dynamic: in.DynamicBand,
+	}
+}
+
+// ValidateOrder checks the size and prices of an order request against the
+// instrument.
+func (in *Instrument) ValidateOrder(p PlaceOrderRequest) error {
+	scale := in.Scale()
+	if err := scale.Check(p.Price, p.Size); err != nil {
+		return err
+	}
+	if err := scale.Check(p.StopPrice, p.DisplaySize); err != nil {
+		return err
+	}
+	if err := scale.Check(p.ProtectionPrice, orderbook.Decimal{}); err != nil {
+		return err
+	}
+
+	if err := in.validateSize("size", p.Size); err != nil {
+		return err
+	}
+	if p.Size.LessThan(in.MinSize) {
+		return fmt.Errorf("size %s is below the minimum order size %s", p.Size, in.MinSize)
+	}
+	if !in.MaxSize.IsZero() && p.Size.GreaterThan(in.MaxSize) {
+		return fmt.Errorf("size %s is above the maximum order size %s", p.Size, in.MaxSize)
+	}
+
+	if !p.DisplaySize.IsZero() {
+		if err := in.validateSize("display size", p.DisplaySize); err != nil {
+			return err
+		}
+	}
+
+	if p.Type == LimitOrder || p.Type == StopLimitOrder {
+		if err := in.validatePrice("price", p.Price); err != nil {
+			return err
+		}
+	}
+
+	if (p.Type == MarketOrder || p.Type == StopOrder) && p.LiquidityPolicy == orderbook.ProtectionLimit {
+		if err := in.validatePrice("protection price", p.ProtectionPrice); err != nil {
+			return err
+		}
+	}
+
+	if p.Type == StopOrder || p.Type == StopLimitOrder {
+		if err := in.validatePrice("stop price", p.StopPrice); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (in *Instrument) validateSize(name string, size orderbook.Decimal) error {
+	if !size.IsPositive() {
+		return fmt.Errorf("%s must be greater than 0", name)
+	}
+	if !size.IsMultipleOf(in.LotSize) {
+		return fmt.Errorf("%s %s is not a multiple of the lot size %s", name, size, in.LotSize)
+	}
+	return nil
+}
+
+func (in *Instrument) validatePrice(name string, price orderbook.Decimal) error {
+	if !price.IsPositive() {
+		return fmt.Errorf("%s must be greater than 0", name)
+	}
+	if !price.IsMultipleOf(in.TickSize) {
+		return fmt.Errorf("%s %s is not a multiple of the tick size %s", name, price, in.TickSize)
+	}
+	if price.LessThan(in.MinPrice) {
+		return fmt.Errorf("%s %s is below the price band minimum %s", name, price, in.MinPrice)
+	}
+	if !in.MaxPrice.IsZero() && price.GreaterThan(in.MaxPrice) {
+		return fmt.Errorf("%s %s is above the price band maximum %s", name, price, in.MaxPrice)
+	}
+	return nil
+}
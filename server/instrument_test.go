@@ -0,0 +1,95 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+)
+
+func writeInstruments(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "instruments.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadInstruments(t *testing.T) {
+	path := writeInstruments(t, `[
+		{"Market": "INN", "TickSize": 0.01, "LotSize": 1, "MinSize": 1, "MaxSize": 1000, "MinPrice": 0.01, "MaxPrice": 10000},
+		{"Market": "ABC", "TickSize": 0.5, "LotSize": 0.1, "MinSize": 0.1}
+	]`)
+	instruments, err := LoadInstruments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instruments) != 2 || instruments[0].Market != "INN" || instruments[1].TickSize != orderbook.MustParseDecimal("0.5") {
+		t.Fatalf("unexpected instruments %+v", instruments)
+	}
+	if scale := instruments[1].Scale(); scale.Price != 1 || scale.Size != 1 {
+		t.Errorf("unexpected scale %+v", scale)
+	}
+
+	invalid := map[string]string{
+		"duplicate market":  `[{"Market": "INN", "TickSize": 1, "LotSize": 1, "MinSize": 1}, {"Market": "INN", "TickSize": 1, "LotSize": 1, "MinSize": 1}]`,
+		"no tick size":      `[{"Market": "INN", "LotSize": 1, "MinSize": 1}]`,
+		"min below lot":     `[{"Market": "INN", "TickSize": 1, "LotSize": 10, "MinSize": 1}]`,
+		"max below min":     `[{"Market": "INN", "TickSize": 1, "LotSize": 1, "MinSize": 10, "MaxSize": 5}]`,
+		"halt without time": `[{"Market": "INN", "TickSize": 1, "LotSize": 1, "MinSize": 1, "BandBreach": "HALT"}]`,
+		"not json":          `{`,
+	}
+	for name, content := range invalid {
+		if _, err := LoadInstruments(writeInstruments(t, content)); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := LoadInstruments(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("missing file: no error")
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	in := &Instrument{
+		Market:   MarketINN,
+		TickSize: orderbook.MustParseDecimal("0.05"),
+		LotSize:  orderbook.NewDecimal(10),
+		MinSize:  orderbook.NewDecimal(10),
+		MaxSize:  orderbook.NewDecimal(1000),
+		MinPrice: orderbook.NewDecimal(1),
+		MaxPrice: orderbook.NewDecimal(500),
+	}
+	d := orderbook.MustParseDecimal
+
+	steps := []struct {
+		name  string
+		order PlaceOrderRequest
+		err   string
+	}{
+		{"limit", PlaceOrderRequest{Type: LimitOrder, Size: d("20"), Price: d("10.05")}, ""},
+		{"market", PlaceOrderRequest{Type: MarketOrder, Size: d("1000")}, ""},
+		{"size off the lot", PlaceOrderRequest{Type: LimitOrder, Size: d("25"), Price: d("10")}, "lot size"},
+		{"size below min", PlaceOrderRequest{Type: MarketOrder, Size: d("0")}, "greater than 0"},
+		{"size above max", PlaceOrderRequest{Type: MarketOrder, Size: d("1010")}, "maximum order size"},
+		{"price off the tick", PlaceOrderRequest{Type: LimitOrder, Size: d("10"), Price: d("10.02")}, "tick size"},
+		{"price too precise", PlaceOrderRequest{Type: LimitOrder, Size: d("10"), Price: d("10.051")}, "decimal places"},
+		{"price below band", PlaceOrderRequest{Type: LimitOrder, Size: d("10"), Price: d("0.5")}, "minimum"},
+		{"price above band", PlaceOrderRequest{Type: LimitOrder, Size: d("10"), Price: d("600")}, "maximum"},
+		{"stop price off the tick", PlaceOrderRequest{Type: StopOrder, Size: d("10"), StopPrice: d("10.01")}, "stop price"},
+		{"display size off the lot", PlaceOrderRequest{Type: LimitOrder, Size: d("100"), Price: d("10"), DisplaySize: d("15")}, "display size"},
+		{"protection price", PlaceOrderRequest{Type: MarketOrder, Size: d("10"), LiquidityPolicy: orderbook.ProtectionLimit, ProtectionPrice: d("10.03")}, "protection price"},
+	}
+	for _, s := range steps {
+		err := in.ValidateOrder(s.order)
+		if s.err == "" && err != nil {
+			t.Errorf("%s: %v", s.name, err)
+		}
+		if s.err != "" && (err == nil || !strings.Contains(err.Error(), s.err)) {
+			t.Errorf("%s: got %v, expected an error about %s", s.name, err, s.err)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/sirupsen/logrus"
+)
+
+// idBlock is the number of IDs the exchange reserves at a time.
+const idBlock = 1000
+
+// openJournals numbers the orders and trades with the ID generator persisted
+// in dir, then rebuilds the orderbook of every market from its latest snapshot
+// and the journal after it in dir and keeps journaling to it, with a new
+// snapshot after every snapshotEvery records. The working orders of the users
+// are restored from the rebuilt books.
+func (ex *Exchange) openJournals(dir string, snapshotEvery uint64) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	ids, err := orderbook.OpenIDGenerator(filepath.Join(dir, "ids"), idBlock)
+	if err != nil {
+		return err
+	}
+
+	for market, ob := range ex.orderbooks {
+		ob.IDs = ids
+
+		snapshot := filepath.Join(dir, string(market)+".snapshot")
+		if err := ob.LoadSnapshot(snapshot); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+
+		journal, records, err := orderbook.OpenJournal(filepath.Join(dir, string(market)+".journal"))
+		if err != nil {
+			return err
+		}
+		if err := ob.Replay(records); err != nil {
+			journal.Close()
+			return err
+		}
+		ob.SetJournal(journal)
+		ob.SetSnapshots(snapshot, snapshotEvery)
+
+		logrus.WithFields(logrus.Fields{
+			"market":  market,
+			"records": len(records),
+		}).Info("orderbook replayed")
+	}
+
+	ex.restoreOrders()
+
+	return nil
+}
+
+// restoreOrders fills the per user order lists with the working orders of the
+// books, in the order they were placed.
+func (ex *Exchange) restoreOrders() {
+	orders := []*orderbook.Order{}
+	for _, ob := range ex.orderbooks {
+		for _, order := range ob.Orders {
+			orders = append(orders, order)
+		}
+	}
+	sort.Sort(orderbook.Orders(orders))
+
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	for _, order := range orders {
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	}
+}
+
+// snapshotOrderbooks periodically writes a snapshot of every orderbook that
+// changed since its last one.
+func (ex *Exchange) snapshotOrderbooks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		for market, ob := range ex.orderbooks {
+			if err := ob.Snapshot(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"market": market,
+					"err":    err,
+				}).Error("writing orderbook snapshot")
+			}
+		}
+	}
+}
+
+// writeFileAtomic writes the file through a temporary file, so a crash leaves
+// either the old or the new content.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
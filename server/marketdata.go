@@ -0,0 +1,461 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ChannelL1 is the best bid and ask of a market.
+	ChannelL1 Channel = "L1"
+	// ChannelL2 is the depth of a market aggregated by price level.
+	ChannelL2 Channel = "L2"
+	// ChannelTrades are the trades of a market.
+	ChannelTrades Channel = "TRADES"
+
+	OpSubscribe   = "subscribe"
+	OpUnsubscribe = "unsubscribe"
+
+	MessageSnapshot MessageType = "SNAPSHOT"
+	MessageUpdate   MessageType = "UPDATE"
+	MessageError    MessageType = "ERROR"
+)
+
+const (
+	// snapshotTradesCount is the number of recent trades in the snapshot of
+	// the trades channel.
+	snapshotTradesCount = 50
+	// wsSendBuffer is the number of messages queued for a connection, a
+	// connection that falls further behind is dropped.
+	wsSendBuffer = 256
+)
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+type (
+	Channel     string
+	MessageType string
+
+	// SubscribeRequest is sent by a client on the market data WebSocket to
+	// subscribe to or unsubscribe from a channel of a market.
+	SubscribeRequest struct {
+		Op      string
+		Channel Channel
+		Market  Market
+	}
+
+	// MarketDataMessage is sent to the subscribers of a channel. A
+	// subscription starts with a SNAPSHOT of the channel, followed by the
+	// UPDATEs to it. Seq numbers the messages of the channel of the market
+	// and goes up by one with every update, a subscriber that sees a gap
+	// missed an update and has to subscribe again for a new snapshot.
+	MarketDataMessage struct {
+		Type    MessageType
+		Channel Channel
+		Market  Market
+		Seq     uint64
+		L1      *TopOfBook        `json:",omitzero"`
+		Bids    []orderbook.Level `json:",omitzero"`
+		Asks    []orderbook.Level `json:",omitzero"`
+		Trades  []PublicTrade     `json:",omitzero"`
+		Candles []Candle          `json:",omitzero"`
+		Error   string            `json:",omitzero"`
+	}
+
+	// PublicTrade is a trade as the public market data shows it, without
+	// the users and orders that made it.
+	PublicTrade struct {
+		Seq           uint64
+		ID            int64
+		Market        string
+		Price         orderbook.Decimal
+		Size          orderbook.Decimal
+		AggressorSide orderbook.Side
+		Timestamp     int64
+	}
+
+	// TopOfBook is the best bid and ask price of a market and the volume
+	// at them, zero for an empty side.
+	TopOfBook struct {
+		BidPrice  orderbook.Decimal
+		BidVolume orderbook.Decimal
+		AskPrice  orderbook.Decimal
+		AskVolume orderbook.Decimal
+	}
+
+	// wsConn is a WebSocket connection. Messages are queued on send and
+	// written by its own goroutine.
+	wsConn struct {
+		conn *websocket.Conn
+		send chan []byte
+		once sync.Once
+		done chan struct{}
+	}
+
+	// marketFeed publishes the market data of a market. It keeps the state
+	// last sent on every channel, updates are the difference between that
+	// state and the book.
+	marketFeed struct {
+		market Market
+		ob     *orderbook.Orderbook
+
+		mu          sync.Mutex
+		subscribers map[Channel]map[*wsConn]bool
+		seq         map[Channel]uint64
+		l1          TopOfBook
+		bids        map[orderbook.Decimal]orderbook.Level
+		asks        map[orderbook.Decimal]orderbook.Level
+		tradeSeq    uint64
+		candles     *candles
+		ticker      *ticker
+	}
+)
+
+func (ch Channel) isValid() bool {
+	if ch == ChannelL1 || ch == ChannelL2 || ch == ChannelTrades {
+		return true
+	}
+	_, ok := ch.interval()
+	return ok
+}
+
+// interval returns the interval of a candles channel.
+func (ch Channel) interval() (Interval, bool) {
+	for _, interval := range Intervals {
+		if ch == CandleChannel(interval) {
+			return interval, true
+		}
+	}
+	return "", false
+}
+
+func newWSConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{
+		conn: conn,
+		send: make(chan []byte, wsSendBuffer),
+		done: make(chan struct{}),
+	}
+}
+
+// queue queues a message for the connection without blocking. A connection
+// whose queue is full is closed.
+func (c *wsConn) queue(msg []byte) {
+	select {
+	case c.send <- msg:
+	case <-c.done:
+	default:
+		logrus.Warn("websocket client too slow, closing connection")
+		c.close()
+	}
+}
+
+func (c *wsConn) close() {
+	c.once.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// writeLoop writes the queued messages until the connection is closed.
+func (c *wsConn) writeLoop() {
+	for {
+		select {
+		case msg := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				c.close()
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *wsConn) queueJSON(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("encoding websocket message")
+		return
+	}
+	c.queue(b)
+}
+
+func newMarketFeed(market Market, ob *orderbook.Orderbook) *marketFeed {
+	f := &marketFeed{
+		market:      market,
+		ob:          ob,
+		subscribers: make(map[Channel]map[*wsConn]bool),
+		seq:         make(map[Channel]uint64),
+		bids:        make(map[orderbook.Decimal]orderbook.Level),
+		asks:        make(map[orderbook.Decimal]orderbook.Level),
+		candles:     newCandles(),
+		ticker:      newTicker(),
+	}
+	for _, ch := range []Channel{ChannelL1, ChannelL2, ChannelTrades} {
+		f.subscribers[ch] = make(map[*wsConn]bool)
+	}
+	for _, interval := range Intervals {
+		f.subscribers[CandleChannel(interval)] = make(map[*wsConn]bool)
+	}
+	return f
+}
+
+// run publishes the updates of the book as they happen.
+func (f *marketFeed) run() {
+	f.publish()
+	for range f.ob.Updates() {
+		f.publish()
+	}
+}
+
+// publish sends the changes of the book since the last publish to the
+// subscribers of every channel that changed.
+func (f *marketFeed) publish() {
+	bids, asks := f.ob.Depth(0)
+	trades := f.ob.FilterTrades(orderbook.TradeFilter{Since: f.tradeSeq})
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if l1 := topOfBook(bids, asks); l1 != f.l1 {
+		f.l1 = l1
+		f.broadcast(ChannelL1, MarketDataMessage{L1: &l1})
+	}
+
+	changedBids := diffLevels(f.bids, bids)
+	changedAsks := diffLevels(f.asks, asks)
+	if len(changedBids) > 0 || len(changedAsks) > 0 {
+		f.broadcast(ChannelL2, MarketDataMessage{Bids: changedBids, Asks: changedAsks})
+	}
+
+	// the book may have been read before the trades, trades already
+	// published are skipped.
+	if len(trades) > 0 && trades[len(trades)-1].Seq > f.tradeSeq {
+		fresh := []*orderbook.Trade{}
+		for _, trade := range trades {
+			if trade.Seq > f.tradeSeq {
+				fresh = append(fresh, trade)
+			}
+		}
+		f.tradeSeq = fresh[len(fresh)-1].Seq
+		f.broadcast(ChannelTrades, MarketDataMessage{Trades: publicTrades(fresh)})
+		f.ticker.add(fresh)
+
+		// the candles in progress are pushed with every trade, an update
+		// can also hold the candles it closed.
+		changed := f.candles.add(fresh)
+		for _, interval := range Intervals {
+			if bars, ok := changed[interval]; ok {
+				f.broadcast(CandleChannel(interval), MarketDataMessage{Candles: bars})
+			}
+		}
+	}
+}
+
+// broadcast numbers the update and queues it for the subscribers of the
+// channel.
+func (f *marketFeed) broadcast(ch Channel, msg MarketDataMessage) {
+	f.seq[ch]++
+	msg.Type = MessageUpdate
+	msg.Channel = ch
+	msg.Market = f.market
+	msg.Seq = f.seq[ch]
+
+	if len(f.subscribers[ch]) == 0 {
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Error("encoding market data")
+		return
+	}
+	for c := range f.subscribers[ch] {
+		c.queue(b)
+	}
+}
+
+// subscribe sends the snapshot of the channel to the connection and adds it to
+// the subscribers. The snapshot is the state the next update is built on.
+func (f *marketFeed) subscribe(c *wsConn, ch Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	msg := MarketDataMessage{
+		Type:    MessageSnapshot,
+		Channel: ch,
+		Market:  f.market,
+		Seq:     f.seq[ch],
+	}
+	switch ch {
+	case ChannelL1:
+		l1 := f.l1
+		msg.L1 = &l1
+	case ChannelL2:
+		msg.Bids = sortedLevels(f.bids, true)
+		msg.Asks = sortedLevels(f.asks, false)
+	case ChannelTrades:
+		trades := f.ob.FilterTrades(orderbook.TradeFilter{})
+		recent := []*orderbook.Trade{}
+		for _, trade := range trades[max(0, len(trades)-snapshotTradesCount):] {
+			if trade.Seq <= f.tradeSeq {
+				recent = append(recent, trade)
+			}
+		}
+		msg.Trades = publicTrades(recent)
+	default:
+		interval, _ := ch.interval()
+		msg.Candles = f.candles.recent(interval, snapshotCandlesCount)
+	}
+
+	c.queueJSON(msg)
+	f.subscribers[ch][c] = true
+}
+
+func (f *marketFeed) unsubscribe(c *wsConn, ch Channel) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.subscribers[ch], c)
+}
+
+func topOfBook(bids, asks []orderbook.Level) TopOfBook {
+	l1 := TopOfBook{}
+	if len(bids) > 0 {
+		l1.BidPrice, l1.BidVolume = bids[0].Price, bids[0].Volume
+	}
+	if len(asks) > 0 {
+		l1.AskPrice, l1.AskVolume = asks[0].Price, asks[0].Volume
+	}
+	return l1
+}
+
+// diffLevels updates the published levels of a side to the levels of the book
+// and returns the levels that changed, a removed level has zero volume.
+func diffLevels(published map[orderbook.Decimal]orderbook.Level, levels []orderbook.Level) []orderbook.Level {
+	changed := []orderbook.Level{}
+	current := make(map[orderbook.Decimal]bool, len(levels))
+
+	for _, level := range levels {
+		current[level.Price] = true
+		if old, ok := published[level.Price]; !ok || old != level {
+			published[level.Price] = level
+			changed = append(changed, level)
+		}
+	}
+	for price := range published {
+		if !current[price] {
+			delete(published, price)
+			changed = append(changed, orderbook.Level{Price: price})
+		}
+	}
+
+	return changed
+}
+
+// sortedLevels returns the levels from the best price to the worst.
+func sortedLevels(levels map[orderbook.Decimal]orderbook.Level, bid bool) []orderbook.Level {
+	sorted := make([]orderbook.Level, 0, len(levels))
+	for _, level := range levels {
+		sorted = append(sorted, level)
+	}
+	slices.SortFunc(sorted, func(a, b orderbook.Level) int {
+		if bid {
+			return b.Price.Cmp(a.Price)
+		}
+		return a.Price.Cmp(b.Price)
+	})
+	return sorted
+}
+
+// handleMarketData upgrades the request to the market data WebSocket. Clients
+// send SubscribeRequests and receive MarketDataMessages.
+func (ex *Exchange) handleMarketData(c echo.Context) error {
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	ws := newWSConn(conn)
+	go ws.writeLoop()
+
+	subscribed := make(map[*marketFeed]map[Channel]bool)
+	defer func() {
+		for feed, channels := range subscribed {
+			for ch := range channels {
+				feed.unsubscribe(ws, ch)
+			}
+		}
+		ws.close()
+	}()
+
+	for {
+		req := SubscribeRequest{}
+		if err := conn.ReadJSON(&req); err != nil {
+			return nil
+		}
+
+		feed, ok := ex.feeds[req.Market]
+		if !ok || !req.Channel.isValid() {
+			ws.queueJSON(MarketDataMessage{
+				Type:    MessageError,
+				Channel: req.Channel,
+				Market:  req.Market,
+				Error:   fmt.Sprintf("unknown channel %s of market %s", req.Channel, req.Market),
+			})
+			continue
+		}
+
+		switch req.Op {
+		case OpSubscribe:
+			if subscribed[feed] == nil {
+				subscribed[feed] = make(map[Channel]bool)
+			}
+			if !subscribed[feed][req.Channel] {
+				subscribed[feed][req.Channel] = true
+				feed.subscribe(ws, req.Channel)
+			}
+		case OpUnsubscribe:
+			delete(subscribed[feed], req.Channel)
+			feed.unsubscribe(ws, req.Channel)
+		default:
+			ws.queueJSON(MarketDataMessage{
+				Type:  MessageError,
+				Error: fmt.Sprintf("unknown op %s", req.Op),
+			})
+		}
+	}
+}
+
+// publicTrades strips the trades down to what the public market data shows.
+func publicTrades(trades []*orderbook.Trade) []PublicTrade {
+	public := make([]PublicTrade, 0, len(trades))
+	for _, trade := range trades {
+		public = append(public, PublicTrade{
+			Seq:           trade.Seq,
+			ID:            trade.ID,
+			Market:        trade.Market,
+			Price:         trade.Price,
+			Size:          trade.Size,
+			AggressorSide: trade.AggressorSide,
+			Timestamp:     trade.Timestamp,
+		})
+	}
+	return public
+}
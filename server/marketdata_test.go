@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+)
+
+func nextMessage(t *testing.T, c *wsConn) MarketDataMessage {
+	t.Helper()
+
+	select {
+	case b := <-c.send:
+		msg := MarketDataMessage{}
+		if err := json.Unmarshal(b, &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	default:
+		t.Fatal("no message queued")
+	}
+	return MarketDataMessage{}
+}
+
+func TestMarketFeed(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	feed := newMarketFeed(MarketINN, ob)
+
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(10), "CSD000000000001-0001"))
+	ob.PlaceLimitOrder(orderbook.NewDecimal(101), orderbook.NewOrder(false, orderbook.NewDecimal(5), "CSD000000000001-0001"))
+	feed.publish()
+
+	c := newWSConn(nil)
+	feed.subscribe(c, ChannelL2)
+	feed.subscribe(c, ChannelTrades)
+
+	snapshot := nextMessage(t, c)
+	if snapshot.Type != MessageSnapshot || snapshot.Seq != 1 || len(snapshot.Asks) != 2 || snapshot.Asks[0].Price != orderbook.NewDecimal(100) {
+		t.Fatalf("unexpected L2 snapshot %+v", snapshot)
+	}
+	trades := nextMessage(t, c)
+	if trades.Type != MessageSnapshot || trades.Seq != 0 || len(trades.Trades) != 0 {
+		t.Fatalf("unexpected trades snapshot %+v", trades)
+	}
+
+	// takes the level at 100 and part of the level at 101.
+	ob.PlaceMarketOrder(orderbook.NewOrder(true, orderbook.NewDecimal(12), "CSD000000000002-0001"))
+	feed.publish()
+
+	update := nextMessage(t, c)
+	if update.Type != MessageUpdate || update.Channel != ChannelL2 || update.Seq != 2 {
+		t.Fatalf("unexpected L2 update %+v", update)
+	}
+	changed := map[orderbook.Decimal]orderbook.Decimal{}
+	for _, level := range update.Asks {
+		changed[level.Price] = level.Volume
+	}
+	if len(changed) != 2 || !changed[orderbook.NewDecimal(100)].IsZero() || changed[orderbook.NewDecimal(101)] != orderbook.NewDecimal(3) {
+		t.Errorf("unexpected changed levels %+v", update.Asks)
+	}
+
+	update = nextMessage(t, c)
+	if update.Channel != ChannelTrades || update.Seq != 1 || len(update.Trades) != 2 {
+		t.Fatalf("unexpected trades update %+v", update)
+	}
+
+	// nothing changed, nothing is sent.
+	feed.publish()
+	select {
+	case b := <-c.send:
+		t.Errorf("unexpected message %s", b)
+	default:
+	}
+}
@@ -0,0 +1,309 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	OrderAccepted        OrderEventType = "ACCEPTED"
+	OrderPartiallyFilled OrderEventType = "PARTIALLY_FILLED"
+	OrderFilled          OrderEventType = "FILLED"
+	OrderCancelled       OrderEventType = "CANCELLED"
+	OrderExpired         OrderEventType = "EXPIRED"
+	OrderRejected        OrderEventType = "REJECTED"
+
+	MessageAuthenticated MessageType = "AUTHENTICATED"
+	MessageOrder         MessageType = "ORDER"
+)
+
+// authWindow is how far the timestamp of an AuthRequest may be off the clock
+// of the exchange.
+const authWindow = 30 * time.Second
+
+type (
+	OrderEventType string
+
+	// OrderEvent is a change to an order of a user. Fills carry the price,
+	// size and trade ID of the execution, Remaining is what is left of the
+	// order after the event.
+	OrderEvent struct {
+		Type      OrderEventType
+		Market    Market
+		OrderID   int64
+		UserID    string
+		Bid       bool
+		Price     orderbook.Decimal
+		Remaining orderbook.Decimal
+		FillPrice orderbook.Decimal `json:",omitzero"`
+		FillSize  orderbook.Decimal `json:",omitzero"`
+		TradeID   int64             `json:",omitzero"`
+		Reason    string            `json:",omitzero"`
+		Timestamp int64
+	}
+
+	// AuthRequest is the first message on the order WebSocket. Signature
+	// is the hex encoded signature of AuthHash(UserID, Timestamp, Nonce) by
+	// the key of the user, Timestamp is unix nano. Like the nonce of a
+	// signed request, Nonce can only be used once.
+	AuthRequest struct {
+		UserID    string
+		Timestamp int64
+		Nonce     string
+		Signature string
+	}
+
+	// OrderStreamMessage is sent on the order WebSocket: AUTHENTICATED once
+	// the connection is authenticated, then an ORDER message for every
+	// event of an order of the user. ERROR is sent before the connection
+	// is closed.
+	OrderStreamMessage struct {
+		Type  MessageType
+		Event *OrderEvent `json:",omitzero"`
+		Error string      `json:",omitzero"`
+	}
+
+	// orderStreams holds the order WebSocket connections of every user.
+	orderStreams struct {
+		mu    sync.RWMutex
+		conns map[string]map[*wsConn]bool
+	}
+)
+
+// AuthHash returns the hash a user signs to authenticate on the order
+// WebSocket.
+func AuthHash(userID string, timestamp int64, nonce string) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("stock-exchange auth:%s:%d:%s", userID, timestamp, nonce)))
+}
+
+func newOrderStreams() *orderStreams {
+	return &orderStreams{conns: make(map[string]map[*wsConn]bool)}
+}
+
+func (s *orderStreams) add(userID string, c *wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns[userID] == nil {
+		s.conns[userID] = make(map[*wsConn]bool)
+	}
+	s.conns[userID][c] = true
+}
+
+func (s *orderStreams) remove(userID string, c *wsConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.conns[userID], c)
+	if len(s.conns[userID]) == 0 {
+		delete(s.conns, userID)
+	}
+}
+
+// send queues the event for the connections of its user.
+func (s *orderStreams) send(event *OrderEvent) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for c := range s.conns[event.UserID] {
+		c.queueJSON(OrderStreamMessage{Type: MessageOrder, Event: event})
+	}
+}
+
+// verifyAuth checks the signature of the request against the key of the user
+// and uses up its nonce, so the request cannot be replayed.
+func (ex *Exchange) verifyAuth(req AuthRequest, now time.Time) error {
+	if d := now.Sub(time.Unix(0, req.Timestamp)); d > authWindow || d < -authWindow {
+		return fmt.Errorf("timestamp is more than %s off", authWindow)
+	}
+	if req.Nonce == "" {
+		return fmt.Errorf("missing nonce")
+	}
+
+	if err := ex.verifySignature(req.UserID, AuthHash(req.UserID, req.Timestamp, req.Nonce), req.Signature); err != nil {
+		return err
+	}
+	if !ex.nonces.use(req.UserID, req.Nonce, req.Timestamp, now) {
+		return fmt.Errorf("nonce already used: %s", req.Nonce)
+	}
+	return nil
+}
+
+// handleOrderStream upgrades the request to the order WebSocket of a user. The
+// first message has to be an AuthRequest, after it the events of the orders
+// of the user are pushed until the connection is closed.
+func (ex *Exchange) handleOrderStream(c echo.Context) error {
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		return err
+	}
+
+	ws := newWSConn(conn)
+	go ws.writeLoop()
+
+	req := AuthRequest{}
+	if err := conn.ReadJSON(&req); err != nil {
+		ws.close()
+		return nil
+	}
+	if err := ex.verifyAuth(req, time.Now()); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"userID": req.UserID,
+			"err":    err,
+		}).Warn("order stream authentication failed")
+
+		// the error is written directly, ws.close would drop it from the
+		// queue.
+		conn.WriteJSON(OrderStreamMessage{Type: MessageError, Error: err.Error()})
+		ws.close()
+		return nil
+	}
+
+	ex.streams.add(req.UserID, ws)
+	defer ex.streams.remove(req.UserID, ws)
+	ws.queueJSON(OrderStreamMessage{Type: MessageAuthenticated})
+
+	// nothing is expected from the client anymore, reading notices when it
+	// goes away.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			ws.close()
+			return nil
+		}
+	}
+}
+
+// newOrderEvent returns the event of the order with its current state.
+func newOrderEvent(t OrderEventType, market Market, o *orderbook.Order) *OrderEvent {
+	return &OrderEvent{
+		Type:      t,
+		Market:    market,
+		OrderID:   o.ID,
+		UserID:    o.UserID,
+		Bid:       o.Bid,
+		Price:     o.Price,
+		Remaining: o.Size.Add(o.Hidden),
+		Timestamp: time.Now().UnixNano(),
+	}
+}
+
+// publishOrderEvents sends the events of a command on the book: the acceptance
+// of the placed or amended order, nil for other commands, and of the stop
+// orders the command triggered, a fill for both orders of every match and the
+// cancellations and rejections the command caused.
+func (ex *Exchange) publishOrderEvents(market Market, placed *orderbook.Order, matches []orderbook.Match) {
+	var triggered []orderbook.TriggeredStop
+	if ob, ok := ex.orderbooks[market]; ok {
+		triggered = ob.TriggeredStops()
+	}
+
+	// a placed stop that triggered right away is reported as the placed
+	// order, unless it was rejected.
+	rejected := false
+	stops := []orderbook.TriggeredStop{}
+	for _, stop := range triggered {
+		if stop.Err != nil {
+			ex.publishOrderRejected(market, &stop.Order, stop.Err)
+			rejected = rejected || (placed != nil && stop.Order.ID == placed.ID)
+			continue
+		}
+		if placed == nil || stop.Order.ID != placed.ID {
+			stops = append(stops, stop)
+		}
+	}
+
+	if placed != nil && placed.Status == orderbook.StatusRejected {
+		if !rejected {
+			ex.streams.send(newOrderEvent(OrderRejected, market, placed))
+		}
+		placed = nil
+	}
+
+	// an order is reported FILLED at its last match, the matches before
+	// are partial fills.
+	last := make(map[*orderbook.Order]int)
+	for i, match := range matches {
+		last[match.Bid] = i
+		last[match.Ask] = i
+	}
+
+	// remaining tracks the size of the orders as the matches are replayed,
+	// it starts at their size after all of them. filled is what the
+	// matches took from each order.
+	remaining := make(map[*orderbook.Order]orderbook.Decimal)
+	filled := make(map[int64]orderbook.Decimal)
+	for o := range last {
+		remaining[o] = o.Size.Add(o.Hidden)
+	}
+	for _, match := range matches {
+		remaining[match.Bid] = remaining[match.Bid].Add(match.Sizefilled)
+		remaining[match.Ask] = remaining[match.Ask].Add(match.Sizefilled)
+		filled[match.Bid.ID] = filled[match.Bid.ID].Add(match.Sizefilled)
+		filled[match.Ask.ID] = filled[match.Ask.ID].Add(match.Sizefilled)
+	}
+
+	if placed != nil {
+		event := newOrderEvent(OrderAccepted, market, placed)
+		if size, ok := remaining[placed]; ok {
+			event.Remaining = size
+		}
+		ex.streams.send(event)
+	}
+	for _, stop := range stops {
+		event := newOrderEvent(OrderAccepted, market, &stop.Order)
+		event.Remaining = event.Remaining.Add(filled[stop.Order.ID])
+		ex.streams.send(event)
+	}
+
+	for i, match := range matches {
+		for _, o := range []*orderbook.Order{match.Bid, match.Ask} {
+			remaining[o] = remaining[o].Sub(match.Sizefilled)
+
+			event := newOrderEvent(OrderPartiallyFilled, market, o)
+			if i == last[o] && o.Status == orderbook.StatusFilled {
+				event.Type = OrderFilled
+			}
+			event.Remaining = remaining[o]
+			event.FillPrice = match.Price
+			event.FillSize = match.Sizefilled
+			event.TradeID = match.TradeID
+			ex.streams.send(event)
+		}
+	}
+
+	if placed != nil {
+		ex.publishOrderCancelled(market, placed)
+	}
+	for _, stop := range stops {
+		ex.publishOrderCancelled(market, &stop.Order)
+	}
+}
+
+// publishOrderCancelled sends the cancellation of the order, when what was
+// left of it got cancelled, and of the resting orders its self-trade
+// prevention cancelled.
+func (ex *Exchange) publishOrderCancelled(market Market, o *orderbook.Order) {
+	if o.Status == orderbook.StatusCancelled {
+		ex.streams.send(newOrderEvent(OrderCancelled, market, o))
+	}
+	for _, p := range o.Prevented {
+		if p.Resting.Status == orderbook.StatusCancelled {
+			event := newOrderEvent(OrderCancelled, market, p.Resting)
+			event.Reason = fmt.Sprintf("self-trade prevention %s", p.Mode)
+			ex.streams.send(event)
+		}
+	}
+}
+
+// publishOrderRejected sends the rejection of a placed order.
+func (ex *Exchange) publishOrderRejected(market Market, o *orderbook.Order, err error) {
+	event := newOrderEvent(OrderRejected, market, o)
+	event.Reason = err.Error()
+	ex.streams.send(event)
+}
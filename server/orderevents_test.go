@@ -0,0 +1,205 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestVerifyAuth(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userID := "CSD000000000001-0001"
+	ex := &Exchange{
+		Users:  map[string]*User{userID: {ID: userID, PrivateKey: key}},
+		nonces: newNonceCache(),
+	}
+	now := time.Now()
+
+	sign := func(key *ecdsa.PrivateKey, timestamp int64, nonce string) AuthRequest {
+		sig, err := crypto.Sign(AuthHash(userID, timestamp, nonce), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return AuthRequest{UserID: userID, Timestamp: timestamp, Nonce: nonce, Signature: hex.EncodeToString(sig)}
+	}
+
+	valid := sign(key, now.UnixNano(), "n1")
+	if err := ex.verifyAuth(valid, now); err != nil {
+		t.Errorf("valid signature rejected: %v", err)
+	}
+	if err := ex.verifyAuth(valid, now); err == nil {
+		t.Errorf("replayed auth request accepted")
+	}
+	if err := ex.verifyAuth(sign(other, now.UnixNano(), "n2"), now); err == nil {
+		t.Errorf("signature of another key accepted")
+	}
+	if err := ex.verifyAuth(sign(key, now.Add(-time.Minute).UnixNano(), "n3"), now); err == nil {
+		t.Errorf("stale signature accepted")
+	}
+	if err := ex.verifyAuth(sign(key, now.UnixNano(), ""), now); err == nil {
+		t.Errorf("auth request without nonce accepted")
+	}
+
+	// the nonce of a rejected request is not used up.
+	if err := ex.verifyAuth(sign(key, now.UnixNano(), "n2"), now); err != nil {
+		t.Errorf("nonce of a rejected request burned: %v", err)
+	}
+}
+
+func TestPublishOrderEvents(t *testing.T) {
+	ex := &Exchange{streams: newOrderStreams()}
+	maker, taker := newWSConn(nil), newWSConn(nil)
+	ex.streams.add("CSD000000000001-0001", maker)
+	ex.streams.add("CSD000000000002-0001", taker)
+
+	ob := orderbook.NewOrderbook()
+	first := orderbook.NewOrder(false, orderbook.NewDecimal(4), "CSD000000000001-0001")
+	second := orderbook.NewOrder(false, orderbook.NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), first)
+	ob.PlaceLimitOrder(orderbook.NewDecimal(101), second)
+
+	order := orderbook.NewOrder(true, orderbook.NewDecimal(20), "CSD000000000002-0001")
+	matches, err := ob.PlaceLimitOrder(orderbook.NewDecimal(101), order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.publishOrderEvents(MarketINN, order, matches)
+
+	events := func(c *wsConn) []OrderEvent {
+		events := []OrderEvent{}
+		for len(c.send) > 0 {
+			msg := OrderStreamMessage{}
+			if err := json.Unmarshal(<-c.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, *msg.Event)
+		}
+		return events
+	}
+
+	got := events(taker)
+	expected := []struct {
+		typ       OrderEventType
+		remaining int64
+		fill      int64
+	}{
+		{OrderAccepted, 20, 0},
+		{OrderPartiallyFilled, 16, 4},
+		{OrderPartiallyFilled, 6, 10},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("got %d taker events, expected %d: %+v", len(got), len(expected), got)
+	}
+	for i, e := range expected {
+		if got[i].Type != e.typ || got[i].Remaining != orderbook.NewDecimal(e.remaining) || got[i].FillSize != orderbook.NewDecimal(e.fill) {
+			t.Errorf("taker event %d: %+v", i, got[i])
+		}
+	}
+
+	got = events(maker)
+	if len(got) != 2 || got[0].Type != OrderFilled || got[0].OrderID != first.ID || got[1].Type != OrderFilled || got[1].OrderID != second.ID {
+		t.Errorf("unexpected maker events %+v", got)
+	}
+	if got[1].FillPrice != orderbook.NewDecimal(101) || got[1].TradeID != matches[1].TradeID {
+		t.Errorf("unexpected fill %+v", got[1])
+	}
+}
+
+func TestPublishRejectedStop(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	ex := &Exchange{
+		streams:    newOrderStreams(),
+		orderbooks: map[Market]*orderbook.Orderbook{MarketINN: ob},
+	}
+	owner := newWSConn(nil)
+	ex.streams.add("CSD000000000003-0001", owner)
+
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(2), "CSD000000000001-0001"))
+	stop := orderbook.NewOrder(true, orderbook.NewDecimal(5), "CSD000000000003-0001")
+	stop.LiquidityPolicy = orderbook.RejectInsufficientLiquidity
+	ob.PlaceStopOrder(orderbook.NewDecimal(100), orderbook.Decimal{}, stop)
+
+	order := orderbook.NewOrder(true, orderbook.NewDecimal(1), "CSD000000000002-0001")
+	matches, err := ob.PlaceMarketOrder(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.publishOrderEvents(MarketINN, order, matches)
+
+	if len(owner.send) != 1 {
+		t.Fatalf("got %d events for the stop owner, expected 1", len(owner.send))
+	}
+	msg := OrderStreamMessage{}
+	if err := json.Unmarshal(<-owner.send, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Event.Type != OrderRejected || msg.Event.OrderID != stop.ID || msg.Event.Reason == "" {
+		t.Errorf("unexpected event %+v", msg.Event)
+	}
+}
+
+func TestPublishTriggeredStops(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	ex := &Exchange{
+		streams:    newOrderStreams(),
+		orderbooks: map[Market]*orderbook.Orderbook{MarketINN: ob},
+	}
+	resting := newWSConn(nil)
+	ex.streams.add("CSD000000000003-0001", resting)
+	killed := newWSConn(nil)
+	ex.streams.add("CSD000000000004-0001", killed)
+
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), orderbook.NewOrder(false, orderbook.NewDecimal(2), "CSD000000000001-0001"))
+	// the stop-market order fills what is left at 100 and gets the rest
+	// cancelled, the stop-limit order then rests at 100.
+	stopMarket := orderbook.NewOrder(true, orderbook.NewDecimal(5), "CSD000000000004-0001")
+	ob.PlaceStopOrder(orderbook.NewDecimal(100), orderbook.Decimal{}, stopMarket)
+	stopLimit := orderbook.NewOrder(true, orderbook.NewDecimal(3), "CSD000000000003-0001")
+	ob.PlaceStopOrder(orderbook.NewDecimal(100), orderbook.NewDecimal(100), stopLimit)
+	ob.TriggeredStops()
+
+	order := orderbook.NewOrder(true, orderbook.NewDecimal(1), "CSD000000000002-0001")
+	matches, err := ob.PlaceMarketOrder(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ex.publishOrderEvents(MarketINN, order, matches)
+
+	events := func(ws *wsConn) []OrderEvent {
+		got := []OrderEvent{}
+		for len(ws.send) > 0 {
+			msg := OrderStreamMessage{}
+			if err := json.Unmarshal(<-ws.send, &msg); err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, *msg.Event)
+		}
+		return got
+	}
+
+	got := events(killed)
+	if len(got) != 3 || got[0].Type != OrderAccepted || got[1].Type != OrderPartiallyFilled || got[2].Type != OrderCancelled {
+		t.Fatalf("unexpected events for the stop-market order %+v", got)
+	}
+	if got[0].Remaining != orderbook.NewDecimal(5) || got[1].Remaining != orderbook.NewDecimal(4) || got[2].Remaining != orderbook.NewDecimal(4) {
+		t.Errorf("unexpected remaining sizes %+v", got)
+	}
+
+	got = events(resting)
+	if len(got) != 1 || got[0].Type != OrderAccepted || got[0].OrderID != stopLimit.ID || got[0].Remaining != orderbook.NewDecimal(3) {
+		t.Errorf("unexpected events for the stop-limit order %+v", got)
+	}
+}
@@ -4,13 +4,17 @@ import (
 	"context"
 	"crypto/ecdsa"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/bruce-mig/stock-exchange/orderbook"
 	"github.com/ethereum/go-ethereum/common"
@@ -24,14 +28,39 @@ import (
 )
 
 const (
-	MarketOrder OrderType = "MARKET"
-	LimitOrder  OrderType = "LIMIT"
-	MarketINN   Market    = "INN"
+	MarketOrder    OrderType = "MARKET"
+	LimitOrder     OrderType = "LIMIT"
+	StopOrder      OrderType = "STOP"
+	StopLimitOrder OrderType = "STOP_LIMIT"
+	MarketINN      Market    = "INN"
+
+	// ErrCodeInsufficientLiquidity is the APIError code of a market order
+	// rejected because the book could not fill it.
+	ErrCodeInsufficientLiquidity = "INSUFFICIENT_LIQUIDITY"
+	// ErrCodeMarketPhase is the APIError code of a request the current
+	// phase of the market does not allow.
+	ErrCodeMarketPhase = "MARKET_PHASE"
+	// ErrCodePriceBand is the APIError code of an order rejected because it
+	// would execute outside of the price bands.
+	ErrCodePriceBand = "PRICE_BAND"
+)
+
+const (
+	// defaultTradesLimit and maxTradesLimit bound the number of trades
+	// returned by one request to GET /trades/:market.
+	defaultTradesLimit = 100
+	maxTradesLimit     = 1000
 )
 
 var (
 	exchangePrivateKey = os.Getenv("EXCHANGE_PK")
 	csdEndpoint        = os.Getenv("CSD_ENDPOINT")
+	instrumentsFile    = getenv("INSTRUMENTS_FILE", "instruments.json")
+	calendarFile       = getenv("CALENDAR_FILE", "calendar.json")
+	journalDir         = getenv("JOURNAL_DIR", "journal")
+	snapshotEvery      = getenv("SNAPSHOT_EVERY", "10000")
+	snapshotInterval   = getenv("SNAPSHOT_INTERVAL", "1m")
+	adminToken         = os.Getenv("ADMIN_TOKEN")
 )
 
 type (
@@ -43,62 +72,154 @@ type (
 		mu     sync.RWMutex
 		Users  map[string]*User
 		// Orders maps a user to his orders.
-		Orders     map[string][]*orderbook.Order
-		PrivateKey *ecdsa.PrivateKey
-		orderbooks map[Market]*orderbook.Orderbook
+		Orders map[string][]*orderbook.Order
+		// Expired maps a user to his GTD and DAY orders that expired.
+		Expired     map[string][]*orderbook.Order
+		PrivateKey  *ecdsa.PrivateKey
+		orderbooks  map[Market]*orderbook.Orderbook
+		instruments map[Market]*Instrument
+		sessions    map[Market]*Session
+		// halts maps a market to its halts, oldest first.
+		halts map[Market][]*Halt
+		// feeds publish the market data of every market, streams the
+		// order events of every user.
+		feeds   map[Market]*marketFeed
+		streams *orderStreams
+		// nonces are the nonces of the recent signed requests.
+		nonces  *nonceCache
+		apiKeys *apiKeyStore
+		// usersPath is the file the users are persisted to, the users
+		// are only kept in memory when it is empty.
+		usersPath string
 	}
 
 	PlaceOrderRequest struct {
-		UserID string
-		Type   OrderType //limit or market
-		Bid    bool
-		Size   float64
-		Price  float64
-		Market Market
+		UserID      string
+		Type        OrderType //limit, market, stop or stop limit
+		Bid         bool
+		Size        orderbook.Decimal
+		Price       orderbook.Decimal
+		StopPrice   orderbook.Decimal // only for stop and stop limit orders
+		DisplaySize orderbook.Decimal // peak size of iceberg limit orders
+		// LiquidityPolicy and ProtectionPrice only apply to market and
+		// stop orders. The policy defaults to rejecting a market order the
+		// book cannot fill completely, and to filling what the book has
+		// for a triggered stop order.
+		LiquidityPolicy orderbook.LiquidityPolicy
+		ProtectionPrice orderbook.Decimal
+		Market          Market
+		TimeInForce     orderbook.TimeInForce // defaults to GTC
+		ExpiresAt       int64                 // unix nano, only for GTD orders
+		// SelfTradePrevention defaults to the self-trade prevention mode
+		// of the user.
+		SelfTradePrevention orderbook.SelfTradePrevention
+	}
+
+	// AmendOrderRequest changes the price and size of a resting limit
+	// order. A zero price keeps the current price, Size is the new total
+	// size of the order.
+	AmendOrderRequest struct {
+		Price orderbook.Decimal
+		Size  orderbook.Decimal
 	}
 
 	Order struct {
-		UserID    string
-		ID        int64
-		Price     float64
-		Size      float64
-		Bid       bool
-		Timestamp int64
+		UserID      string
+		ID          int64
+		Price       orderbook.Decimal
+		Size        orderbook.Decimal
+		Bid         bool
+		Timestamp   int64
+		TimeInForce orderbook.TimeInForce
+		ExpiresAt   int64
+		StopPrice   orderbook.Decimal
+		DisplaySize orderbook.Decimal
+		Hidden      orderbook.Decimal
+		Status      orderbook.OrderStatus
 	}
 
 	OrderbookData struct {
-		TotalBidVolume float64
-		TotalAskVolume float64
+		TotalBidVolume orderbook.Decimal
+		TotalAskVolume orderbook.Decimal
 		Asks           []*Order
 		Bids           []*Order
 	}
 
 	MatchedOrder struct {
-		UserID string
-		Price  float64
-		Size   float64
-		ID     int64
+		UserID  string
+		Price   orderbook.Decimal
+		Size    orderbook.Decimal
+		ID      int64
+		TradeID int64
 	}
 
 	User struct {
 		ID         string
 		PrivateKey *ecdsa.PrivateKey
+		// SelfTradePrevention is the mode used for the orders of the user
+		// that do not set one.
+		SelfTradePrevention orderbook.SelfTradePrevention
+		Status              UserStatus
+		CreatedAt           int64
+	}
+
+	SelfTradePreventionRequest struct {
+		SelfTradePrevention orderbook.SelfTradePrevention
+	}
+
+	// PreventedMatch is a match with an order of the same user that
+	// self-trade prevention stopped.
+	PreventedMatch struct {
+		RestingOrderID int64
+		// RestingStatus is CANCELLED when the resting order got cancelled.
+		RestingStatus orderbook.OrderStatus
+		// Size is the size taken off both orders without a trade by
+		// DECREMENT_AND_CANCEL.
+		Size orderbook.Decimal
+		Mode orderbook.SelfTradePrevention
 	}
 
 	PlaceOrderResponse struct {
 		OrderID int64
+		Status  orderbook.OrderStatus
+		// Filled is the size filled on placement, Remaining the size that
+		// is resting in the book or got cancelled, depending on Status.
+		Filled    orderbook.Decimal
+		Remaining orderbook.Decimal
+		// PreventedMatches are the self-trades that were not executed.
+		PreventedMatches []PreventedMatch
 	}
 
 	GetOrdersResponse struct {
 		Asks []Order
 		Bids []Order
+		// Stops are the stop orders waiting for their trigger.
+		Stops   []Order
+		Expired []Order
 	}
 
 	PriceResponse struct {
-		Price float64
+		Price orderbook.Decimal
+	}
+
+	// BestPriceResponse is the best price of a side of the book and the
+	// visible volume at it, zero for an empty side.
+	BestPriceResponse struct {
+		Price orderbook.Decimal
+		Size  orderbook.Decimal
+	}
+
+	// AuctionResponse holds the price and volume the market would uncross
+	// at, they are only set while the market is in a call auction.
+	AuctionResponse struct {
+		InAuction bool
+		Price     orderbook.Decimal
+		Volume    orderbook.Decimal
+		Surplus   orderbook.Decimal
 	}
 
 	APIError struct {
+		Code  string `json:",omitempty"`
 		Error string
 	}
 )
@@ -111,45 +232,124 @@ func StartServer() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	ex, err := NewExchange(exchangePrivateKey, client)
+	instruments, err := LoadInstruments(instrumentsFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	calendar, err := LoadCalendar(calendarFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ex, err := NewExchange(exchangePrivateKey, client, instruments, calendar)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	ex.registerUser(os.Getenv("USER_1_PK"), "CSD000000000001-0001")
-	ex.registerUser(os.Getenv("USER_2_PK"), "CSD000000000002-0001")
-	ex.registerUser(os.Getenv("USER_3_PK"), "CSD000000000003-0001")
+	every, err := strconv.ParseUint(snapshotEvery, 10, 64)
+	if err != nil {
+		log.Fatalf("invalid SNAPSHOT_EVERY: %v", err)
+	}
+	interval, err := time.ParseDuration(snapshotInterval)
+	if err != nil || interval <= 0 {
+		log.Fatalf("invalid SNAPSHOT_INTERVAL: %s", snapshotInterval)
+	}
+	if err := ex.openJournals(journalDir, every); err != nil {
+		log.Fatal(err)
+	}
+	if err := ex.openUsers(filepath.Join(journalDir, "users.json")); err != nil {
+		log.Fatal(err)
+	}
+	ex.importEnvUsers()
+	if ex.apiKeys, err = openAPIKeyStore(filepath.Join(journalDir, "apikeys.json")); err != nil {
+		log.Fatal(err)
+	}
+	// the allowed IPs of the API keys are checked against the address of
+	// the connection, headers like X-Forwarded-For can be spoofed.
+	e.IPExtractor = echo.ExtractIPDirect()
 
+	e.GET("/instruments", ex.handleGetInstruments)
 	e.GET("/trades/:market", ex.handleGetTrades)
-	e.GET("/order/user/:userID", ex.handleGetOrders)
-	e.GET("/book/:market", ex.handleGetBook)
+	e.GET("/candles/:market", ex.handleGetCandles)
+	e.GET("/ticker", ex.handleGetTickers)
+	e.GET("/ticker/:market", ex.handleGetTicker)
+	e.GET("/depth/:market", ex.handleGetDepth)
 	e.GET("/book/:market/bestBid", ex.handleGetBestBid)
 	e.GET("/book/:market/bestAsk", ex.handleGetBestAsk)
 
-	e.POST("/order", ex.handlePlaceOrder)
-	e.DELETE("/order/:id", ex.cancelOrder)
+	e.GET("/ws/marketdata", ex.handleMarketData)
+	e.GET("/ws/orders", ex.handleOrderStream)
+
+	e.GET("/auction/:market", ex.handleGetAuction)
+	e.GET("/session/:market", ex.handleGetSession)
+	e.GET("/halts/:market", ex.handleGetHalts)
+
+	admin := e.Group("/admin", adminOnly(adminToken))
+	admin.GET("/book/:market", ex.handleGetBook)
+	admin.POST("/session/:market/halt", ex.handleHalt)
+	admin.POST("/session/:market/resume", ex.handleResume)
+	admin.POST("/apikeys", ex.handleAdminCreateAPIKey)
+	admin.GET("/apikeys", ex.handleAdminGetAPIKeys)
+	admin.DELETE("/apikeys/:id", ex.handleAdminRevokeAPIKey)
+	admin.POST("/users", ex.handleOnboardUser)
+	admin.GET("/users", ex.handleGetUsers)
+	admin.GET("/users/:userID", ex.handleGetUser)
+	admin.POST("/users/:userID/suspend", ex.handleSuspendUser)
+	admin.POST("/users/:userID/reactivate", ex.handleReactivateUser)
+	admin.POST("/users/:userID/close", ex.handleCloseUser)
+
+	// the requests on the orders and settings of a user have to be signed
+	// by the user or carry an API key of the user with the scope, the API
+	// keys themselves are only managed with signed requests.
+	e.GET("/order/user/:userID", ex.handleGetOrders, ex.authenticate(ScopeRead))
+	e.POST("/order", ex.handlePlaceOrder, ex.authenticate(ScopeTrade))
+	e.PUT("/order/:id", ex.handleAmendOrder, ex.authenticate(ScopeTrade))
+	e.DELETE("/order/:id", ex.cancelOrder, ex.authenticate(ScopeCancel))
+	e.PUT("/user/:userID/stp", ex.handleSetSelfTradePrevention, ex.authenticate(ScopeTrade))
+	e.POST("/apikeys", ex.handleCreateAPIKey, ex.authenticate(""))
+	e.GET("/apikeys", ex.handleGetAPIKeys, ex.authenticate(""))
+	e.DELETE("/apikeys/:id", ex.handleRevokeAPIKey, ex.authenticate(""))
+
+	ex.updateSessions()
+	go ex.runSessions(time.Second)
+	go ex.expireOrders(time.Second)
+	go ex.snapshotOrderbooks(interval)
+	for _, feed := range ex.feeds {
+		go feed.run()
+	}
 
 	e.Start(":3000")
 }
 
-func NewUser(privKey string, id string) *User {
-	pk, err := crypto.HexToECDSA(privKey)
-	if err != nil {
-		panic(err)
-	}
-	return &User{
-		ID:         id,
-		PrivateKey: pk,
-	}
-}
-
 func httpErrorHandler(err error, c echo.Context) {
 	fmt.Println(err)
 }
 
-func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error) {
+// NewExchange returns an exchange with one orderbook per instrument, each
+// market trading on the calendar.
+func NewExchange(privateKey string, client *ethclient.Client, instruments []*Instrument, calendar *Calendar) (*Exchange, error) {
 	orderbooks := make(map[Market]*orderbook.Orderbook)
-	orderbooks[MarketINN] = orderbook.NewOrderbook()
+	instrumentsByMarket := make(map[Market]*Instrument)
+	sessions := make(map[Market]*Session)
+	feeds := make(map[Market]*marketFeed)
+	// one generator numbers the orders and trades of all markets.
+	ids := orderbook.NewIDGenerator()
+	for _, in := range instruments {
+		ob := orderbook.NewOrderbookWithScale(in.Scale())
+		ob.IDs = ids
+		ob.Market = string(in.Market)
+		ob.Bands = in.PriceBands()
+		ob.ReferencePrice = in.ReferencePrice
+		orderbooks[in.Market] = ob
+		instrumentsByMarket[in.Market] = in
+		sessions[in.Market] = NewSession(in.Market, calendar, systemClock{})
+		feeds[in.Market] = newMarketFeed(in.Market, ob)
+
+		logrus.WithFields(logrus.Fields{
+			"market":   in.Market,
+			"tickSize": in.TickSize,
+			"lotSize":  in.LotSize,
+		}).Info("new market")
+	}
 
 	pk, err := crypto.HexToECDSA(privateKey)
 	if err != nil {
@@ -157,46 +357,123 @@ func NewExchange(privateKey string, client *ethclient.Client) (*Exchange, error)
 	}
 
 	return &Exchange{
-		Client:     client,
-		Users:      make(map[string]*User),
-		Orders:     make(map[string][]*orderbook.Order),
-		PrivateKey: pk,
-		orderbooks: orderbooks,
+		Client:      client,
+		Users:       make(map[string]*User),
+		Orders:      make(map[string][]*orderbook.Order),
+		Expired:     make(map[string][]*orderbook.Order),
+		PrivateKey:  pk,
+		orderbooks:  orderbooks,
+		instruments: instrumentsByMarket,
+		sessions:    sessions,
+		halts:       make(map[Market][]*Halt),
+		feeds:       feeds,
+		streams:     newOrderStreams(),
+		nonces:      newNonceCache(),
+		apiKeys:     newAPIKeyStore(),
 	}, nil
 }
 
+func getenv(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+func (ex *Exchange) handleGetInstruments(c echo.Context) error {
+	instruments := []*Instrument{}
+	for _, in := range ex.instruments {
+		instruments = append(instruments, in)
+	}
+	sort.Slice(instruments, func(i, j int) bool {
+		return instruments[i].Market < instruments[j].Market
+	})
+
+	return c.JSON(http.StatusOK, instruments)
+}
+
 func (ex *Exchange) handleGetTrades(c echo.Context) error {
 	market := Market(c.Param("market"))
 	ob, ok := ex.orderbooks[market]
 	if !ok {
 		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
 	}
-	return c.JSON(http.StatusOK, ob.Trades)
+
+	filter, err := tradeFilter(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusOK, publicTrades(ob.FilterTrades(filter)))
+}
+
+// tradeFilter reads the pagination of the trades from the query: the trades
+// after sequence number since, from and to (unix nano), and limit, which
+// defaults to defaultTradesLimit and cannot exceed maxTradesLimit.
+func tradeFilter(c echo.Context) (orderbook.TradeFilter, error) {
+	filter := orderbook.TradeFilter{Limit: defaultTradesLimit}
+
+	if since := c.QueryParam("since"); since != "" {
+		v, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid since: %s", since)
+		}
+		filter.Since = v
+	}
+	if from := c.QueryParam("from"); from != "" {
+		v, err := strconv.ParseInt(from, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid from: %s", from)
+		}
+		filter.From = v
+	}
+	if to := c.QueryParam("to"); to != "" {
+		v, err := strconv.ParseInt(to, 10, 64)
+		if err != nil {
+			return filter, fmt.Errorf("invalid to: %s", to)
+		}
+		filter.To = v
+	}
+	if limit := c.QueryParam("limit"); limit != "" {
+		v, err := strconv.Atoi(limit)
+		if err != nil || v <= 0 || v > maxTradesLimit {
+			return filter, fmt.Errorf("limit must be between 1 and %d", maxTradesLimit)
+		}
+		filter.Limit = v
+	}
+
+	return filter, nil
 }
 
 func (ex *Exchange) handleGetOrders(c echo.Context) error {
 	userID := c.Param("userID")
+	if userID != authUser(c) {
+		return forbidden(c, "cannot list the orders of user %s", userID)
+	}
 
 	ex.mu.RLock()
 
 	orderbookOrders := ex.Orders[userID]
 	orderResp := &GetOrdersResponse{
-		Asks: []Order{},
-		Bids: []Order{},
+		Asks:    []Order{},
+		Bids:    []Order{},
+		Stops:   []Order{},
+		Expired: []Order{},
 	}
 
 	for i := 0; i < len(orderbookOrders); i++ {
-		if orderbookOrders[i].Limit == nil {
+		// the books keep matching while we hold the exchange lock, the
+		// state of the order is read under the lock of its book.
+		state, ok := ex.orderState(orderbookOrders[i].ID)
+		if !ok {
 			continue
 		}
 
-		order := Order{
-			UserID:    orderbookOrders[i].UserID,
-			ID:        orderbookOrders[i].ID,
-			Price:     orderbookOrders[i].Limit.Price,
-			Size:      orderbookOrders[i].Size,
-			Bid:       orderbookOrders[i].Bid,
-			Timestamp: orderbookOrders[i].Timestamp,
+		order := newOrder(&state)
+
+		if state.Status == orderbook.StatusPending {
+			orderResp.Stops = append(orderResp.Stops, order)
+			continue
 		}
 
 		if order.Bid {
@@ -205,11 +482,39 @@ func (ex *Exchange) handleGetOrders(c echo.Context) error {
 			orderResp.Asks = append(orderResp.Asks, order)
 		}
 	}
+
+	for _, expiredOrder := range ex.Expired[userID] {
+		orderResp.Expired = append(orderResp.Expired, newOrder(expiredOrder))
+	}
 	ex.mu.RUnlock()
 
 	return c.JSON(http.StatusOK, orderResp)
 }
 
+func (t OrderType) isValid() bool {
+	return t == MarketOrder || t == LimitOrder || t == StopOrder || t == StopLimitOrder
+}
+
+// newOrder converts an orderbook order into its API representation.
+func newOrder(o *orderbook.Order) Order {
+	return Order{
+		UserID:      o.UserID,
+		ID:          o.ID,
+		Price:       o.Price,
+		Size:        o.Size,
+		Bid:         o.Bid,
+		Timestamp:   o.Timestamp,
+		TimeInForce: o.TimeInForce,
+		ExpiresAt:   o.ExpiresAt,
+		StopPrice:   o.StopPrice,
+		DisplaySize: o.DisplaySize,
+		Hidden:      o.Hidden,
+		Status:      o.Status,
+	}
+}
+
+// handleGetBook returns every order of the book with its user, it is only
+// served to admins. Everyone else gets the aggregated depth.
 func (ex *Exchange) handleGetBook(c echo.Context) error {
 	market := Market(c.Param("market"))
 	ob, ok := ex.orderbooks[market]
@@ -217,131 +522,307 @@ func (ex *Exchange) handleGetBook(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]any{"msg": "market not found"})
 	}
 
+	bids, asks := ob.Book(0)
 	orderbookData := OrderbookData{
-		TotalBidVolume: ob.BidTotalVolume(),
-		TotalAskVolume: ob.AskTotalVolume(),
-		Asks:           []*Order{},
-		Bids:           []*Order{},
-	}
-	for _, limit := range ob.Asks() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
+		Asks: []*Order{},
+		Bids: []*Order{},
+	}
+	for _, level := range asks {
+		orderbookData.TotalAskVolume = orderbookData.TotalAskVolume.Add(level.Volume)
+		for i := range level.Orders {
+			o := newOrder(&level.Orders[i])
 			orderbookData.Asks = append(orderbookData.Asks, &o)
 		}
 	}
 
-	for _, limit := range ob.Bids() {
-		for _, order := range limit.Orders {
-			o := Order{
-				UserID:    order.UserID,
-				ID:        order.ID,
-				Price:     limit.Price,
-				Size:      order.Size,
-				Bid:       order.Bid,
-				Timestamp: order.Timestamp,
-			}
+	for _, level := range bids {
+		orderbookData.TotalBidVolume = orderbookData.TotalBidVolume.Add(level.Volume)
+		for i := range level.Orders {
+			o := newOrder(&level.Orders[i])
 			orderbookData.Bids = append(orderbookData.Bids, &o)
 		}
 	}
 	return c.JSON(http.StatusOK, orderbookData)
 }
 
+// handleGetBestBid returns the best bid price and the volume at it.
 func (ex *Exchange) handleGetBestBid(c echo.Context) error {
+	return ex.handleGetBestPrice(c, true)
+}
 
+// handleGetBestAsk returns the best ask price and the volume at it.
+func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
+	return ex.handleGetBestPrice(c, false)
+}
+
+func (ex *Exchange) handleGetBestPrice(c echo.Context, bid bool) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
-	order := Order{}
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
 
-	if len(ob.Bids()) == 0 {
-		return c.JSON(http.StatusOK, order)
+	bids, asks := ob.Depth(1)
+	levels := asks
+	if bid {
+		levels = bids
 	}
-	bestLimit := ob.Bids()[0]
-	bestOrder := bestLimit.Orders[0]
 
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
-	order.ID = bestOrder.ID
-	order.Size = bestOrder.Size
-	order.Bid = bestOrder.Bid
-	order.Timestamp = bestOrder.Timestamp
+	res := BestPriceResponse{}
+	if len(levels) > 0 {
+		res.Price = levels[0].Price
+		res.Size = levels[0].Volume
+	}
 
-	return c.JSON(http.StatusOK, order)
+	return c.JSON(http.StatusOK, res)
+}
 
+// handleGetAuction returns the indicative uncrossing price and volume of a
+// market in a call auction.
+func (ex *Exchange) handleGetAuction(c echo.Context) error {
+	market := Market(c.Param("market"))
+	ob, ok := ex.orderbooks[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	res := AuctionResponse{}
+	if ob.InAuction() {
+		result := ob.IndicativePrice()
+		res = AuctionResponse{
+			InAuction: true,
+			Price:     result.Price,
+			Volume:    result.Volume,
+			Surplus:   result.Surplus,
+		}
+	}
+
+	return c.JSON(http.StatusOK, res)
 }
 
-func (ex *Exchange) handleGetBestAsk(c echo.Context) error {
+// handleGetSession returns the current phase of a market and its next
+// scheduled transition.
+func (ex *Exchange) handleGetSession(c echo.Context) error {
 	market := Market(c.Param("market"))
-	ob := ex.orderbooks[market]
-	order := Order{}
+	session, ok := ex.sessions[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	res := SessionResponse{
+		Market: market,
+		Phase:  session.Phase(),
+	}
+	next, at := session.NextTransition()
+	if !at.IsZero() {
+		res.NextPhase = next
+		res.NextTransition = at.UnixNano()
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
 
-	if len(ob.Asks()) == 0 {
-		return c.JSON(http.StatusOK, order)
+// handleHalt halts trading on a market until it is resumed.
+func (ex *Exchange) handleHalt(c echo.Context) error {
+	market := Market(c.Param("market"))
+	session, ok := ex.sessions[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	if session.Phase() == PhaseHalted {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("market %s is already halted", market)})
 	}
 
-	bestLimit := ob.Asks()[0]
-	bestOrder := bestLimit.Orders[0]
+	ex.haltMarket(market, "manual", 0)
+
+	return ex.handleGetSession(c)
+}
 
-	order.Price = bestLimit.Price
-	order.UserID = bestOrder.UserID
-	order.ID = bestOrder.ID
-	order.Size = bestOrder.Size
-	order.Bid = bestOrder.Bid
-	order.Timestamp = bestOrder.Timestamp
+// handleResume lifts the halt of a market, it goes back to its scheduled
+// phase right away.
+func (ex *Exchange) handleResume(c echo.Context) error {
+	market := Market(c.Param("market"))
+	session, ok := ex.sessions[market]
+	if !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "market not found"})
+	}
+
+	if session.Phase() != PhaseHalted {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("market %s is not halted", market)})
+	}
 
-	return c.JSON(http.StatusOK, order)
+	ex.resumeMarket(market)
 
+	return ex.handleGetSession(c)
 }
 
 func (ex *Exchange) cancelOrder(c echo.Context) error {
-	idStr := c.Param("id")
-	id, _ := strconv.Atoi(idStr)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid order id: %s", c.Param("id"))})
+	}
 
-	ob := ex.orderbooks[MarketINN]
-	order := ob.Orders[int64(id)]
-	ob.CancelOrder(order)
+	ob, order := ex.findOrder(id)
+	if order == nil {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("order not found: %d", id)})
+	}
+	if order.UserID != authUser(c) {
+		return forbidden(c, "order %d belongs to another user", id)
+	}
+	if phase := ex.sessions[ex.market(ob)].Phase(); !phase.CanCancel() {
+		return c.JSON(http.StatusBadRequest, APIError{
+			Code:  ErrCodeMarketPhase,
+			Error: fmt.Sprintf("orders cannot be cancelled during %s", phase),
+		})
+	}
+	if err := ob.CancelOrder(order); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	ex.streams.send(newOrderEvent(OrderCancelled, ex.market(ob), order))
 
 	log.Println("order cancelled id =>", id)
 
 	return c.JSON(200, map[string]any{"msg": fmt.Sprintf("order cancelled id => %d", id)})
 }
 
-func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder) {
+// handleAmendOrder changes the price and size of a resting limit order, see
+// orderbook.Orderbook.AmendOrder for how that affects its time priority.
+func (ex *Exchange) handleAmendOrder(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid order id: %s", c.Param("id"))})
+	}
+
+	var amendData AmendOrderRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&amendData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	ob, order := ex.findOrder(id)
+	if order == nil {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("order not found: %d", id)})
+	}
+	if order.UserID != authUser(c) {
+		return forbidden(c, "order %d belongs to another user", id)
+	}
+
+	market := ex.market(ob)
+	if phase := ex.sessions[market].Phase(); !phase.CanAmend() {
+		return c.JSON(http.StatusBadRequest, APIError{
+			Code:  ErrCodeMarketPhase,
+			Error: fmt.Sprintf("orders cannot be amended during %s", phase),
+		})
+	}
+
+	price := amendData.Price
+	if price.IsZero() {
+		price = order.Price
+	}
+	placeOrderData := PlaceOrderRequest{
+		UserID:      order.UserID,
+		Type:        LimitOrder,
+		Bid:         order.Bid,
+		Size:        amendData.Size,
+		Price:       price,
+		DisplaySize: order.DisplaySize,
+		Market:      market,
+	}
+	if err := ex.instruments[market].ValidateOrder(placeOrderData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	matches, err := ob.AmendOrder(order, price, amendData.Size)
+	if err != nil {
+		return ex.orderRejected(c, market, err)
+	}
+
+	if len(matches) > 0 || len(order.Prevented) > 0 {
+		ex.removeInactiveOrders()
+	}
+	ex.publishOrderEvents(market, order, matches)
+	if err := ex.handleMatches(matches); err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, newPlaceOrderResponse(order, amendData.Size))
+}
+
+// market returns the market of the orderbook.
+func (ex *Exchange) market(ob *orderbook.Orderbook) Market {
+	for market, book := range ex.orderbooks {
+		if book == ob {
+			return market
+		}
+	}
+	return ""
+}
+
+// findOrder returns the working order with the given id and the orderbook it
+// is in.
+func (ex *Exchange) findOrder(id int64) (*orderbook.Orderbook, *orderbook.Order) {
+	for _, ob := range ex.orderbooks {
+		if order, ok := ob.Order(id); ok {
+			return ob, order
+		}
+	}
+	return nil, nil
+}
+
+// orderState returns a copy of the working order with the ID, read under the
+// lock of the book it belongs to.
+func (ex *Exchange) orderState(id int64) (orderbook.Order, bool) {
+	for _, ob := range ex.orderbooks {
+		if order, ok := ob.OrderState(id); ok {
+			return order, true
+		}
+	}
+	return orderbook.Order{}, false
+}
+
+func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order) ([]orderbook.Match, []*MatchedOrder, error) {
 	ob := ex.orderbooks[market]
-	matches := ob.PlaceMarketOrder(order)
-	matchedOrders := make([]*MatchedOrder, len(matches))
+	matches, err := ob.PlaceMarketOrder(order)
+	if err != nil {
+		return nil, nil, err
+	}
+	matchedOrders := []*MatchedOrder{}
 
 	isBid := false
 	if order.Bid {
 		isBid = true
 	}
 
-	totalSizeFilled := 0.0
-	sumPrice := 0.0
-	for i := 0; i < len(matchedOrders); i++ {
-		limitUserID := matches[i].Bid.UserID
-		id := matches[i].Bid.ID
-		if isBid {
-			limitUserID = matches[i].Ask.UserID
-			id = matches[i].Ask.ID
+	totalSizeFilled := orderbook.Decimal{}
+	sumPrice := orderbook.Decimal{}
+	for _, match := range matches {
+		// matches of stop orders triggered by this order are settled
+		// like any other match but were not filled against this order.
+		if match.Bid != order && match.Ask != order {
+			continue
 		}
-		matchedOrders[i] = &MatchedOrder{
-			UserID: limitUserID,
-			ID:     id,
-			Size:   matches[i].Sizefilled,
-			Price:  matches[i].Price,
+
+		limitUserID := match.Bid.UserID
+		id := match.Bid.ID
+		if isBid {
+			limitUserID = match.Ask.UserID
+			id = match.Ask.ID
 		}
-		totalSizeFilled += matches[i].Sizefilled
-		sumPrice += matches[i].Price
+		matchedOrders = append(matchedOrders, &MatchedOrder{
+			UserID:  limitUserID,
+			ID:      id,
+			TradeID: match.TradeID,
+			Size:    match.Sizefilled,
+			Price:   match.Price,
+		})
+		totalSizeFilled = totalSizeFilled.Add(match.Sizefilled)
+		sumPrice = sumPrice.Add(match.Price)
 	}
 
-	avgPrice := sumPrice / float64(len(matches))
+	avgPrice := orderbook.Decimal{}
+	if len(matchedOrders) > 0 {
+		avgPrice = sumPrice.Div(orderbook.NewDecimal(int64(len(matchedOrders))))
+	}
 
 	logrus.WithFields(logrus.Fields{
 		"type":     order.Type(),
@@ -349,42 +830,77 @@ func (ex *Exchange) handlePlaceMarketOrder(market Market, order *orderbook.Order
 		"avgPrice": avgPrice,
 	}).Info("filled MARKET order")
 
-	newOrderMap := make(map[string][]*orderbook.Order)
+	ex.removeInactiveOrders()
 
-	ex.mu.Lock()
-	for userID, orderbookOrders := range ex.Orders {
-		for i := 0; i < len(orderbookOrders); i++ {
-			// If the order is not filled we place it in the map copy.
-			// this means that the size of the order == o
-			if !orderbookOrders[i].IsFilled() {
-				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
-
-			}
-		}
-	}
-
-	ex.Orders = newOrderMap
-	ex.mu.Unlock()
-
-	return matches, matchedOrders
+	return matches, matchedOrders, nil
 }
 
-func (ex *Exchange) handlePlaceLimitOrder(market Market, price float64, order *orderbook.Order) error {
+func (ex *Exchange) handlePlaceLimitOrder(market Market, price orderbook.Decimal, order *orderbook.Order) ([]orderbook.Match, error) {
 	ob := ex.orderbooks[market]
-	ob.PlaceLimitOrder(price, order)
+	matches, err := ob.PlaceLimitOrder(price, order)
+	if err != nil {
+		return nil, err
+	}
 
 	// keep track of user orders
 	ex.mu.Lock()
-	ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	if _, ok := ob.OrderState(order.ID); ok {
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	}
 	ex.mu.Unlock()
 
+	if len(matches) > 0 || len(order.Prevented) > 0 {
+		ex.removeInactiveOrders()
+	}
+
 	// logrus.WithFields(logrus.Fields{
 	// 	"type":  order.Type(),
 	// 	"price": order.Limit.Price,
 	// 	"size":  order.Size,
 	// }).Info("new LIMIT order")
 
-	return nil
+	return matches, nil
+}
+
+func (ex *Exchange) handlePlaceStopOrder(market Market, stopPrice, price orderbook.Decimal, order *orderbook.Order) ([]orderbook.Match, error) {
+	ob := ex.orderbooks[market]
+	matches, err := ob.PlaceStopOrder(stopPrice, price, order)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep track of user orders
+	ex.mu.Lock()
+	if _, ok := ob.OrderState(order.ID); ok {
+		ex.Orders[order.UserID] = append(ex.Orders[order.UserID], order)
+	}
+	ex.mu.Unlock()
+
+	if len(matches) > 0 || len(order.Prevented) > 0 {
+		ex.removeInactiveOrders()
+	}
+
+	return matches, nil
+}
+
+// removeInactiveOrders drops the orders that are no longer working in a book,
+// because they got filled, cancelled or expired, from the per user order lists.
+func (ex *Exchange) removeInactiveOrders() {
+	newOrderMap := make(map[string][]*orderbook.Order)
+
+	ex.mu.Lock()
+	for userID, orderbookOrders := range ex.Orders {
+		for i := 0; i < len(orderbookOrders); i++ {
+			// If the order is still working we place it in the map copy.
+			if _, ok := ex.orderState(orderbookOrders[i].ID); ok {
+				newOrderMap[userID] = append(newOrderMap[userID], orderbookOrders[i])
+
+			}
+		}
+	}
+
+	ex.Orders = newOrderMap
+	ex.mu.Unlock()
 }
 
 func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
@@ -394,40 +910,345 @@ func (ex *Exchange) handlePlaceOrder(c echo.Context) error {
 		return err
 	}
 
+	// the user defaults to the signer of the request.
+	if placeOrderData.UserID == "" {
+		placeOrderData.UserID = authUser(c)
+	}
+	if placeOrderData.UserID != authUser(c) {
+		return forbidden(c, "cannot place orders for user %s", placeOrderData.UserID)
+	}
+
 	market := Market(placeOrderData.Market)
+	if _, ok := ex.orderbooks[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	if !placeOrderData.Type.isValid() {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid order type: %s", placeOrderData.Type)})
+	}
+
+	if phase := ex.sessions[market].Phase(); !phase.CanPlace(placeOrderData.Type) {
+		return c.JSON(http.StatusBadRequest, APIError{
+			Code:  ErrCodeMarketPhase,
+			Error: fmt.Sprintf("%s orders are not accepted during %s", placeOrderData.Type, phase),
+		})
+	}
+
+	if err := ex.instruments[market].ValidateOrder(placeOrderData); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	if !placeOrderData.SelfTradePrevention.IsValid() {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid self-trade prevention mode: %s", placeOrderData.SelfTradePrevention)})
+	}
+
+	// the order is numbered by the book it is placed in, from the IDs of
+	// the exchange.
 	order := orderbook.NewOrder(placeOrderData.Bid, placeOrderData.Size, placeOrderData.UserID)
+	order.SelfTradePrevention = ex.selfTradePrevention(placeOrderData)
+
+	if placeOrderData.Type == LimitOrder || placeOrderData.Type == StopLimitOrder {
+		if err := validateTimeInForce(placeOrderData, order.Timestamp); err != nil {
+			return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+		}
+		order.TimeInForce = placeOrderData.TimeInForce
+		order.ExpiresAt = placeOrderData.ExpiresAt
+	}
+
+	if !placeOrderData.DisplaySize.IsZero() {
+		if placeOrderData.Type != LimitOrder && placeOrderData.Type != StopLimitOrder {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "display size is only allowed for limit orders"})
+		}
+		if placeOrderData.DisplaySize.GreaterThan(placeOrderData.Size) {
+			return c.JSON(http.StatusBadRequest, APIError{Error: "display size cannot be larger than the order size"})
+		}
+		order.DisplaySize = placeOrderData.DisplaySize
+	}
 
 	//Limit Orders
 	if placeOrderData.Type == LimitOrder {
-		if err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order); err != nil {
+		matches, err := ex.handlePlaceLimitOrder(market, placeOrderData.Price, order)
+		if err != nil {
+			ex.publishOrderRejected(market, order, err)
+			return ex.orderRejected(c, market, err)
+		}
+		ex.publishOrderEvents(market, order, matches)
+		if err := ex.handleMatches(matches); err != nil {
+			return err
+		}
+	}
+
+	//Stop and Stop Limit Orders
+	if placeOrderData.Type == StopOrder || placeOrderData.Type == StopLimitOrder {
+		price := orderbook.Decimal{}
+		if placeOrderData.Type == StopLimitOrder {
+			price = placeOrderData.Price
+		} else {
+			order.LiquidityPolicy = placeOrderData.LiquidityPolicy
+			order.ProtectionPrice = placeOrderData.ProtectionPrice
+		}
+
+		matches, err := ex.handlePlaceStopOrder(market, placeOrderData.StopPrice, price, order)
+		if err != nil {
+			return ex.orderRejected(c, market, err)
+		}
+		ex.publishOrderEvents(market, order, matches)
+		if err := ex.handleMatches(matches); err != nil {
 			return err
 		}
 	}
 
 	//Market Orders
 	if placeOrderData.Type == MarketOrder {
-		matches, _ := ex.handlePlaceMarketOrder(market, order)
+		order.LiquidityPolicy = placeOrderData.LiquidityPolicy
+		order.ProtectionPrice = placeOrderData.ProtectionPrice
+
+		matches, _, err := ex.handlePlaceMarketOrder(market, order)
+		if err != nil {
+			ex.publishOrderRejected(market, order, err)
+			return ex.orderRejected(c, market, err)
+		}
+		ex.publishOrderEvents(market, order, matches)
 		if err := ex.handleMatches(matches); err != nil {
 			return err
 		}
 
 	}
+
+	return c.JSON(http.StatusOK, newPlaceOrderResponse(order, placeOrderData.Size))
+}
+
+// orderRejected responds to an order the orderbook rejected. An order that
+// would have executed outside of the price bands halts the market when the
+// instrument says so.
+func (ex *Exchange) orderRejected(c echo.Context, market Market, err error) error {
+	var bandErr *orderbook.PriceBandError
+	if errors.As(err, &bandErr) {
+		in := ex.instruments[market]
+		if in.BandBreach == HaltOnBreach {
+			ex.haltMarket(market, err.Error(), time.Duration(in.HaltSeconds)*time.Second)
+		}
+		return c.JSON(http.StatusBadRequest, APIError{Code: ErrCodePriceBand, Error: err.Error()})
+	}
+
+	var liquidityErr *orderbook.InsufficientLiquidityError
+	if errors.As(err, &liquidityErr) {
+		return c.JSON(http.StatusBadRequest, APIError{Code: ErrCodeInsufficientLiquidity, Error: err.Error()})
+	}
+
+	return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+}
+
+// newPlaceOrderResponse returns the response for an order that was placed, or
+// amended, with the given size.
+func newPlaceOrderResponse(order *orderbook.Order, size orderbook.Decimal) *PlaceOrderResponse {
+	remaining := order.Size.Add(order.Hidden)
 	res := &PlaceOrderResponse{
-		OrderID: order.ID,
+		OrderID:          order.ID,
+		Status:           order.Status,
+		Filled:           size.Sub(remaining),
+		Remaining:        remaining,
+		PreventedMatches: []PreventedMatch{},
+	}
+	for _, p := range order.Prevented {
+		// the size decremented by self-trade prevention was not filled.
+		res.Filled = res.Filled.Sub(p.Size)
+		res.PreventedMatches = append(res.PreventedMatches, PreventedMatch{
+			RestingOrderID: p.Resting.ID,
+			RestingStatus:  p.Resting.Status,
+			Size:           p.Size,
+			Mode:           p.Mode,
+		})
 	}
 
-	return c.JSON(http.StatusOK, res)
+	return res
+}
+
+// selfTradePrevention returns the self-trade prevention mode of the order,
+// falling back to the mode of the user.
+func (ex *Exchange) selfTradePrevention(p PlaceOrderRequest) orderbook.SelfTradePrevention {
+	if p.SelfTradePrevention != "" {
+		return p.SelfTradePrevention
+	}
+
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	if user, ok := ex.Users[p.UserID]; ok {
+		return user.SelfTradePrevention
+	}
+	return ""
+}
+
+// handleSetSelfTradePrevention sets the self-trade prevention mode used for
+// the orders of a user that do not set one.
+func (ex *Exchange) handleSetSelfTradePrevention(c echo.Context) error {
+	userID := c.Param("userID")
+	if userID != authUser(c) {
+		return forbidden(c, "cannot change the settings of user %s", userID)
+	}
+
+	var req SelfTradePreventionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if !req.SelfTradePrevention.IsValid() {
+		return c.JSON(http.StatusBadRequest, APIError{Error: fmt.Sprintf("invalid self-trade prevention mode: %s", req.SelfTradePrevention)})
+	}
+
+	ex.mu.Lock()
+	user, ok := ex.Users[userID]
+	var err error
+	if ok {
+		user.SelfTradePrevention = req.SelfTradePrevention
+		err = ex.saveUsers()
+	}
+	ex.mu.Unlock()
+
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("user not found: %s", userID)})
+	}
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"userID": userID,
+		"mode":   req.SelfTradePrevention,
+	}).Info("self-trade prevention set")
+
+	return c.JSON(http.StatusOK, req)
+}
+
+func validateTimeInForce(p PlaceOrderRequest, now int64) error {
+	switch p.TimeInForce {
+	case "", orderbook.GoodTillCancel, orderbook.ImmediateOrCancel, orderbook.FillOrKill, orderbook.Day:
+		if p.ExpiresAt != 0 {
+			return fmt.Errorf("expiry time is only allowed for %s orders", orderbook.GoodTillDate)
+		}
+	case orderbook.GoodTillDate:
+		if p.ExpiresAt <= now {
+			return fmt.Errorf("%s order needs an expiry time in the future", orderbook.GoodTillDate)
+		}
+	default:
+		return fmt.Errorf("invalid time in force: %s", p.TimeInForce)
+	}
+	return nil
+}
+
+// expireOrders periodically removes the GTD and DAY orders that expired from
+// every orderbook and moves them to the owners expired orders.
+func (ex *Exchange) expireOrders(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for now := range ticker.C {
+		for market, ob := range ex.orderbooks {
+			expired, err := ob.ExpireOrders(now.UnixNano())
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"market": market,
+					"err":    err,
+				}).Error("expiring orders")
+				continue
+			}
+			if len(expired) == 0 {
+				continue
+			}
+
+			ex.mu.Lock()
+			for _, order := range expired {
+				ex.Expired[order.UserID] = append(ex.Expired[order.UserID], order)
+			}
+			ex.mu.Unlock()
+
+			for _, order := range expired {
+				ex.streams.send(newOrderEvent(OrderExpired, market, order))
+			}
+
+			ex.removeInactiveOrders()
+		}
+	}
+}
+
+// runSessions periodically moves every market to the phase its calendar
+// schedules.
+func (ex *Exchange) runSessions(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+
+	for range ticker.C {
+		ex.updateSessions()
+	}
+}
+
+func (ex *Exchange) updateSessions() {
+	for market, session := range ex.sessions {
+		ex.updateSession(market, session)
+	}
+}
+
+// updateSession moves the market to its scheduled phase. Entering an auction
+// phase puts the book into a call auction, leaving one uncrosses the book and
+// settles the auction trades.
+func (ex *Exchange) updateSession(market Market, session *Session) {
+	// a book whose journal failed takes no more commands, its market stays
+	// halted until the exchange is restarted from the journal.
+	ob := ex.orderbooks[market]
+	if err := ob.Err(); err != nil {
+		if session.Phase() != PhaseHalted {
+			ex.haltMarket(market, err.Error(), 0)
+		}
+		return
+	}
+
+	from, to, changed := session.Update()
+	if !changed {
+		return
+	}
+
+	// a book replayed from its journal can still be in the auction that
+	// was going on when the exchange stopped.
+	if ob.InAuction() && (from.isAuction() || !to.isAuction()) {
+		_, matches, err := ob.Uncross()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"market": market,
+				"err":    err,
+			}).Error("uncrossing the call auction")
+			return
+		}
+
+		ex.removeInactiveOrders()
+		ex.publishOrderEvents(market, nil, matches)
+		if err := ex.handleMatches(matches); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"market": market,
+				"err":    err,
+			}).Error("settling auction trades")
+		}
+	}
+	if to.isAuction() && !ob.InAuction() {
+		if err := ob.StartAuction(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"market": market,
+				"err":    err,
+			}).Error("starting the call auction")
+		}
+	}
 }
 
 func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
 	for _, match := range matches {
-		fromUser, ok := ex.Users[match.Ask.UserID]
-		if !ok {
+		// the users are only looked up under the lock, the transfer goes
+		// out to the chain without it.
+		ex.mu.RLock()
+		fromUser, fromOK := ex.Users[match.Ask.UserID]
+		toUser, toOK := ex.Users[match.Bid.UserID]
+		ex.mu.RUnlock()
+
+		if !fromOK {
 			return fmt.Errorf("user not found: %+v", match.Ask.UserID)
 		}
-
-		toUser, ok := ex.Users[match.Bid.UserID]
-		if !ok {
+		if !toOK {
 			return fmt.Errorf("user not found: %+v", match.Bid.UserID)
 		}
 
@@ -440,7 +1261,7 @@ func (ex *Exchange) handleMatches(matches []orderbook.Match) error {
 		// 	return fmt.Errorf("error casting public key to ECDSA")
 		// }
 
-		amount := big.NewInt(int64(match.Sizefilled))
+		amount := big.NewInt(match.Sizefilled.IntPart())
 
 		securitiesTransfer(ex.Client, fromUser.PrivateKey, toAddress, amount)
 
@@ -479,12 +1300,3 @@ func securitiesTransfer(client *ethclient.Client, fromPrivKey *ecdsa.PrivateKey,
 	return client.SendTransaction(ctx, signedTx)
 
 }
-
-func (ex *Exchange) registerUser(pk string, userId string) {
-	user := NewUser(pk, userId)
-	ex.Users[userId] = user
-
-	logrus.WithFields(logrus.Fields{
-		"id": userId,
-	}).Info("new exchange user")
-}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+func TestPlaceOrderUnknownType(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	ex := &Exchange{orderbooks: map[Market]*orderbook.Orderbook{MarketINN: ob}}
+
+	body := `{"UserID":"CSD000000000001-0001","Type":"LIMTI","Market":"INN","Size":10,"Price":100}`
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/order", bytes.NewReader([]byte(body))), rec)
+	c.Set(authUserKey, "CSD000000000001-0001")
+
+	if err := ex.handlePlaceOrder(c); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || len(ob.Orders) != 0 {
+		t.Errorf("got status %d with %d orders", rec.Code, len(ob.Orders))
+	}
+}
+
+func TestAmendOrder(t *testing.T) {
+	ob := orderbook.NewOrderbook()
+	in := &Instrument{
+		Market:         MarketINN,
+		TickSize:       orderbook.MustParseDecimal("0.01"),
+		LotSize:        orderbook.NewDecimal(1),
+		StaticBand:     orderbook.MustParseDecimal("0.1"),
+		ReferencePrice: orderbook.NewDecimal(100),
+	}
+	ob.Bands = in.PriceBands()
+	ob.ReferencePrice = in.ReferencePrice
+	ex := &Exchange{
+		orderbooks:  map[Market]*orderbook.Orderbook{MarketINN: ob},
+		instruments: map[Market]*Instrument{MarketINN: in},
+		sessions:    map[Market]*Session{MarketINN: {Market: MarketINN, phase: PhaseContinuous}},
+		streams:     newOrderStreams(),
+	}
+
+	bid := orderbook.NewOrder(true, orderbook.NewDecimal(10), "CSD000000000001-0001")
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), bid)
+	// the ask is outside of the band, it only rests as long as nothing
+	// trades with it.
+	ob.PlaceLimitOrder(orderbook.NewDecimal(130), orderbook.NewOrder(false, orderbook.NewDecimal(10), "CSD000000000002-0001"))
+
+	amend := func(userID, id, body string) *httptest.ResponseRecorder {
+		e := echo.New()
+		e.PUT("/order/:id", ex.handleAmendOrder, func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set(authUserKey, userID)
+				return next(c)
+			}
+		})
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/order/"+id, bytes.NewReader([]byte(body))))
+		return rec
+	}
+	id := strconv.FormatInt(bid.ID, 10)
+
+	rec := amend("CSD000000000001-0001", id, `{"Price":101,"Size":5}`)
+	if rec.Code != http.StatusOK || bid.Price != orderbook.NewDecimal(101) || bid.Size != orderbook.NewDecimal(5) {
+		t.Errorf("got status %d, order %+v", rec.Code, bid)
+	}
+
+	if rec := amend("CSD000000000002-0001", id, `{"Price":102,"Size":5}`); rec.Code != http.StatusForbidden {
+		t.Errorf("amend of another user's order: got status %d", rec.Code)
+	}
+	if rec := amend("CSD000000000001-0001", "999999", `{"Price":102,"Size":5}`); rec.Code != http.StatusNotFound {
+		t.Errorf("amend of an unknown order: got status %d", rec.Code)
+	}
+	if rec := amend("CSD000000000001-0001", "abc", `{"Price":102,"Size":5}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("amend of an invalid order id: got status %d", rec.Code)
+	}
+
+	rec = amend("CSD000000000001-0001", id, `{"Price":130,"Size":5}`)
+	res := APIError{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || res.Code != ErrCodePriceBand {
+		t.Errorf("amend outside of the band: got status %d %+v", rec.Code, res)
+	}
+	if bid.Price != orderbook.NewDecimal(101) || len(ob.Trades) != 0 {
+		t.Errorf("order changed by a rejected amend: %+v", bid)
+	}
+}
+
+func TestCancelOrderInvalidID(t *testing.T) {
+	ex := &Exchange{orderbooks: map[Market]*orderbook.Orderbook{MarketINN: orderbook.NewOrderbook()}}
+
+	e := echo.New()
+	e.DELETE("/order/:id", ex.cancelOrder)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/order/abc", nil))
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d", rec.Code)
+	}
+}
@@ -0,0 +1,324 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	PhasePreOpen        Phase = "PRE_OPEN"
+	PhaseOpeningAuction Phase = "OPENING_AUCTION"
+	PhaseContinuous     Phase = "CONTINUOUS"
+	PhaseClosingAuction Phase = "CLOSING_AUCTION"
+	PhaseClosed         Phase = "CLOSED"
+	PhaseHalted         Phase = "HALTED"
+)
+
+type (
+	// Phase is the trading phase of a market, it decides which actions the
+	// exchange accepts for the market.
+	Phase string
+
+	// Clock tells the time the sessions are driven by, tests swap it for a
+	// clock they can move forward.
+	Clock interface {
+		Now() time.Time
+	}
+
+	systemClock struct{}
+
+	// Calendar is the daily trading schedule of the markets. The times are
+	// "15:04" in Location and every phase lasts until the next one starts,
+	// the market is closed before PreOpen, after Close and on days that are
+	// not trading days.
+	Calendar struct {
+		Location       string // IANA time zone, UTC when empty
+		PreOpen        string
+		OpeningAuction string
+		Continuous     string
+		ClosingAuction string
+		Close          string
+		// TradingDays are weekday names like "Monday".
+		TradingDays []string
+		// Holidays are dates like "2006-01-02" the market stays closed.
+		Holidays []string
+
+		loc      *time.Location
+		schedule []transition
+		days     map[time.Weekday]bool
+		holidays map[string]bool
+	}
+
+	// transition is the start of a phase, as an offset from midnight.
+	transition struct {
+		offset time.Duration
+		phase  Phase
+	}
+
+	// Session is the phase state machine of one market. The phase follows
+	// the calendar, except while the market is halted.
+	Session struct {
+		Market   Market
+		calendar *Calendar
+		clock    Clock
+
+		mu     sync.RWMutex
+		phase  Phase
+		halted bool
+		// haltedUntil is when a halt ends by itself, zero for a halt
+		// that lasts until Resume.
+		haltedUntil time.Time
+	}
+
+	SessionResponse struct {
+		Market Market
+		Phase  Phase
+		// NextPhase starts at NextTransition (unix nano), the schedule
+		// does not move while the market is halted.
+		NextPhase      Phase
+		NextTransition int64
+	}
+)
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// LoadCalendar reads the trading calendar from a JSON file.
+func LoadCalendar(path string) (*Calendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	calendar := &Calendar{}
+	if err := json.NewDecoder(f).Decode(calendar); err != nil {
+		return nil, fmt.Errorf("decoding calendar file %s: %w", path, err)
+	}
+	if err := calendar.init(); err != nil {
+		return nil, fmt.Errorf("calendar file %s: %w", path, err)
+	}
+
+	return calendar, nil
+}
+
+// init parses and validates the schedule of the calendar.
+func (c *Calendar) init() error {
+	loc, err := time.LoadLocation(c.Location)
+	if err != nil {
+		return err
+	}
+	c.loc = loc
+
+	c.schedule = nil
+	times := []struct {
+		value string
+		phase Phase
+	}{
+		{c.PreOpen, PhasePreOpen},
+		{c.OpeningAuction, PhaseOpeningAuction},
+		{c.Continuous, PhaseContinuous},
+		{c.ClosingAuction, PhaseClosingAuction},
+		{c.Close, PhaseClosed},
+	}
+	for _, tt := range times {
+		t, err := time.Parse("15:04", tt.value)
+		if err != nil {
+			return fmt.Errorf("invalid start time %q of phase %s", tt.value, tt.phase)
+		}
+		offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+		if len(c.schedule) > 0 && offset <= c.schedule[len(c.schedule)-1].offset {
+			return fmt.Errorf("phase %s must start after phase %s", tt.phase, c.schedule[len(c.schedule)-1].phase)
+		}
+		c.schedule = append(c.schedule, transition{offset: offset, phase: tt.phase})
+	}
+
+	c.days = make(map[time.Weekday]bool)
+	for _, day := range c.TradingDays {
+		weekday, ok := weekdays[day]
+		if !ok {
+			return fmt.Errorf("invalid trading day: %s", day)
+		}
+		c.days[weekday] = true
+	}
+
+	c.holidays = make(map[string]bool)
+	for _, day := range c.Holidays {
+		if _, err := time.Parse(time.DateOnly, day); err != nil {
+			return fmt.Errorf("invalid holiday: %s", day)
+		}
+		c.holidays[day] = true
+	}
+
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"Sunday":    time.Sunday,
+	"Monday":    time.Monday,
+	"Tuesday":   time.Tuesday,
+	"Wednesday": time.Wednesday,
+	"Thursday":  time.Thursday,
+	"Friday":    time.Friday,
+	"Saturday":  time.Saturday,
+}
+
+// isTradingDay reports whether the market opens on the day of midnight.
+func (c *Calendar) isTradingDay(midnight time.Time) bool {
+	return c.days[midnight.Weekday()] && !c.holidays[midnight.Format(time.DateOnly)]
+}
+
+func (c *Calendar) midnight(t time.Time) time.Time {
+	y, m, d := t.In(c.loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, c.loc)
+}
+
+// PhaseAt returns the scheduled phase at t.
+func (c *Calendar) PhaseAt(t time.Time) Phase {
+	midnight := c.midnight(t)
+	if !c.isTradingDay(midnight) {
+		return PhaseClosed
+	}
+
+	phase := PhaseClosed
+	for _, tr := range c.schedule {
+		if t.Before(midnight.Add(tr.offset)) {
+			break
+		}
+		phase = tr.phase
+	}
+	return phase
+}
+
+// NextTransition returns the next scheduled phase after t and the time it
+// starts. It returns a zero time when the market does not open again within a
+// year.
+func (c *Calendar) NextTransition(t time.Time) (Phase, time.Time) {
+	midnight := c.midnight(t)
+	for day := 0; day <= 366; day++ {
+		date := midnight.AddDate(0, 0, day)
+		if !c.isTradingDay(date) {
+			continue
+		}
+		for _, tr := range c.schedule {
+			if start := date.Add(tr.offset); start.After(t) {
+				return tr.phase, start
+			}
+		}
+	}
+	return PhaseClosed, time.Time{}
+}
+
+// isAuction reports whether orders collect in a call auction during the
+// phase.
+func (p Phase) isAuction() bool {
+	return p == PhaseOpeningAuction || p == PhaseClosingAuction
+}
+
+// CanPlace reports whether orders of the given type are accepted during the
+// phase. The auctions accept every order type but market orders.
+func (p Phase) CanPlace(t OrderType) bool {
+	switch p {
+	case PhaseContinuous:
+		return true
+	case PhaseOpeningAuction, PhaseClosingAuction:
+		return t != MarketOrder
+	}
+	return false
+}
+
+// CanAmend reports whether resting orders can be amended during the phase.
+func (p Phase) CanAmend() bool {
+	return p == PhaseContinuous || p.isAuction()
+}
+
+// CanCancel reports whether orders can be cancelled during the phase, which
+// is always the case unless the market is closed.
+func (p Phase) CanCancel() bool {
+	return p != PhaseClosed
+}
+
+// NewSession returns the session of a market, its phase is set by the first
+// Update.
+func NewSession(market Market, calendar *Calendar, clock Clock) *Session {
+	return &Session{
+		Market:   market,
+		calendar: calendar,
+		clock:    clock,
+		phase:    PhaseClosed,
+	}
+}
+
+// Phase returns the current phase of the market.
+func (s *Session) Phase() Phase {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.halted {
+		return PhaseHalted
+	}
+	return s.phase
+}
+
+// Update moves the session to the phase the calendar schedules for now and
+// returns the phase it left. The session stays where it is while the market
+// is halted, the missed transitions are made by the first Update after Resume.
+func (s *Session) Update() (from, to Phase, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.halted && !s.haltedUntil.IsZero() && !s.clock.Now().Before(s.haltedUntil) {
+		s.halted = false
+
+		logrus.WithFields(logrus.Fields{
+			"market": s.Market,
+		}).Info("market halt ended")
+	}
+
+	if s.halted {
+		return s.phase, s.phase, false
+	}
+
+	from = s.phase
+	s.phase = s.calendar.PhaseAt(s.clock.Now())
+	if s.phase == from {
+		return from, from, false
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"market": s.Market,
+		"from":   from,
+		"to":     s.phase,
+	}).Info("market phase changed")
+
+	return from, s.phase, true
+}
+
+// Halt stops trading on the market until Resume, or until the first Update at
+// or after until when it is not zero.
+func (s *Session) Halt(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halted = true
+	s.haltedUntil = until
+}
+
+// Resume lifts a halt, the next Update returns the market to its scheduled
+// phase.
+func (s *Session) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.halted = false
+	s.haltedUntil = time.Time{}
+}
+
+// NextTransition returns the next scheduled phase and the time it starts.
+func (s *Session) NextTransition() (Phase, time.Time) {
+	return s.calendar.NextTransition(s.clock.Now())
+}
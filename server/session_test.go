@@ -0,0 +1,159 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) forward(d time.Duration) { c.now = c.now.Add(d) }
+
+func testCalendar(t *testing.T) *Calendar {
+	calendar := &Calendar{
+		PreOpen:        "07:30",
+		OpeningAuction: "07:50",
+		Continuous:     "08:00",
+		ClosingAuction: "16:30",
+		Close:          "16:35",
+		TradingDays:    []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday"},
+		Holidays:       []string{"2026-12-25"},
+	}
+	if err := calendar.init(); err != nil {
+		t.Fatal(err)
+	}
+	return calendar
+}
+
+func TestSessionPhases(t *testing.T) {
+	// Monday
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC)}
+	session := NewSession(MarketINN, testCalendar(t), clock)
+
+	steps := []struct {
+		forward time.Duration
+		phase   Phase
+	}{
+		{0, PhaseClosed},
+		{30 * time.Minute, PhasePreOpen},
+		{20 * time.Minute, PhaseOpeningAuction},
+		{10 * time.Minute, PhaseContinuous},
+		{8*time.Hour + 30*time.Minute, PhaseClosingAuction},
+		{5 * time.Minute, PhaseClosed},
+	}
+
+	for _, step := range steps {
+		clock.forward(step.forward)
+		session.Update()
+		if phase := session.Phase(); phase != step.phase {
+			t.Errorf("%s: phase %s != %s", clock.now, phase, step.phase)
+		}
+	}
+}
+
+func TestSessionUpdate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 7, 55, 0, 0, time.UTC)}
+	session := NewSession(MarketINN, testCalendar(t), clock)
+
+	from, to, changed := session.Update()
+	if from != PhaseClosed || to != PhaseOpeningAuction || !changed {
+		t.Errorf("unexpected transition %s -> %s (%v)", from, to, changed)
+	}
+
+	if _, _, changed := session.Update(); changed {
+		t.Errorf("phase changed without the clock moving")
+	}
+}
+
+func TestSessionHalt(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)}
+	session := NewSession(MarketINN, testCalendar(t), clock)
+	session.Update()
+
+	session.Halt(time.Time{})
+	if session.Phase() != PhaseHalted {
+		t.Errorf("phase %s != %s", session.Phase(), PhaseHalted)
+	}
+
+	// the closing auction starts while the market is halted.
+	clock.forward(7*time.Hour + 31*time.Minute)
+	if _, _, changed := session.Update(); changed {
+		t.Errorf("phase changed while halted")
+	}
+
+	session.Resume()
+	from, to, changed := session.Update()
+	if from != PhaseContinuous || to != PhaseClosingAuction || !changed {
+		t.Errorf("unexpected transition %s -> %s (%v)", from, to, changed)
+	}
+}
+
+func TestCalendarNextTransition(t *testing.T) {
+	calendar := testCalendar(t)
+
+	tests := []struct {
+		now   time.Time
+		phase Phase
+		at    time.Time
+	}{
+		// Monday morning
+		{time.Date(2026, 10, 19, 7, 0, 0, 0, time.UTC), PhasePreOpen, time.Date(2026, 10, 19, 7, 30, 0, 0, time.UTC)},
+		// Friday after the close, the market opens again on Monday
+		{time.Date(2026, 10, 23, 17, 0, 0, 0, time.UTC), PhasePreOpen, time.Date(2026, 10, 26, 7, 30, 0, 0, time.UTC)},
+		// Thursday before a Christmas Friday
+		{time.Date(2026, 12, 24, 16, 35, 0, 0, time.UTC), PhasePreOpen, time.Date(2026, 12, 28, 7, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		phase, at := calendar.NextTransition(tt.now)
+		if phase != tt.phase || !at.Equal(tt.at) {
+			t.Errorf("%s: next transition %s at %s, expected %s at %s", tt.now, phase, at, tt.phase, tt.at)
+		}
+	}
+
+	if phase := calendar.PhaseAt(time.Date(2026, 12, 25, 10, 0, 0, 0, time.UTC)); phase != PhaseClosed {
+		t.Errorf("phase on a holiday %s != %s", phase, PhaseClosed)
+	}
+}
+
+func TestPhaseActions(t *testing.T) {
+	assertAllowed := func(what string, allowed, expected bool) {
+		t.Helper()
+		if allowed != expected {
+			t.Errorf("%s: allowed %v != %v", what, allowed, expected)
+		}
+	}
+
+	assertAllowed("market order in continuous", PhaseContinuous.CanPlace(MarketOrder), true)
+	assertAllowed("market order in auction", PhaseOpeningAuction.CanPlace(MarketOrder), false)
+	assertAllowed("limit order in auction", PhaseClosingAuction.CanPlace(LimitOrder), true)
+	assertAllowed("limit order in pre-open", PhasePreOpen.CanPlace(LimitOrder), false)
+	assertAllowed("limit order while halted", PhaseHalted.CanPlace(LimitOrder), false)
+	assertAllowed("amend while halted", PhaseHalted.CanAmend(), false)
+	assertAllowed("cancel while halted", PhaseHalted.CanCancel(), true)
+	assertAllowed("cancel when closed", PhaseClosed.CanCancel(), false)
+}
+
+func TestSessionHaltUntil(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC)}
+	session := NewSession(MarketINN, testCalendar(t), clock)
+	session.Update()
+
+	session.Halt(clock.now.Add(5 * time.Minute))
+
+	clock.forward(4 * time.Minute)
+	session.Update()
+	if session.Phase() != PhaseHalted {
+		t.Errorf("phase %s != %s", session.Phase(), PhaseHalted)
+	}
+
+	clock.forward(time.Minute)
+	session.Update()
+	if session.Phase() != PhaseContinuous {
+		t.Errorf("phase %s != %s", session.Phase(), PhaseContinuous)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+// tickerWindow is the period the statistics of a ticker cover.
+const tickerWindow = 24 * time.Hour
+
+var hundred = orderbook.NewDecimal(100)
+
+type (
+	// Ticker holds the statistics of the trades of a market in the last 24
+	// hours. Open is the price of the first trade in the window, Change the
+	// change from it to LastPrice in percent and VWAP the volume weighted
+	// average price. LastPrice is kept when the window is empty.
+	Ticker struct {
+		Market      Market
+		LastPrice   orderbook.Decimal
+		Open        orderbook.Decimal
+		High        orderbook.Decimal
+		Low         orderbook.Decimal
+		Volume      orderbook.Decimal
+		QuoteVolume orderbook.Decimal
+		VWAP        orderbook.Decimal
+		Change      orderbook.Decimal
+		BestBid     orderbook.Decimal
+		BestAsk     orderbook.Decimal
+		Trades      int
+		Timestamp   int64
+	}
+
+	tickerTrade struct {
+		seq       uint64
+		timestamp int64
+		price     orderbook.Decimal
+		size      orderbook.Decimal
+	}
+
+	// ticker maintains the statistics of the trades in the window as
+	// trades come in and leave it. highs and lows are the trades that can
+	// still become the high or low of the window: their prices decrease
+	// (increase) from the front, which is the high (low).
+	ticker struct {
+		mu          sync.Mutex
+		window      []tickerTrade
+		highs       []tickerTrade
+		lows        []tickerTrade
+		last        orderbook.Decimal
+		volume      orderbook.Decimal
+		quoteVolume orderbook.Decimal
+	}
+)
+
+func newTicker() *ticker {
+	return &ticker{}
+}
+
+// add adds the trades, ordered by sequence number, to the window.
+func (t *ticker) add(trades []*orderbook.Trade) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, trade := range trades {
+		tt := tickerTrade{
+			seq:       trade.Seq,
+			timestamp: trade.Timestamp,
+			price:     trade.Price,
+			size:      trade.Size,
+		}
+		t.window = append(t.window, tt)
+		t.last = trade.Price
+		t.volume = t.volume.Add(trade.Size)
+		t.quoteVolume = t.quoteVolume.Add(trade.Price.Mul(trade.Size))
+
+		for len(t.highs) > 0 && t.highs[len(t.highs)-1].price.Cmp(tt.price) <= 0 {
+			t.highs = t.highs[:len(t.highs)-1]
+		}
+		t.highs = append(t.highs, tt)
+		for len(t.lows) > 0 && t.lows[len(t.lows)-1].price.Cmp(tt.price) >= 0 {
+			t.lows = t.lows[:len(t.lows)-1]
+		}
+		t.lows = append(t.lows, tt)
+	}
+}
+
+// evict removes the trades that left the window at now.
+func (t *ticker) evict(now time.Time) {
+	cutoff := now.Add(-tickerWindow).UnixNano()
+
+	n := sort.Search(len(t.window), func(i int) bool {
+		return t.window[i].timestamp >= cutoff
+	})
+	for _, tt := range t.window[:n] {
+		t.volume = t.volume.Sub(tt.size)
+		t.quoteVolume = t.quoteVolume.Sub(tt.price.Mul(tt.size))
+		if len(t.highs) > 0 && t.highs[0].seq == tt.seq {
+			t.highs = t.highs[1:]
+		}
+		if len(t.lows) > 0 && t.lows[0].seq == tt.seq {
+			t.lows = t.lows[1:]
+		}
+	}
+	t.window = t.window[n:]
+}
+
+// stats returns the ticker of the window ending at now, without the best bid
+// and ask.
+func (t *ticker) stats(market Market, now time.Time) Ticker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.evict(now)
+
+	s := Ticker{
+		Market:      market,
+		LastPrice:   t.last,
+		Volume:      t.volume,
+		QuoteVolume: t.quoteVolume,
+		Trades:      len(t.window),
+		Timestamp:   now.UnixNano(),
+	}
+	if len(t.window) > 0 {
+		s.Open = t.window[0].price
+		s.High = t.highs[0].price
+		s.Low = t.lows[0].price
+		if !t.volume.IsZero() {
+			s.VWAP = t.quoteVolume.Div(t.volume)
+		}
+		if !s.Open.IsZero() {
+			s.Change = s.LastPrice.Sub(s.Open).Mul(hundred).Div(s.Open)
+		}
+	}
+
+	return s
+}
+
+// ticker returns the ticker of a market with the best bid and ask of the book.
+func (ex *Exchange) ticker(market Market, now time.Time) Ticker {
+	s := ex.feeds[market].ticker.stats(market, now)
+
+	bids, asks := ex.orderbooks[market].Depth(1)
+	if len(bids) > 0 {
+		s.BestBid = bids[0].Price
+	}
+	if len(asks) > 0 {
+		s.BestAsk = asks[0].Price
+	}
+
+	return s
+}
+
+func (ex *Exchange) handleGetTicker(c echo.Context) error {
+	market := Market(c.Param("market"))
+	if _, ok := ex.feeds[market]; !ok {
+		return c.JSON(http.StatusBadRequest, APIError{Error: "orderbook not found"})
+	}
+
+	return c.JSON(http.StatusOK, ex.ticker(market, time.Now()))
+}
+
+// handleGetTickers returns the tickers of every market, ordered by market.
+func (ex *Exchange) handleGetTickers(c echo.Context) error {
+	markets := make([]Market, 0, len(ex.feeds))
+	for market := range ex.feeds {
+		markets = append(markets, market)
+	}
+	sort.Slice(markets, func(i, j int) bool { return markets[i] < markets[j] })
+
+	now := time.Now()
+	tickers := make([]Ticker, 0, len(markets))
+	for _, market := range markets {
+		tickers = append(tickers, ex.ticker(market, now))
+	}
+
+	return c.JSON(http.StatusOK, tickers)
+}
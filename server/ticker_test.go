@@ -0,0 +1,57 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+)
+
+func TestTicker(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	trade := func(seq uint64, ago time.Duration, price, size int64) *orderbook.Trade {
+		return &orderbook.Trade{
+			Seq:       seq,
+			Timestamp: now.Add(-ago).UnixNano(),
+			Price:     orderbook.NewDecimal(price),
+			Size:      orderbook.NewDecimal(size),
+		}
+	}
+
+	tk := newTicker()
+	tk.add([]*orderbook.Trade{
+		trade(1, 25*time.Hour, 200, 10),
+		trade(2, 23*time.Hour, 100, 10),
+		trade(3, 12*time.Hour, 90, 10),
+		trade(4, time.Hour, 120, 20),
+	})
+
+	s := tk.stats(MarketINN, now)
+	expected := Ticker{
+		Market:      MarketINN,
+		LastPrice:   orderbook.NewDecimal(120),
+		Open:        orderbook.NewDecimal(100),
+		High:        orderbook.NewDecimal(120),
+		Low:         orderbook.NewDecimal(90),
+		Volume:      orderbook.NewDecimal(40),
+		QuoteVolume: orderbook.NewDecimal(4300),
+		VWAP:        orderbook.MustParseDecimal("107.5"),
+		Change:      orderbook.NewDecimal(20),
+		Trades:      3,
+		Timestamp:   now.UnixNano(),
+	}
+	if s != expected {
+		t.Errorf("got %+v, expected %+v", s, expected)
+	}
+
+	// the low leaves the window.
+	s = tk.stats(MarketINN, now.Add(13*time.Hour))
+	if s.Trades != 1 || s.Low != orderbook.NewDecimal(120) || s.Open != orderbook.NewDecimal(120) || !s.Change.IsZero() {
+		t.Errorf("unexpected ticker %+v", s)
+	}
+
+	s = tk.stats(MarketINN, now.Add(48*time.Hour))
+	if s.Trades != 0 || !s.Volume.IsZero() || !s.High.IsZero() || s.LastPrice != orderbook.NewDecimal(120) {
+		t.Errorf("unexpected ticker of an empty window %+v", s)
+	}
+}
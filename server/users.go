@@ -0,0 +1,394 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// UserActive users can trade.
+	UserActive UserStatus = "ACTIVE"
+	// UserSuspended users can only read and cancel their orders.
+	UserSuspended UserStatus = "SUSPENDED"
+	// UserClosed users cannot do anything anymore, closing an account
+	// cancels its orders and revokes its API keys.
+	UserClosed UserStatus = "CLOSED"
+)
+
+// userIDPattern is the format of the CSD account ID of a user, like
+// CSD000000000001-0001.
+var userIDPattern = regexp.MustCompile(`^CSD\d{12}-\d{4}$`)
+
+// envUsers are imported from the private keys in the environment when they are
+// not registered yet, the way the exchange used to bootstrap its users.
+var envUsers = []struct {
+	env string
+	id  string
+}{
+	{"USER_1_PK", "CSD000000000001-0001"},
+	{"USER_2_PK", "CSD000000000002-0001"},
+	{"USER_3_PK", "CSD000000000003-0001"},
+}
+
+type (
+	UserStatus string
+
+	// OnboardUserRequest registers a user. PrivateKey is the hex encoded
+	// secp256k1 key of the user, a new key is generated when it is empty.
+	OnboardUserRequest struct {
+		ID         string
+		PrivateKey string
+	}
+
+	// UserResponse is a user without its private key, Address is the
+	// address of its key.
+	UserResponse struct {
+		ID                  string
+		Address             string
+		Status              UserStatus
+		SelfTradePrevention orderbook.SelfTradePrevention
+		CreatedAt           int64
+	}
+
+	// OnboardUserResponse holds the registered user. PrivateKey is only
+	// set for a generated key and is not shown again.
+	OnboardUserResponse struct {
+		UserResponse
+		PrivateKey string `json:",omitzero"`
+	}
+
+	// userRecord is a user as it is stored.
+	userRecord struct {
+		ID                  string
+		PrivateKey          string
+		Status              UserStatus
+		SelfTradePrevention orderbook.SelfTradePrevention
+		CreatedAt           int64
+	}
+)
+
+// NewUser returns an active user with the hex encoded private key. It fails
+// when the ID is not a CSD account ID or the key is invalid.
+func NewUser(privKey string, id string) (*User, error) {
+	if !userIDPattern.MatchString(id) {
+		return nil, fmt.Errorf("invalid user id: %s, expected a CSD account id like CSD000000000001-0001", id)
+	}
+	pk, err := crypto.HexToECDSA(privKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key of user %s: %w", id, err)
+	}
+
+	return &User{
+		ID:         id,
+		PrivateKey: pk,
+		Status:     UserActive,
+		CreatedAt:  time.Now().UnixNano(),
+	}, nil
+}
+
+func newUserResponse(user *User) UserResponse {
+	return UserResponse{
+		ID:                  user.ID,
+		Address:             crypto.PubkeyToAddress(user.PrivateKey.PublicKey).Hex(),
+		Status:              user.Status,
+		SelfTradePrevention: user.SelfTradePrevention,
+		CreatedAt:           user.CreatedAt,
+	}
+}
+
+// openUsers loads the users persisted to the file at path and keeps persisting
+// them to it. A missing file has no users.
+func (ex *Exchange) openUsers(path string) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	ex.usersPath = path
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	records := []userRecord{}
+	if err := json.Unmarshal(b, &records); err != nil {
+		return fmt.Errorf("user file %s: %w", path, err)
+	}
+	for _, record := range records {
+		user, err := NewUser(record.PrivateKey, record.ID)
+		if err != nil {
+			return fmt.Errorf("user file %s: %w", path, err)
+		}
+		user.Status = record.Status
+		user.SelfTradePrevention = record.SelfTradePrevention
+		user.CreatedAt = record.CreatedAt
+		ex.Users[user.ID] = user
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"users": len(records),
+	}).Info("users loaded")
+
+	return nil
+}
+
+// saveUsers writes the users to the user file, the caller holds ex.mu. The
+// file holds the private keys of the users, it is only readable by the owner.
+func (ex *Exchange) saveUsers() error {
+	if ex.usersPath == "" {
+		return nil
+	}
+
+	records := make([]userRecord, 0, len(ex.Users))
+	for _, user := range ex.Users {
+		records = append(records, userRecord{
+			ID:                  user.ID,
+			PrivateKey:          hex.EncodeToString(crypto.FromECDSA(user.PrivateKey)),
+			Status:              user.Status,
+			SelfTradePrevention: user.SelfTradePrevention,
+			CreatedAt:           user.CreatedAt,
+		})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+
+	b, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ex.usersPath, b)
+}
+
+// registerUser adds the user to the exchange, it fails when the ID is taken.
+func (ex *Exchange) registerUser(user *User) error {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	if _, ok := ex.Users[user.ID]; ok {
+		return fmt.Errorf("user already exists: %s", user.ID)
+	}
+
+	ex.Users[user.ID] = user
+	if err := ex.saveUsers(); err != nil {
+		delete(ex.Users, user.ID)
+		return err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id": user.ID,
+	}).Info("new exchange user")
+
+	return nil
+}
+
+// importEnvUsers registers the users of envUsers that have a private key in
+// the environment and are not registered yet.
+func (ex *Exchange) importEnvUsers() {
+	for _, u := range envUsers {
+		pk := os.Getenv(u.env)
+		if pk == "" {
+			continue
+		}
+
+		ex.mu.RLock()
+		_, ok := ex.Users[u.id]
+		ex.mu.RUnlock()
+		if ok {
+			continue
+		}
+
+		user, err := NewUser(pk, u.id)
+		if err == nil {
+			err = ex.registerUser(user)
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"env": u.env,
+				"err": err,
+			}).Error("importing user")
+		}
+	}
+}
+
+// userStatus returns the status of the user, false when it does not exist.
+func (ex *Exchange) userStatus(userID string) (UserStatus, bool) {
+	ex.mu.RLock()
+	defer ex.mu.RUnlock()
+
+	user, ok := ex.Users[userID]
+	if !ok {
+		return "", false
+	}
+	if user.Status == "" {
+		return UserActive, true
+	}
+	return user.Status, true
+}
+
+// setUserStatus moves the user from one of the statuses in from to the status
+// to.
+func (ex *Exchange) setUserStatus(userID string, to UserStatus, from ...UserStatus) (*User, int, error) {
+	ex.mu.Lock()
+	defer ex.mu.Unlock()
+
+	user, ok := ex.Users[userID]
+	if !ok {
+		return nil, http.StatusNotFound, fmt.Errorf("user not found: %s", userID)
+	}
+
+	status := user.Status
+	if status == "" {
+		status = UserActive
+	}
+	allowed := false
+	for _, s := range from {
+		allowed = allowed || s == status
+	}
+	if !allowed {
+		return nil, http.StatusConflict, fmt.Errorf("user %s is %s", userID, status)
+	}
+
+	user.Status = to
+	if err := ex.saveUsers(); err != nil {
+		user.Status = status
+		return nil, http.StatusInternalServerError, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":     userID,
+		"from":   status,
+		"status": to,
+	}).Info("user status changed")
+
+	return user, http.StatusOK, nil
+}
+
+// closeUserAccount cancels the working orders and revokes the API keys of a
+// closed user.
+func (ex *Exchange) closeUserAccount(userID string) {
+	ex.mu.RLock()
+	orders := append([]*orderbook.Order{}, ex.Orders[userID]...)
+	ex.mu.RUnlock()
+
+	for _, order := range orders {
+		ob, working := ex.findOrder(order.ID)
+		if working == nil {
+			continue
+		}
+		// the order can fill between the lookup and the cancel.
+		if err := ob.CancelOrder(working); err != nil {
+			continue
+		}
+		ex.streams.send(newOrderEvent(OrderCancelled, ex.market(ob), working))
+	}
+	ex.removeInactiveOrders()
+
+	now := time.Now()
+	for _, key := range ex.apiKeys.list(userID) {
+		if _, err := ex.apiKeys.revoke(key.ID, now); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"apiKey": key.ID,
+				"err":    err,
+			}).Error("revoking api key")
+		}
+	}
+}
+
+// handleOnboardUser registers a user with an imported or generated key.
+func (ex *Exchange) handleOnboardUser(c echo.Context) error {
+	var req OnboardUserRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+
+	generated := req.PrivateKey == ""
+	if generated {
+		key, err := crypto.GenerateKey()
+		if err != nil {
+			return err
+		}
+		req.PrivateKey = hex.EncodeToString(crypto.FromECDSA(key))
+	}
+
+	user, err := NewUser(req.PrivateKey, req.ID)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APIError{Error: err.Error()})
+	}
+	if err := ex.registerUser(user); err != nil {
+		return c.JSON(http.StatusConflict, APIError{Error: err.Error()})
+	}
+
+	res := OnboardUserResponse{UserResponse: newUserResponse(user)}
+	if generated {
+		res.PrivateKey = req.PrivateKey
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// handleGetUsers returns every user, ordered by ID.
+func (ex *Exchange) handleGetUsers(c echo.Context) error {
+	ex.mu.RLock()
+	users := make([]UserResponse, 0, len(ex.Users))
+	for _, user := range ex.Users {
+		users = append(users, newUserResponse(user))
+	}
+	ex.mu.RUnlock()
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	return c.JSON(http.StatusOK, users)
+}
+
+func (ex *Exchange) handleGetUser(c echo.Context) error {
+	ex.mu.RLock()
+	user, ok := ex.Users[c.Param("userID")]
+	var res UserResponse
+	if ok {
+		res = newUserResponse(user)
+	}
+	ex.mu.RUnlock()
+
+	if !ok {
+		return c.JSON(http.StatusNotFound, APIError{Error: fmt.Sprintf("user not found: %s", c.Param("userID"))})
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// handleSuspendUser stops an active user from trading.
+func (ex *Exchange) handleSuspendUser(c echo.Context) error {
+	return ex.changeUserStatus(c, UserSuspended, UserActive)
+}
+
+// handleReactivateUser lets a suspended user trade again.
+func (ex *Exchange) handleReactivateUser(c echo.Context) error {
+	return ex.changeUserStatus(c, UserActive, UserSuspended)
+}
+
+// handleCloseUser closes the account of a user for good.
+func (ex *Exchange) handleCloseUser(c echo.Context) error {
+	return ex.changeUserStatus(c, UserClosed, UserActive, UserSuspended)
+}
+
+func (ex *Exchange) changeUserStatus(c echo.Context, to UserStatus, from ...UserStatus) error {
+	userID := c.Param("userID")
+	if _, code, err := ex.setUserStatus(userID, to, from...); err != nil {
+		return c.JSON(code, APIError{Error: err.Error()})
+	}
+	if to == UserClosed {
+		ex.closeUserAccount(userID)
+	}
+
+	return ex.handleGetUser(c)
+}
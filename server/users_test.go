@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bruce-mig/stock-exchange/orderbook"
+	"github.com/labstack/echo/v4"
+)
+
+func TestNewUser(t *testing.T) {
+	pk := "4f3edf983ac636a65a842ce7c78d9aa706d3b113bce9c46f30d7d21715b23b1d"
+
+	if _, err := NewUser(pk, "CSD000000000001-0001"); err != nil {
+		t.Errorf("valid user rejected: %v", err)
+	}
+	for _, id := range []string{"", "CSD1-0001", "CSD000000000001-001", "csd000000000001-0001", "CSD000000000001-0001 "} {
+		if _, err := NewUser(pk, id); err == nil {
+			t.Errorf("invalid id %q accepted", id)
+		}
+	}
+	if _, err := NewUser("not a key", "CSD000000000001-0001"); err == nil {
+		t.Errorf("invalid key accepted")
+	}
+}
+
+func TestUserLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	newExchange := func() *Exchange {
+		ex := &Exchange{
+			Users:      make(map[string]*User),
+			Orders:     make(map[string][]*orderbook.Order),
+			orderbooks: map[Market]*orderbook.Orderbook{MarketINN: orderbook.NewOrderbook()},
+			streams:    newOrderStreams(),
+			apiKeys:    newAPIKeyStore(),
+			nonces:     newNonceCache(),
+		}
+		if err := ex.openUsers(path); err != nil {
+			t.Fatal(err)
+		}
+		return ex
+	}
+	ex := newExchange()
+
+	e := echo.New()
+	e.POST("/admin/users", ex.handleOnboardUser)
+	e.POST("/admin/users/:userID/suspend", ex.handleSuspendUser)
+	e.POST("/admin/users/:userID/reactivate", ex.handleReactivateUser)
+	e.POST("/admin/users/:userID/close", ex.handleCloseUser)
+	post := func(path, body string) (int, []byte) {
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body))))
+		return rec.Code, rec.Body.Bytes()
+	}
+
+	user := "CSD000000000001-0001"
+	code, body := post("/admin/users", `{"ID":"`+user+`"}`)
+	res := OnboardUserResponse{}
+	if err := json.Unmarshal(body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || res.Status != UserActive || res.PrivateKey == "" || res.Address == "" {
+		t.Fatalf("unexpected onboarding %d %s", code, body)
+	}
+	if code, _ := post("/admin/users", `{"ID":"`+user+`"}`); code != http.StatusConflict {
+		t.Errorf("duplicate user: got status %d", code)
+	}
+	if code, _ := post("/admin/users", `{"ID":"CSD2-0001"}`); code != http.StatusBadRequest {
+		t.Errorf("invalid id: got status %d", code)
+	}
+
+	// imported keys are not shown again.
+	other := "CSD000000000002-0001"
+	code, body = post("/admin/users", `{"ID":"`+other+`","PrivateKey":"`+res.PrivateKey+`"}`)
+	imported := OnboardUserResponse{}
+	if err := json.Unmarshal(body, &imported); err != nil {
+		t.Fatal(err)
+	}
+	if code != http.StatusOK || imported.PrivateKey != "" || imported.Address != res.Address {
+		t.Errorf("unexpected import %d %s", code, body)
+	}
+
+	// suspended users can only read and cancel.
+	if code, _ := post("/admin/users/"+user+"/suspend", ""); code != http.StatusOK {
+		t.Fatalf("suspend: got status %d", code)
+	}
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusOK) }
+	for scope, expected := range map[Scope]int{ScopeRead: http.StatusOK, ScopeCancel: http.StatusOK, ScopeTrade: http.StatusForbidden} {
+		c := e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), httptest.NewRecorder())
+		c.Set(authUserKey, user)
+		ex.checkUserStatus(scope, ok)(c)
+		if c.Response().Status != expected {
+			t.Errorf("%s of a suspended user: got status %d, expected %d", scope, c.Response().Status, expected)
+		}
+	}
+	if code, _ := post("/admin/users/"+user+"/reactivate", ""); code != http.StatusOK {
+		t.Errorf("reactivate: got status %d", code)
+	}
+
+	// closing cancels the orders and revokes the api keys.
+	ob := ex.orderbooks[MarketINN]
+	order := orderbook.NewOrder(true, orderbook.NewDecimal(10), user)
+	ob.PlaceLimitOrder(orderbook.NewDecimal(100), order)
+	ex.Orders[user] = []*orderbook.Order{order}
+	key, err := CreateAPIKeyRequest{UserID: user, Scopes: []Scope{ScopeRead}}.validate(time.Unix(0, order.Timestamp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ex.apiKeys.create(key); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := post("/admin/users/"+user+"/close", ""); code != http.StatusOK {
+		t.Fatalf("close: got status %d", code)
+	}
+	if order.Status != orderbook.StatusCancelled || len(ex.Orders[user]) != 0 {
+		t.Errorf("order of a closed user not cancelled: %s", order.Status)
+	}
+	if keys := ex.apiKeys.list(user); len(keys) != 1 || keys[0].RevokedAt == 0 {
+		t.Errorf("api key of a closed user not revoked %+v", keys)
+	}
+	if code, _ := post("/admin/users/"+user+"/reactivate", ""); code != http.StatusConflict {
+		t.Errorf("reactivating a closed user: got status %d", code)
+	}
+
+	// the registry survives a restart.
+	restarted := newExchange()
+	if len(restarted.Users) != 2 || restarted.Users[user].Status != UserClosed || restarted.Users[other].Status != UserActive {
+		t.Errorf("unexpected users after restart %+v", restarted.Users)
+	}
+	if restarted.Users[other].PrivateKey.D.Cmp(ex.Users[other].PrivateKey.D) != 0 {
+		t.Errorf("private key not restored")
+	}
+}